@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Ack modes for ingestion requests. With ackStored the request waits until
+// the consumer has written the log to both ClickHouse and Cassandra.
+const (
+	ackAccepted = "accepted"
+	ackStored   = "stored"
+)
+
+const (
+	defaultAckTimeout = 10 * time.Second
+	maxAckTimeout     = 60 * time.Second
+	ackPollMin        = 25 * time.Millisecond
+	ackPollMax        = 500 * time.Millisecond
+)
+
+// ackResult is what the consumer recorded for one log in log_acks.
+type ackResult struct {
+	Status string // "stored" or "failed"
+	Error  string
+}
+
+// parseAckMode reads the ack and ack_timeout query parameters.
+func parseAckMode(r *http.Request) (string, time.Duration, error) {
+	mode := r.URL.Query().Get("ack")
+	switch mode {
+	case "", ackAccepted:
+		return ackAccepted, 0, nil
+	case ackStored:
+	default:
+		return "", 0, fmt.Errorf("ack must be %q or %q", ackAccepted, ackStored)
+	}
+
+	timeout := defaultAckTimeout
+	if v := r.URL.Query().Get("ack_timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return "", 0, errors.New("ack_timeout must be a positive duration such as 5s")
+		}
+		timeout = d
+	}
+	if timeout > maxAckTimeout {
+		timeout = maxAckTimeout
+	}
+	return ackStored, timeout, nil
+}
+
+// waitForAcks polls log_acks until every log has a result or the timeout
+// passes. Logs still missing at the timeout are absent from the result.
+func waitForAcks(ctx context.Context, projectID string, logIDs []string, timeout time.Duration) (map[string]ackResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make(map[string]ackResult, len(logIDs))
+	pending := logIDs
+	delay := ackPollMin
+	for {
+		rows, err := db.QueryContext(ctx,
+			`SELECT log_id, status, COALESCE(error, '') FROM log_acks WHERE project_id = $1 AND log_id = ANY($2::UUID[])`,
+			projectID, pq.Array(pending),
+		)
+		if err != nil {
+			if ctx.Err() != nil {
+				return results, nil
+			}
+			return results, err
+		}
+		for rows.Next() {
+			var logID string
+			var res ackResult
+			if err := rows.Scan(&logID, &res.Status, &res.Error); err != nil {
+				rows.Close()
+				return results, err
+			}
+			results[logID] = res
+		}
+		rows.Close()
+
+		var still []string
+		for _, id := range pending {
+			if _, ok := results[id]; !ok {
+				still = append(still, id)
+			}
+		}
+		pending = still
+		if len(pending) == 0 {
+			return results, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return results, nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > ackPollMax {
+			delay = ackPollMax
+		}
+	}
+}
+
+// writeStoredAck waits for the consumer to store a single log and reports
+// the outcome: 201 once stored, 500 if the consumer failed to store it and
+// 504 if it is still pending at the timeout. The log is already in Kafka in
+// the last case, so a retry with the same Idempotency-Key is safe.
+func writeStoredAck(w http.ResponseWriter, r *http.Request, projectID, logID string, timeout time.Duration) {
+	results, err := waitForAcks(r.Context(), projectID, []string{logID}, timeout)
+	if err != nil {
+		log.Printf("writeStoredAck: error reading acks for log %s: %v", logID, err)
+	}
+
+	body := map[string]string{"status": "pending", "log_id": logID}
+	status := http.StatusGatewayTimeout
+	if res, ok := results[logID]; ok {
+		body["status"] = res.Status
+		status = http.StatusCreated
+		if res.Status != ackStored {
+			body["error"] = res.Error
+			status = http.StatusInternalServerError
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// waitForBatchAcks waits for the accepted entries of a batch and replaces
+// their status with stored, failed or pending. It returns 504 when any is
+// still pending, 500 when any failed and 200 when all were stored.
+func waitForBatchAcks(ctx context.Context, projectID string, resp *batchResponse, timeout time.Duration) int {
+	var logIDs []string
+	for _, res := range resp.Results {
+		if res.Status == "accepted" {
+			logIDs = append(logIDs, res.LogID)
+		}
+	}
+	acks, err := waitForAcks(ctx, projectID, logIDs, timeout)
+	if err != nil {
+		log.Printf("waitForBatchAcks: error reading acks: %v", err)
+	}
+
+	for i, res := range resp.Results {
+		if res.Status != "accepted" {
+			continue
+		}
+		ack, ok := acks[res.LogID]
+		switch {
+		case !ok:
+			resp.Results[i].Status = "pending"
+			resp.Pending++
+		case ack.Status == ackStored:
+			resp.Results[i].Status = ackStored
+			resp.Stored++
+		default:
+			resp.Results[i].Status = "failed"
+			resp.Results[i].Error = ack.Error
+			resp.Failed++
+		}
+	}
+
+	switch {
+	case resp.Pending > 0:
+		return http.StatusGatewayTimeout
+	case resp.Failed > 0:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusOK
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// backfillStatus is how an index backfill job is returned by the API. The
+// job itself is run by the consumer.
+type backfillStatus struct {
+	Status      string     `json:"status"`
+	Total       int64      `json:"total"`
+	Scanned     int64      `json:"scanned"`
+	Written     int64      `json:"written"`
+	Error       string     `json:"error,omitempty"`
+	RequestedAt time.Time  `json:"requested_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+func loadBackfill(projectID string) (*backfillStatus, error) {
+	var b backfillStatus
+	err := db.QueryRow(`SELECT `+backfillColumns+` FROM index_backfills WHERE project_id = $1`, projectID).Scan(&b.Status, &b.Total, &b.Scanned, &b.Written, &b.Error, &b.RequestedAt, &b.StartedAt, &b.UpdatedAt, &b.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// apiBackfillStatusHandler returns the project's latest index backfill.
+func apiBackfillStatusHandler(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := authenticateProject(w, r)
+	if !ok {
+		return
+	}
+	b, err := loadBackfill(projectID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No backfill for this project", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("apiBackfillStatusHandler: error loading backfill: %v", err)
+		http.Error(w, "Could not load backfill", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// backfillColumns are the columns a backfillStatus is read from.
+const backfillColumns = `status, total, scanned, written, error, requested_at, started_at, updated_at, finished_at`
+
+// startBackfillQuery queues a job for project $1 in one statement, so two
+// requests cannot both start one. A failed job keeps its progress unless $2
+// (restart) is true; any other finished job starts afresh. Nothing is
+// written, and no row returned, while a job is queued or running. Rows
+// ingested after the cutoff are indexed by the live consumer, so a job only
+// rebuilds those before it.
+const startBackfillQuery = `
+	INSERT INTO index_backfills
+		(project_id, status, cutoff, cleared, rewrite_from, paging_state, total, scanned, written, error,
+		 claim_id, lease_until, requested_at, started_at, updated_at, finished_at)
+	VALUES ($1, 'pending', now(), false, NULL, NULL, 0, 0, 0, '', NULL, NULL, now(), NULL, now(), NULL)
+	ON CONFLICT (project_id) DO UPDATE SET
+		status = 'pending', error = '', claim_id = NULL, lease_until = NULL, finished_at = NULL, updated_at = now(),
+		cutoff       = CASE WHEN index_backfills.status = 'failed' AND NOT $2 THEN index_backfills.cutoff       ELSE excluded.cutoff       END,
+		cleared      = CASE WHEN index_backfills.status = 'failed' AND NOT $2 THEN index_backfills.cleared      ELSE excluded.cleared      END,
+		rewrite_from = CASE WHEN index_backfills.status = 'failed' AND NOT $2 THEN index_backfills.rewrite_from ELSE excluded.rewrite_from END,
+		paging_state = CASE WHEN index_backfills.status = 'failed' AND NOT $2 THEN index_backfills.paging_state ELSE excluded.paging_state END,
+		total        = CASE WHEN index_backfills.status = 'failed' AND NOT $2 THEN index_backfills.total        ELSE excluded.total        END,
+		scanned      = CASE WHEN index_backfills.status = 'failed' AND NOT $2 THEN index_backfills.scanned      ELSE excluded.scanned      END,
+		written      = CASE WHEN index_backfills.status = 'failed' AND NOT $2 THEN index_backfills.written      ELSE excluded.written      END,
+		requested_at = CASE WHEN index_backfills.status = 'failed' AND NOT $2 THEN index_backfills.requested_at ELSE excluded.requested_at END,
+		started_at   = CASE WHEN index_backfills.status = 'failed' AND NOT $2 THEN index_backfills.started_at   ELSE excluded.started_at   END
+	WHERE index_backfills.status NOT IN ('pending', 'running')
+	RETURNING ` + backfillColumns
+
+// apiStartBackfillHandler queues a rebuild of the project's logs_index rows
+// from Cassandra. A failed job is continued from its checkpoint unless
+// ?restart=true is given; a job that is queued or running returns 409.
+func apiStartBackfillHandler(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := authenticateProject(w, r)
+	if !ok {
+		return
+	}
+	restart := r.URL.Query().Get("restart") == "true"
+
+	var b backfillStatus
+	err := db.QueryRow(startBackfillQuery, projectID, restart).
+		Scan(&b.Status, &b.Total, &b.Scanned, &b.Written, &b.Error, &b.RequestedAt, &b.StartedAt, &b.UpdatedAt, &b.FinishedAt)
+	if err == sql.ErrNoRows {
+		// The conflicting job may finish in the meantime; report it anyway.
+		existing, err := loadBackfill(projectID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("apiStartBackfillHandler: error loading backfill: %v", err)
+		}
+		if existing == nil {
+			http.Error(w, "A backfill is already queued or running", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(existing)
+		return
+	}
+	if err != nil {
+		log.Printf("apiStartBackfillHandler: error queueing backfill: %v", err)
+		http.Error(w, "Could not start backfill", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(&b)
+}
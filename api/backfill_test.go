@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func backfillRow(status string) []driver.Value {
+	at := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	return []driver.Value{status, int64(10), int64(4), int64(4), "", at, nil, at, nil}
+}
+
+func TestStartBackfillHandler(t *testing.T) {
+	columns := strings.Split(strings.ReplaceAll(backfillColumns, " ", ""), ",")
+	tests := []struct {
+		name     string
+		target   string
+		started  []driver.Value // returned by the INSERT, nil if it wrote nothing
+		existing []driver.Value // the job that blocked it
+		err      error
+		status   int
+		restart  bool
+		job      string // status of the job in the response
+	}{
+		{"queued", "/api/projects/p1/backfill", backfillRow("pending"), nil, nil, http.StatusAccepted, false, "pending"},
+		{"restart", "/api/projects/p1/backfill?restart=true", backfillRow("pending"), nil, nil, http.StatusAccepted, true, "pending"},
+		{"already running", "/api/projects/p1/backfill", nil, backfillRow("running"), nil, http.StatusConflict, false, "running"},
+		{"finished since", "/api/projects/p1/backfill", nil, nil, nil, http.StatusConflict, false, ""},
+		{"database down", "/api/projects/p1/backfill", nil, nil, errors.New("connection refused"), http.StatusInternalServerError, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fdb := useFakeDB(t)
+			fdb.row("SELECT api_key FROM projects WHERE id = $1", []string{"api_key"}, "key1")
+			var restart driver.Value
+			fdb.on("INSERT INTO index_backfills", func(args []driver.Value) (fakeResult, error) {
+				restart = args[1]
+				res := fakeResult{columns: columns}
+				if tt.started != nil {
+					res.rows = [][]driver.Value{tt.started}
+				}
+				return res, tt.err
+			})
+			fdb.on("FROM index_backfills WHERE project_id", func([]driver.Value) (fakeResult, error) {
+				res := fakeResult{columns: columns}
+				if tt.existing != nil {
+					res.rows = [][]driver.Value{tt.existing}
+				}
+				return res, nil
+			})
+
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, tt.target, nil), map[string]string{"projectID": "p1"})
+			req.Header.Set("X-API-KEY", "key1")
+			rec := httptest.NewRecorder()
+			apiStartBackfillHandler(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if restart != tt.restart {
+				t.Errorf("restart = %v, want %v", restart, tt.restart)
+			}
+			if tt.job == "" {
+				return
+			}
+			var b backfillStatus
+			if err := json.Unmarshal(rec.Body.Bytes(), &b); err != nil {
+				t.Fatalf("response %s: %v", rec.Body, err)
+			}
+			if b.Status != tt.job || b.Total != 10 || b.Written != 4 {
+				t.Errorf("job = %+v, want status %s", b, tt.job)
+			}
+		})
+	}
+}
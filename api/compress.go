@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxLogBodyBytes caps the decoded size of a single-log request body.
+const maxLogBodyBytes = 1 << 20
+
+// maxZstdWindow bounds the memory a zstd decoder may use for its window.
+// 8 MiB is what RFC 8878 asks every decoder to support.
+const maxZstdWindow = 8 << 20
+
+// decompressRequest decodes a gzip, deflate or zstd request body according to
+// Content-Encoding, and caps the decoded body at limit bytes. Reading past the
+// limit fails with *http.MaxBytesError, which handlers turn into a 413.
+func decompressRequest(limit int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+		var body io.ReadCloser
+		switch encoding {
+		case "", "identity":
+			body = r.Body
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			body = zr
+		case "deflate":
+			body = newDeflateReader(r.Body)
+		case "zstd":
+			// The window is bounded separately from the body limit, so a
+			// small limit does not reject streams with the usual window.
+			zr, err := zstd.NewReader(r.Body,
+				zstd.WithDecoderConcurrency(1),
+				zstd.WithDecoderMaxWindow(maxZstdWindow),
+				zstd.WithDecoderMaxMemory(uint64(max(limit, maxZstdWindow))),
+			)
+			if err != nil {
+				http.Error(w, "Invalid zstd body", http.StatusBadRequest)
+				return
+			}
+			body = zstdBody{zr.IOReadCloser(), limit}
+		default:
+			http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		defer body.Close()
+
+		r.Body = http.MaxBytesReader(w, body, limit)
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		next(w, r)
+	}
+}
+
+// newDeflateReader accepts both zlib-wrapped data, which is what HTTP
+// "deflate" means, and the raw deflate streams some clients send instead.
+func newDeflateReader(r io.Reader) io.ReadCloser {
+	br := bufio.NewReader(r)
+	if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+		if zr, err := zlib.NewReader(br); err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(br)
+}
+
+// zstdBody reports frames the decoder refuses for their size as a body over
+// the limit, so they get a 413 like any other.
+type zstdBody struct {
+	io.ReadCloser
+	limit int64
+}
+
+func (b zstdBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		err = &http.MaxBytesError{Limit: b.limit}
+	}
+	return n, err
+}
+
+func isZlibHeader(h []byte) bool {
+	return h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0
+}
+
+// isBodyTooLarge reports whether err came from reading past the body limit.
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
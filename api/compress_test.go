@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressBody(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	default:
+		return data
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressRequest(t *testing.T) {
+	const limit = 1024
+	// echo answers with the length of the decoded body, or 413 when it is
+	// over the limit, the way the ingest handlers do.
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			if isBodyTooLarge(err) {
+				http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(strconv.Itoa(len(body))))
+	}
+	handler := decompressRequest(limit, echo)
+
+	atLimit := bytes.Repeat([]byte("a"), limit)
+	overLimit := bytes.Repeat([]byte("a"), limit+1)
+	// A highly compressible body far over the limit, as a zip bomb would be.
+	bomb := bytes.Repeat([]byte("a"), 64*limit)
+
+	tests := []struct {
+		name       string
+		header     string // Content-Encoding sent
+		encoding   string // how the body is encoded
+		body       []byte
+		raw        []byte // sent as is instead of encoding body
+		wantStatus int
+		wantLen    int
+	}{
+		{name: "identity at the limit", body: atLimit, wantStatus: http.StatusOK, wantLen: limit},
+		{name: "identity over the limit", body: overLimit, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "explicit identity", header: "identity", body: atLimit, wantStatus: http.StatusOK, wantLen: limit},
+		{name: "gzip at the limit", header: "gzip", encoding: "gzip", body: atLimit, wantStatus: http.StatusOK, wantLen: limit},
+		{name: "x-gzip", header: "x-gzip", encoding: "gzip", body: atLimit, wantStatus: http.StatusOK, wantLen: limit},
+		{name: "gzip over the limit", header: "gzip", encoding: "gzip", body: overLimit, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "gzip bomb", header: "gzip", encoding: "gzip", body: bomb, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "zlib deflate", header: "deflate", encoding: "deflate", body: atLimit, wantStatus: http.StatusOK, wantLen: limit},
+		{name: "raw deflate", header: "deflate", encoding: "raw-deflate", body: atLimit, wantStatus: http.StatusOK, wantLen: limit},
+		{name: "deflate bomb", header: "deflate", encoding: "deflate", body: bomb, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "zstd at the limit", header: "zstd", encoding: "zstd", body: atLimit, wantStatus: http.StatusOK, wantLen: limit},
+		{name: "zstd bomb", header: "zstd", encoding: "zstd", body: bomb, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "header is case-insensitive", header: " GZIP ", encoding: "gzip", body: atLimit, wantStatus: http.StatusOK, wantLen: limit},
+		{name: "invalid gzip", header: "gzip", raw: []byte("not gzip"), wantStatus: http.StatusBadRequest},
+		{name: "unsupported encoding", header: "br", body: atLimit, wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.raw
+			if body == nil {
+				body = compressBody(t, tt.encoding, tt.body)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			if tt.header != "" {
+				req.Header.Set("Content-Encoding", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus == http.StatusOK && rec.Body.String() != strconv.Itoa(tt.wantLen) {
+				t.Errorf("decoded %s bytes, want %d", rec.Body.String(), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestIsZlibHeader(t *testing.T) {
+	tests := []struct {
+		header []byte
+		want   bool
+	}{
+		{[]byte{0x78, 0x9c}, true},
+		{[]byte{0x78, 0x01}, true},
+		{[]byte{0x78, 0xda}, true},
+		{[]byte{0x78, 0x00}, false},
+		{[]byte{0x1f, 0x8b}, false},
+	}
+	for _, tt := range tests {
+		if got := isZlibHeader(tt.header); got != tt.want {
+			t.Errorf("isZlibHeader(% x) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
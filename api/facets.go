@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Facet sizes: how many of a field's values are listed.
+const (
+	defaultFacetValues = 10
+	maxFacetValues     = 100
+)
+
+// facetsResult breaks the logs matching a search down by field. Total
+// counts every matching log.
+type facetsResult struct {
+	Total  uint64  `json:"total"`
+	Facets []facet `json:"facets"`
+}
+
+// facet is a field's most common values among the matching logs. Uniq
+// estimates how many distinct values it has, and Missing counts the logs
+// without the field.
+type facet struct {
+	Field   string       `json:"field"`
+	Uniq    uint64       `json:"uniq"`
+	Missing uint64       `json:"missing"`
+	Values  []facetValue `json:"values"`
+}
+
+// facetValue is a value's count and its share of Total.
+type facetValue struct {
+	Value string  `json:"value"`
+	Count uint64  `json:"count"`
+	Share float64 `json:"share"`
+}
+
+// loadSearchableKeys returns the project's searchable keys.
+func loadSearchableKeys(projectID string) ([]string, error) {
+	rows, err := db.Query(`SELECT key_name FROM project_searchable_keys WHERE project_id = $1 ORDER BY key_name`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// apiProjectFacetsHandler returns the top values of fields among the logs
+// matching the logs API's filters. Each field parameter names event_name or
+// a searchable key; without any, every one of them is returned. top sets
+// how many values each facet lists.
+func apiProjectFacetsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["projectID"]
+	ctx := context.Background()
+	params := r.URL.Query()
+
+	filter, ok := parseLogFilter(w, r, projectID)
+	if !ok {
+		return
+	}
+	top := defaultFacetValues
+	if s := params.Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxFacetValues {
+			http.Error(w, fmt.Sprintf("top must be between 1 and %d", maxFacetValues), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	keys, err := loadSearchableKeys(projectID)
+	if err != nil {
+		log.Printf("apiProjectFacetsHandler: error loading searchable keys: %v", err)
+		http.Error(w, "Failed to load searchable keys", http.StatusInternalServerError)
+		return
+	}
+	fields := params["field"]
+	if len(fields) == 0 {
+		fields = append([]string{"event_name"}, keys...)
+	}
+	searchable := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		searchable[k] = true
+	}
+	// facetKeys has the searchable key of each field, or "" for event_name.
+	facetKeys := make([]string, len(fields))
+	for i, field := range fields {
+		if col, ok := queryColumns[field]; ok && col == "event_name" {
+			continue
+		}
+		if !searchable[field] {
+			http.Error(w, fmt.Sprintf("field %q: %v", field, errUnknownGroupField), http.StatusBadRequest)
+			return
+		}
+		facetKeys[i] = field
+	}
+
+	result := facetsResult{Facets: make([]facet, len(fields))}
+	for i, field := range fields {
+		result.Facets[i] = facet{Field: field, Values: []facetValue{}}
+	}
+	if err := loadFacetStats(ctx, filter, facetKeys, &result); err != nil {
+		log.Printf("apiProjectFacetsHandler: error querying facet counts: %v", err)
+		http.Error(w, "Failed to query ClickHouse", http.StatusInternalServerError)
+		return
+	}
+	if err := loadFacetValues(ctx, filter, facetKeys, top, &result); err != nil {
+		log.Printf("apiProjectFacetsHandler: error querying facet values: %v", err)
+		http.Error(w, "Failed to query ClickHouse", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// loadFacetStats counts the matching logs and, for every facet, how many
+// have the field and about how many distinct values it has, in one query.
+// Logs without a searchable key are counted as missing.
+func loadFacetStats(ctx context.Context, filter *logFilter, facetKeys []string, result *facetsResult) error {
+	cols := []string{"count()"}
+	var args []interface{}
+	present := make([]uint64, len(facetKeys))
+	dest := []interface{}{&result.Total}
+	for i, key := range facetKeys {
+		if key == "" {
+			cols = append(cols, "count()", "uniq(event_name)")
+		} else {
+			cols = append(cols, "countIf(mapContains(searchable, ?))", "uniqIf(searchable[?], mapContains(searchable, ?))")
+			args = append(args, key, key, key)
+		}
+		dest = append(dest, &present[i], &result.Facets[i].Uniq)
+	}
+	query := `SELECT ` + strings.Join(cols, ", ") + ` FROM ` + logsIndex + ` WHERE ` + filter.where
+	args = append(args, filter.args...)
+	if err := clickhouseConn.QueryRow(ctx, query, args...).Scan(dest...); err != nil {
+		return err
+	}
+	for i := range result.Facets {
+		result.Facets[i].Missing = result.Total - min(present[i], result.Total)
+	}
+	return nil
+}
+
+// loadFacetValues lists the top values of every facet in one query: each
+// log is expanded into one (facet, value) pair per field it has, and the
+// pairs are counted per facet.
+func loadFacetValues(ctx context.Context, filter *logFilter, facetKeys []string, top int, result *facetsResult) error {
+	pairs := make([]string, len(facetKeys))
+	var args []interface{}
+	for i, key := range facetKeys {
+		idx := strconv.Itoa(i)
+		if key == "" {
+			pairs[i] = "tuple(toUInt16(" + idx + "), event_name, toUInt8(1))"
+		} else {
+			pairs[i] = "tuple(toUInt16(" + idx + "), searchable[?], toUInt8(mapContains(searchable, ?)))"
+			args = append(args, key, key)
+		}
+	}
+	query := `
+          SELECT fv.1 AS facet, fv.2 AS value, count() AS c
+          FROM ` + logsIndex + `
+          ARRAY JOIN arrayFilter(p -> p.3 = 1, [` + strings.Join(pairs, ", ") + `]) AS fv
+          WHERE ` + filter.where + `
+          GROUP BY facet, value
+          ORDER BY facet, c DESC, value
+          LIMIT ? BY facet
+        `
+	args = append(append(args, filter.args...), top)
+	rows, err := clickhouseConn.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i uint16
+		var v facetValue
+		if err := rows.Scan(&i, &v.Value, &v.Count); err != nil {
+			return err
+		}
+		if int(i) >= len(result.Facets) {
+			continue
+		}
+		if result.Total > 0 {
+			v.Share = float64(v.Count) / float64(result.Total)
+		}
+		result.Facets[i].Values = append(result.Facets[i].Values, v)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	chdriver "github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeWriter stands in for the Kafka writer and keeps what is written.
+type fakeWriter struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+	// err, if set, is returned instead of writing.
+	err error
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+// useFakeWriter replaces kafkaWriter for the rest of the test.
+func useFakeWriter(t *testing.T) *fakeWriter {
+	t.Helper()
+	w := &fakeWriter{}
+	prev := kafkaWriter
+	kafkaWriter = w
+	t.Cleanup(func() { kafkaWriter = prev })
+	return w
+}
+
+// fakeResult is what a fakeDB handler answers a statement with.
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+// fakeQuery answers the statements that contain match.
+type fakeQuery struct {
+	match  string
+	answer func(args []driver.Value) (fakeResult, error)
+}
+
+// fakeDB is a database/sql driver that answers each statement with the
+// first handler whose match it contains. Statements no handler matches
+// return no rows and affect none.
+type fakeDB struct {
+	mu       sync.Mutex
+	queries  []fakeQuery
+	executed []string
+}
+
+// on adds a handler for the statements that contain match.
+func (f *fakeDB) on(match string, answer func(args []driver.Value) (fakeResult, error)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, fakeQuery{match: match, answer: answer})
+}
+
+// row answers the statements that contain match with one row.
+func (f *fakeDB) row(match string, columns []string, values ...driver.Value) {
+	f.on(match, func([]driver.Value) (fakeResult, error) {
+		return fakeResult{columns: columns, rows: [][]driver.Value{values}}, nil
+	})
+}
+
+func (f *fakeDB) answer(query string, args []driver.NamedValue) (fakeResult, error) {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	f.mu.Lock()
+	f.executed = append(f.executed, query)
+	queries := f.queries
+	f.mu.Unlock()
+	for _, q := range queries {
+		if strings.Contains(query, q.match) {
+			return q.answer(values)
+		}
+	}
+	return fakeResult{}, nil
+}
+
+var fakeDBs = struct {
+	sync.Mutex
+	byName map[string]*fakeDB
+}{byName: make(map[string]*fakeDB)}
+
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+// useFakeDB replaces db for the rest of the test.
+func useFakeDB(t *testing.T) *fakeDB {
+	t.Helper()
+	f := &fakeDB{}
+	fakeDBs.Lock()
+	fakeDBs.byName[t.Name()] = f
+	fakeDBs.Unlock()
+	conn, err := sql.Open("fakedb", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := db
+	db = conn
+	t.Cleanup(func() {
+		db = prev
+		conn.Close()
+		fakeDBs.Lock()
+		delete(fakeDBs.byName, t.Name())
+		fakeDBs.Unlock()
+	})
+	return f
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+	f, ok := fakeDBs.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("no fake database %q", name)
+	}
+	return &fakeConn{db: f}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakedb: transactions are not supported")
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.db.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: res.columns, rows: res.rows}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.db.answer(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(res.affected), nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, named(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, named(args))
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		out[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return out
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// fakeClickhouse answers the count and the page queries of the log list.
+// Every other method of clickhouse.Conn panics.
+type fakeClickhouse struct {
+	clickhouse.Conn
+	count uint64
+	rows  *fakeCHRows
+}
+
+func (c *fakeClickhouse) QueryRow(ctx context.Context, query string, args ...interface{}) chdriver.Row {
+	return &fakeCHRows{rows: [][]interface{}{{c.count}}}
+}
+
+func (c *fakeClickhouse) Query(ctx context.Context, query string, args ...interface{}) (chdriver.Rows, error) {
+	return c.rows, nil
+}
+
+// useFakeClickhouse replaces clickhouseConn for the rest of the test.
+func useFakeClickhouse(t *testing.T, c *fakeClickhouse) {
+	t.Helper()
+	prev := clickhouseConn
+	clickhouseConn = c
+	t.Cleanup(func() { clickhouseConn = prev })
+}
+
+// fakeCHRows serves rows in order. Scanning row scanErrAt (counted from 1)
+// fails with scanErr, and err is reported by Err once the rows run out.
+type fakeCHRows struct {
+	chdriver.Rows
+	rows      [][]interface{}
+	current   []interface{}
+	scanned   int
+	scanErrAt int
+	scanErr   error
+	err       error
+}
+
+func (r *fakeCHRows) Next() bool {
+	if len(r.rows) == 0 {
+		return false
+	}
+	r.current, r.rows = r.rows[0], r.rows[1:]
+	return true
+}
+
+func (r *fakeCHRows) Scan(dest ...interface{}) error {
+	if r.current == nil && len(r.rows) > 0 {
+		// QueryRow scans without calling Next.
+		r.Next()
+	}
+	r.scanned++
+	if r.scanned == r.scanErrAt {
+		return r.scanErr
+	}
+	for i, v := range r.current {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+	}
+	return nil
+}
+
+func (r *fakeCHRows) Err() error   { return r.err }
+func (r *fakeCHRows) Close() error { return nil }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Full-text search runs over payload_text, the payload's string values,
+// which logs_index indexes with token and n-gram bloom filters on
+// lowerUTF8(payload_text). Conditions use that same expression so the
+// skip indexes apply. Free text is read as
+//
+//	declined        a term: a whole token, using the token index
+//	declin*         a prefix: a token starting with it
+//	"card declined" a phrase: the exact text, using the n-gram index
+//
+// Anything else (other wildcards, words with punctuation) is matched as a
+// substring pattern.
+
+// snippetRadius is how many characters of context a snippet keeps on each
+// side of its first match.
+const snippetRadius = 60
+
+// isToken reports whether s is a single token as ClickHouse splits them:
+// ASCII letters and digits and any non-ASCII characters.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < 0x80 && !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixTerm returns the prefix of a prefix query such as declin*.
+func prefixTerm(v queryValue) (string, bool) {
+	if v.quoted {
+		return "", false
+	}
+	prefix, ok := strings.CutSuffix(v.text, "*")
+	return prefix, ok && isToken(prefix)
+}
+
+// fullText compiles free text against payload_text.
+func (b *sqlBuilder) fullText(v queryValue) {
+	lower := strings.ToLower(v.text)
+	if prefix, ok := prefixTerm(v); ok {
+		// The LIKE narrows rows with the n-gram index; the regex keeps
+		// only matches at the start of a token.
+		prefix = strings.ToLower(prefix)
+		b.write("(lowerUTF8(payload_text) LIKE ? AND match(lowerUTF8(payload_text), ?))",
+			likePattern(queryValue{text: prefix, quoted: true}, true),
+			`(^|[^a-z0-9\x{80}-\x{10FFFF}])`+regexp.QuoteMeta(prefix))
+		return
+	}
+	if !v.quoted && isToken(lower) {
+		b.write("hasToken(lowerUTF8(payload_text), ?)", lower)
+		return
+	}
+	b.write("lowerUTF8(payload_text) LIKE ?", likePattern(queryValue{text: lower, quoted: v.quoted}, true))
+}
+
+// textTerms collects the free text of a query that a hit must contain, so
+// it can be highlighted. Terms under NOT are left out.
+func textTerms(n queryNode) []queryValue {
+	var terms []queryValue
+	var walk func(queryNode)
+	walk = func(n queryNode) {
+		switch n := n.(type) {
+		case andNode:
+			for _, c := range n.children {
+				walk(c)
+			}
+		case orNode:
+			for _, c := range n.children {
+				walk(c)
+			}
+		case textNode:
+			terms = append(terms, n.value)
+		}
+	}
+	if n != nil {
+		walk(n)
+	}
+	return terms
+}
+
+// span is a match in a []rune, from start up to end.
+type span struct{ start, end int }
+
+// highlight returns a snippet of text around the first match of terms,
+// HTML-escaped, with every match in it wrapped in <mark>. It returns "" when
+// nothing matches.
+func highlight(text string, terms []queryValue) string {
+	rs := []rune(text)
+	lower := make([]rune, len(rs))
+	for i, r := range rs {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	var spans []span
+	for _, t := range terms {
+		spans = append(spans, findTerm(lower, t)...)
+	}
+	if len(spans) == 0 {
+		return ""
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	from := max(spans[0].start-snippetRadius, 0)
+	to := min(spans[0].end+snippetRadius, len(rs))
+	var sb strings.Builder
+	if from > 0 {
+		sb.WriteString("…")
+	}
+	pos := from
+	for _, s := range spans {
+		if s.start < pos || s.end > to {
+			continue
+		}
+		sb.WriteString(html.EscapeString(string(rs[pos:s.start])))
+		sb.WriteString("<mark>")
+		sb.WriteString(html.EscapeString(string(rs[s.start:s.end])))
+		sb.WriteString("</mark>")
+		pos = s.end
+	}
+	sb.WriteString(html.EscapeString(string(rs[pos:to])))
+	if to < len(rs) {
+		sb.WriteString("…")
+	}
+	return sb.String()
+}
+
+// findTerm finds a term in lowercased text: a whole token for terms, the
+// start of a token for prefixes, and anywhere for phrases and patterns.
+func findTerm(lower []rune, t queryValue) []span {
+	if prefix, ok := prefixTerm(t); ok {
+		return findRunes(lower, []rune(strings.ToLower(prefix)), true, false)
+	}
+	if !t.quoted && isToken(t.text) {
+		return findRunes(lower, []rune(strings.ToLower(t.text)), true, true)
+	}
+	if !t.wildcard() {
+		return findRunes(lower, []rune(strings.ToLower(t.text)), false, false)
+	}
+	var expr strings.Builder
+	for _, r := range strings.ToLower(t.text) {
+		switch r {
+		case '*':
+			expr.WriteString(".*?")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil
+	}
+	text := string(lower)
+	var spans []span
+	for _, loc := range re.FindAllStringIndex(text, -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		start := utf8.RuneCountInString(text[:loc[0]])
+		spans = append(spans, span{start, start + utf8.RuneCountInString(text[loc[0]:loc[1]])})
+	}
+	return spans
+}
+
+func findRunes(text, needle []rune, tokenStart, tokenEnd bool) []span {
+	var spans []span
+	if len(needle) == 0 {
+		return nil
+	}
+	for i := 0; i+len(needle) <= len(text); i++ {
+		if !equalRunes(text[i:i+len(needle)], needle) {
+			continue
+		}
+		end := i + len(needle)
+		if tokenStart && i > 0 && isTokenRune(text[i-1]) {
+			continue
+		}
+		if tokenEnd && end < len(text) && isTokenRune(text[end]) {
+			continue
+		}
+		spans = append(spans, span{i, end})
+		i = end - 1
+	}
+	return spans
+}
+
+func equalRunes(a, b []rune) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isTokenRune(r rune) bool {
+	return r >= 0x80 || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsToken(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"declined", true},
+		{"Error42", true},
+		{"größe", true},
+		{"", false},
+		{"card declined", false},
+		{"user_id", false},
+		{"a-b", false},
+		{"declin*", false},
+	}
+	for _, tt := range tests {
+		if got := isToken(tt.in); got != tt.want {
+			t.Errorf("isToken(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixTerm(t *testing.T) {
+	tests := []struct {
+		v      queryValue
+		prefix string
+		ok     bool
+	}{
+		{queryValue{text: "declin*"}, "declin", true},
+		{queryValue{text: "declin*", quoted: true}, "", false},
+		{queryValue{text: "declined"}, "declined", false},
+		{queryValue{text: "*"}, "", false},
+		{queryValue{text: "de*lin*"}, "de*lin", false},
+		{queryValue{text: "user_*"}, "user_", false},
+	}
+	for _, tt := range tests {
+		prefix, ok := prefixTerm(tt.v)
+		if ok != tt.ok || (ok && prefix != tt.prefix) {
+			t.Errorf("prefixTerm(%+v) = %q, %v; want %q, %v", tt.v, prefix, ok, tt.prefix, tt.ok)
+		}
+	}
+}
+
+func TestFullText(t *testing.T) {
+	tests := []struct {
+		v    queryValue
+		sql  string
+		args []interface{}
+	}{
+		{
+			v:    queryValue{text: "Declined"},
+			sql:  "hasToken(lowerUTF8(payload_text), ?)",
+			args: []interface{}{"declined"},
+		},
+		{
+			v:    queryValue{text: "Declin*"},
+			sql:  "(lowerUTF8(payload_text) LIKE ? AND match(lowerUTF8(payload_text), ?))",
+			args: []interface{}{"%declin%", `(^|[^a-z0-9\x{80}-\x{10FFFF}])declin`},
+		},
+		{
+			v:    queryValue{text: "Card Declined", quoted: true},
+			sql:  "lowerUTF8(payload_text) LIKE ?",
+			args: []interface{}{"%card declined%"},
+		},
+		{
+			v:    queryValue{text: "user_id"},
+			sql:  "lowerUTF8(payload_text) LIKE ?",
+			args: []interface{}{`%user\_id%`},
+		},
+		{
+			v:    queryValue{text: "time*out"},
+			sql:  "lowerUTF8(payload_text) LIKE ?",
+			args: []interface{}{"%time%out%"},
+		},
+	}
+	for _, tt := range tests {
+		var b sqlBuilder
+		b.fullText(tt.v)
+		if got := b.sb.String(); got != tt.sql {
+			t.Errorf("fullText(%+v) sql = %s, want %s", tt.v, got, tt.sql)
+		}
+		if !reflect.DeepEqual(b.args, tt.args) {
+			t.Errorf("fullText(%+v) args = %#v, want %#v", tt.v, b.args, tt.args)
+		}
+	}
+}
+
+func TestTextTerms(t *testing.T) {
+	n, err := parseQuery(`declined OR (a:1 "card error") NOT timeout time*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range textTerms(n) {
+		if v.quoted {
+			got = append(got, `"`+v.text+`"`)
+		} else {
+			got = append(got, v.text)
+		}
+	}
+	want := []string{"declined", `"card error"`, "time*"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("textTerms = %q, want %q", got, want)
+	}
+	if terms := textTerms(nil); terms != nil {
+		t.Errorf("textTerms(nil) = %v, want nil", terms)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	term := func(s string) queryValue { return queryValue{text: s} }
+	phrase := func(s string) queryValue { return queryValue{text: s, quoted: true} }
+	long := strings.Repeat("a ", 50) + "hit" + strings.Repeat(" b", 50)
+
+	tests := []struct {
+		name  string
+		text  string
+		terms []queryValue
+		want  string
+	}{
+		{"term", "Card declined by bank", []queryValue{term("declined")}, "Card <mark>declined</mark> by bank"},
+		{"term ignores case", "DECLINED", []queryValue{term("declined")}, "<mark>DECLINED</mark>"},
+		{"term is a whole token", "undeclined declines", []queryValue{term("declined")}, ""},
+		{"prefix", "payment declined", []queryValue{term("declin*")}, "payment <mark>declin</mark>ed"},
+		{"prefix starts a token", "undeclined", []queryValue{term("declin*")}, ""},
+		{"phrase", "Card Declined!", []queryValue{phrase("card declined")}, "<mark>Card Declined</mark>!"},
+		{"phrase inside a token", "xcard declinedx", []queryValue{phrase("card declined")}, "x<mark>card declined</mark>x"},
+		{"pattern", "xabcx abd", []queryValue{term("a?c")}, "x<mark>abc</mark>x abd"},
+		{"escapes html", "<b>error</b> & more", []queryValue{term("error")}, "&lt;b&gt;<mark>error</mark>&lt;/b&gt; &amp; more"},
+		{"non-ascii", "Größe überschritten", []queryValue{term("größe")}, "<mark>Größe</mark> überschritten"},
+		{
+			"every match", "error then timeout error",
+			[]queryValue{term("timeout"), term("error")},
+			"<mark>error</mark> then <mark>timeout</mark> <mark>error</mark>",
+		},
+		{
+			"snippet around the first match", long, []queryValue{term("hit")},
+			"…" + strings.Repeat("a ", 30) + "<mark>hit</mark>" + strings.Repeat(" b", 30) + "…",
+		},
+		{"no terms", "anything", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlight(tt.text, tt.terms); got != tt.want {
+				t.Errorf("highlight(%q) =\n  %q\nwant\n  %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindTerm(t *testing.T) {
+	tests := []struct {
+		text string
+		term queryValue
+		want []span
+	}{
+		{"a b a", queryValue{text: "a"}, []span{{0, 1}, {4, 5}}},
+		{"aaa", queryValue{text: "aa", quoted: true}, []span{{0, 2}}},
+		{"über über", queryValue{text: "über"}, []span{{0, 4}, {5, 9}}},
+		{"ab ac", queryValue{text: "a*"}, []span{{0, 1}, {3, 4}}},
+		{"x*y", queryValue{text: "*"}, nil},
+	}
+	for _, tt := range tests {
+		if got := findTerm([]rune(tt.text), tt.term); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("findTerm(%q, %+v) = %v, want %v", tt.text, tt.term, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Histogram limits. An automatic interval aims for about targetBuckets
+// buckets; a chosen one may make up to maxBuckets.
+const (
+	targetBuckets = 60
+	maxBuckets    = 1000
+	defaultSeries = 5
+	maxSeries     = 20
+)
+
+// histogramIntervals are the intervals an automatic interval is picked
+// from.
+var histogramIntervals = []time.Duration{
+	time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+	time.Minute, 5 * time.Minute, 10 * time.Minute, 30 * time.Minute,
+	time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+	24 * time.Hour, 7 * 24 * time.Hour, 30 * 24 * time.Hour,
+}
+
+// histogram is log counts over time. Buckets are the start of each
+// interval in unix milliseconds, and Counts the logs in each. When grouped,
+// Series has the counts of the most common values and Other the counts of
+// the rest.
+type histogram struct {
+	Interval   string            `json:"interval"`
+	IntervalMs int64             `json:"interval_ms"`
+	From       int64             `json:"from"`
+	To         int64             `json:"to"`
+	GroupBy    string            `json:"group_by,omitempty"`
+	Total      uint64            `json:"total"`
+	Buckets    []int64           `json:"buckets"`
+	Counts     []uint64          `json:"counts"`
+	Series     []histogramSeries `json:"series,omitempty"`
+	Other      []uint64          `json:"other,omitempty"`
+}
+
+type histogramSeries struct {
+	Value  string   `json:"value"`
+	Total  uint64   `json:"total"`
+	Counts []uint64 `json:"counts"`
+}
+
+// parseInterval reads the interval parameter. Buckets start at multiples
+// of the interval since the epoch, in UTC, so an interval under a day must
+// divide a day and a longer one must be whole days.
+func parseInterval(s string) (time.Duration, error) {
+	d, err := parseRelativeDuration(s)
+	if err != nil || d < time.Second || d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid interval %q", s)
+	}
+	day := 24 * time.Hour
+	if (d < day && day%d != 0) || (d >= day && d%day != 0) {
+		return 0, fmt.Errorf("interval %q must divide a day or be whole days", s)
+	}
+	return d, nil
+}
+
+// formatInterval writes an interval in the largest unit that divides it.
+func formatInterval(d time.Duration) string {
+	for _, u := range []struct {
+		size time.Duration
+		name string
+	}{{24 * time.Hour, "d"}, {time.Hour, "h"}, {time.Minute, "m"}} {
+		if d%u.size == 0 {
+			return strconv.FormatInt(int64(d/u.size), 10) + u.name
+		}
+	}
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
+
+// autoInterval picks the shortest interval that splits span into fewer
+// than targetBuckets buckets.
+func autoInterval(span time.Duration) time.Duration {
+	for _, iv := range histogramIntervals {
+		if span/iv < targetBuckets {
+			return iv
+		}
+	}
+	return histogramIntervals[len(histogramIntervals)-1]
+}
+
+// alignBuckets returns the start of the bucket holding from, in unix
+// milliseconds, and how many buckets of ivMs it takes to reach to.
+func alignBuckets(from, to, ivMs int64) (int64, int) {
+	start := from - ((from%ivMs)+ivMs)%ivMs
+	return start, int((to - start + ivMs - 1) / ivMs)
+}
+
+// bucketExpr is the start of a log's bucket in unix seconds.
+func bucketExpr(interval time.Duration) (string, interface{}) {
+	if interval >= 24*time.Hour {
+		return "toUnixTimestamp(toDateTime(toStartOfInterval(timestamp, toIntervalDay(?), 'UTC'), 'UTC'))", int64(interval / (24 * time.Hour))
+	}
+	return "toUnixTimestamp(toDateTime(toStartOfInterval(timestamp, toIntervalSecond(?), 'UTC'), 'UTC'))", int64(interval / time.Second)
+}
+
+// apiProjectHistogramHandler counts the logs matching the logs API's
+// filters per time bucket, optionally split by event_name or a searchable
+// key. interval is a duration such as 5m or 1d, or auto (the default).
+// group_by names the field and top how many of its values get a series.
+func apiProjectHistogramHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	projectID := vars["projectID"]
+	ctx := context.Background()
+	params := r.URL.Query()
+
+	filter, ok := parseLogFilter(w, r, projectID)
+	if !ok {
+		return
+	}
+	var interval time.Duration
+	if s := params.Get("interval"); s != "" && s != "auto" {
+		var err error
+		if interval, err = parseInterval(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	top := defaultSeries
+	if s := params.Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSeries {
+			http.Error(w, fmt.Sprintf("top must be between 1 and %d", maxSeries), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	groupBy := params.Get("group_by")
+	var group string
+	var groupArgs []interface{}
+	if groupBy != "" {
+		var err error
+		group, groupArgs, err = groupColumn(projectID, groupBy)
+		if err == errUnknownGroupField {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("apiProjectHistogramHandler: error loading searchable keys: %v", err)
+			http.Error(w, "Failed to load searchable keys", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// An open start is the oldest matching log. An open end is now, or
+	// the newest log if that is later, so recent quiet time still shows.
+	h := histogram{GroupBy: groupBy, Buckets: []int64{}, Counts: []uint64{}}
+	from, to := filter.from.UnixMilli(), filter.to.UnixMilli()
+	if filter.from.IsZero() || filter.to.IsZero() {
+		var minTS, maxTS int64
+		rangeQuery := `SELECT count(), toUnixTimestamp64Milli(min(timestamp)), toUnixTimestamp64Milli(max(timestamp)) FROM ` + logsIndex + ` WHERE ` + filter.where
+		if err := clickhouseConn.QueryRow(ctx, rangeQuery, filter.args...).Scan(&h.Total, &minTS, &maxTS); err != nil {
+			log.Printf("apiProjectHistogramHandler: error reading time range: %v", err)
+			http.Error(w, "Failed to query ClickHouse", http.StatusInternalServerError)
+			return
+		}
+		if filter.to.IsZero() {
+			to = max(time.Now().UnixMilli(), maxTS+1)
+		}
+		if filter.from.IsZero() {
+			from = minTS
+			if h.Total == 0 {
+				from = to
+			}
+		}
+		from = min(from, to)
+	}
+	h.From, h.To = from, to
+	span := time.Duration(to-from) * time.Millisecond
+
+	if interval == 0 {
+		interval = autoInterval(span)
+	}
+	ivMs := interval.Milliseconds()
+	start, n := alignBuckets(from, to, ivMs)
+	if n > maxBuckets {
+		http.Error(w, fmt.Sprintf("interval %s makes %d buckets, at most %d are allowed", formatInterval(interval), n, maxBuckets), http.StatusBadRequest)
+		return
+	}
+	h.Interval, h.IntervalMs = formatInterval(interval), ivMs
+	if from == to {
+		writeHistogram(w, h)
+		return
+	}
+	for i := 0; i < n; i++ {
+		h.Buckets = append(h.Buckets, start+int64(i)*ivMs)
+	}
+	h.Counts = make([]uint64, n)
+
+	// Series are the group's most common values over the whole range.
+	// series is a log's 1-based index into them, or 0 for the rest. Logs
+	// without a searchable key are never a series, as in facets.
+	seriesExpr, seriesArgs := "toUInt64(0)", []interface{}(nil)
+	if group != "" {
+		where, whereArgs := filter.where, filter.args
+		if len(groupArgs) > 0 {
+			where += " AND mapContains(searchable, ?)"
+			whereArgs = append(append([]interface{}{}, whereArgs...), groupArgs...)
+		}
+		topQuery := `SELECT ` + group + ` AS value, count() AS c FROM ` + logsIndex + ` WHERE ` + where + ` GROUP BY value ORDER BY c DESC, value LIMIT ?`
+		args := append(append(append([]interface{}{}, groupArgs...), whereArgs...), top)
+		values, err := loadSeries(ctx, topQuery, args, n, &h)
+		if err != nil {
+			log.Printf("apiProjectHistogramHandler: error querying top values: %v", err)
+			http.Error(w, "Failed to query ClickHouse", http.StatusInternalServerError)
+			return
+		}
+		if len(values) > 0 {
+			seriesExpr = "indexOf(?, " + group + ")"
+			seriesArgs = append([]interface{}{values}, groupArgs...)
+			if len(groupArgs) > 0 {
+				seriesExpr = "if(mapContains(searchable, ?), " + seriesExpr + ", 0)"
+				seriesArgs = append(append([]interface{}{}, groupArgs...), seriesArgs...)
+			}
+			h.Other = make([]uint64, n)
+		}
+	}
+
+	bucket, ivArg := bucketExpr(interval)
+	query := `
+          SELECT ` + bucket + ` AS bucket, ` + seriesExpr + ` AS series, count()
+          FROM ` + logsIndex + `
+          WHERE ` + filter.where + `
+          GROUP BY bucket, series
+        `
+	args := append(append([]interface{}{ivArg}, seriesArgs...), filter.args...)
+	rows, err := clickhouseConn.Query(ctx, query, args...)
+	if err != nil {
+		log.Printf("apiProjectHistogramHandler: error querying ClickHouse: %v", err)
+		http.Error(w, "Failed to query ClickHouse", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	h.Total = 0
+	for rows.Next() {
+		var sec uint32
+		var series uint64
+		var count uint64
+		if err := rows.Scan(&sec, &series, &count); err != nil {
+			log.Printf("apiProjectHistogramHandler: error reading row: %v", err)
+			http.Error(w, "Error reading rows", http.StatusInternalServerError)
+			return
+		}
+		i := (int64(sec)*1000 - start) / ivMs
+		if i < 0 || i >= int64(n) {
+			continue
+		}
+		h.Counts[i] += count
+		h.Total += count
+		switch {
+		case series > 0 && int(series) <= len(h.Series):
+			h.Series[series-1].Counts[i] += count
+		case h.Other != nil:
+			h.Other[i] += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading rows", http.StatusInternalServerError)
+		return
+	}
+	writeHistogram(w, h)
+}
+
+// loadSeries runs the top values query and adds a series with n buckets to
+// h for each value, returning the values in order.
+func loadSeries(ctx context.Context, query string, args []interface{}, n int, h *histogram) ([]string, error) {
+	rows, err := clickhouseConn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var s histogramSeries
+		if err := rows.Scan(&s.Value, &s.Total); err != nil {
+			return nil, err
+		}
+		s.Counts = make([]uint64, n)
+		h.Series = append(h.Series, s)
+		values = append(values, s.Value)
+	}
+	return values, rows.Err()
+}
+
+func writeHistogram(w http.ResponseWriter, h histogram) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
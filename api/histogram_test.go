@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInterval(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"1s", time.Second, true},
+		{"5m", 5 * time.Minute, true},
+		{"90m", 90 * time.Minute, true},
+		{"1h", time.Hour, true},
+		{"1d", 24 * time.Hour, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2w", 14 * 24 * time.Hour, true},
+		{"7m", 0, false},
+		{"36h", 0, false},
+		{"500ms", 0, false},
+		{"1.5s", 0, false},
+		{"0s", 0, false},
+		{"-1m", 0, false},
+		{"auto", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseInterval(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parseInterval(%q) = %v, %v; want %v, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatInterval(t *testing.T) {
+	tests := []struct {
+		in   time.Duration
+		want string
+	}{
+		{time.Second, "1s"},
+		{90 * time.Second, "90s"},
+		{5 * time.Minute, "5m"},
+		{90 * time.Minute, "90m"},
+		{2 * time.Hour, "2h"},
+		{24 * time.Hour, "1d"},
+		{7 * 24 * time.Hour, "7d"},
+	}
+	for _, tt := range tests {
+		if got := formatInterval(tt.in); got != tt.want {
+			t.Errorf("formatInterval(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAutoInterval(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		span time.Duration
+		want time.Duration
+	}{
+		{0, time.Second},
+		{59 * time.Second, time.Second},
+		{time.Minute, 5 * time.Second},
+		{time.Hour, 5 * time.Minute},
+		{day, 30 * time.Minute},
+		{365 * day, 7 * day},
+		{3650 * day, 30 * day},
+	}
+	for _, tt := range tests {
+		if got := autoInterval(tt.span); got != tt.want {
+			t.Errorf("autoInterval(%v) = %v, want %v", tt.span, got, tt.want)
+		}
+	}
+}
+
+func TestAlignBuckets(t *testing.T) {
+	noon := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC).UnixMilli()
+	midnight := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC).UnixMilli()
+	dayMs := (24 * time.Hour).Milliseconds()
+
+	tests := []struct {
+		name           string
+		from, to, ivMs int64
+		start          int64
+		n              int
+	}{
+		{"empty range", 0, 0, 1000, 0, 0},
+		{"aligned", 2000, 3000, 1000, 2000, 1},
+		{"just past a bucket", 2000, 3001, 1000, 2000, 2},
+		{"unaligned", 1500, 3500, 1000, 1000, 3},
+		{"before the epoch", -1500, 500, 1000, -2000, 3},
+		{"days start at midnight UTC", noon, noon + dayMs, dayMs, midnight, 2},
+	}
+	for _, tt := range tests {
+		start, n := alignBuckets(tt.from, tt.to, tt.ivMs)
+		if start != tt.start || n != tt.n {
+			t.Errorf("%s: alignBuckets(%d, %d, %d) = %d, %d; want %d, %d", tt.name, tt.from, tt.to, tt.ivMs, start, n, tt.start, tt.n)
+		}
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// maxBatchEntries caps how many logs a single batch request may carry.
+	maxBatchEntries = 1000
+	// maxBatchBodyBytes caps the decoded size of a batch request body.
+	maxBatchBodyBytes = 10 << 20
+)
+
+// Event timestamps outside [now-maxEventAge, now+maxEventSkew] are rejected.
+// Both can be overridden with EVENT_TIME_MAX_AGE and EVENT_TIME_MAX_SKEW.
+var (
+	maxEventAge  = 7 * 24 * time.Hour
+	maxEventSkew = 5 * time.Minute
+)
+
+func initIngest() error {
+	if v := os.Getenv("EVENT_TIME_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid EVENT_TIME_MAX_AGE: %w", err)
+		}
+		maxEventAge = d
+	}
+	if v := os.Getenv("EVENT_TIME_MAX_SKEW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid EVENT_TIME_MAX_SKEW: %w", err)
+		}
+		maxEventSkew = d
+	}
+	return nil
+}
+
+// idempotencyNamespace seeds the name-based UUIDs derived from Idempotency-Key
+// headers, so the same key always maps to the same log ID within a project.
+var idempotencyNamespace = uuid.MustParse("8f0c2a4e-5b7d-4c1a-9e36-2d4b7f1a6c58")
+
+// logEnvelope is the message published to the logs topic for every accepted
+// log. Times are unix milliseconds.
+type logEnvelope struct {
+	ProjectID  string                 `json:"project_id"`
+	LogID      string                 `json:"log_id"`
+	EventTime  int64                  `json:"event_time"`
+	IngestedAt int64                  `json:"ingested_at"`
+	Payload    map[string]interface{} `json:"payload"`
+	// Ack asks the consumer to record the outcome in log_acks when "stored".
+	Ack string `json:"ack,omitempty"`
+}
+
+// batchItemResult reports what happened to one entry of a batch request.
+type batchItemResult struct {
+	Index       int          `json:"index"`
+	Status      string       `json:"status"`
+	LogID       string       `json:"log_id,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	FieldErrors []fieldError `json:"field_errors,omitempty"`
+}
+
+type batchResponse struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+	// Stored, Failed and Pending break down the accepted entries when the
+	// client waits with ack=stored.
+	Stored  int               `json:"stored,omitempty"`
+	Failed  int               `json:"failed,omitempty"`
+	Pending int               `json:"pending,omitempty"`
+	Results []batchItemResult `json:"results"`
+}
+
+// authenticateProject checks the X-API-KEY header against the project in the
+// route. It writes the error response itself and returns false on failure.
+func authenticateProject(w http.ResponseWriter, r *http.Request) (string, bool) {
+	projectID := mux.Vars(r)["projectID"]
+	apiKey := r.Header.Get("X-API-KEY")
+
+	if apiKey == "" {
+		http.Error(w, "Missing API key", http.StatusUnauthorized)
+		return "", false
+	}
+
+	// Validate API key against the database
+	var dbApiKey string
+	err := db.QueryRow(`SELECT api_key FROM projects WHERE id = $1`, projectID).Scan(&dbApiKey)
+	if err != nil || dbApiKey != apiKey {
+		http.Error(w, "Invalid API key or project", http.StatusUnauthorized)
+		return "", false
+	}
+	return projectID, true
+}
+
+// authenticateAPIKey finds the project that owns the X-API-KEY header, for
+// routes without a project in the path. It writes the error response itself
+// and returns false on failure.
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	apiKey := r.Header.Get("X-API-KEY")
+	if apiKey == "" {
+		http.Error(w, "Missing API key", http.StatusUnauthorized)
+		return "", false
+	}
+
+	var projectID string
+	err := db.QueryRow(`SELECT id FROM projects WHERE api_key = $1`, apiKey).Scan(&projectID)
+	if err != nil {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return "", false
+	}
+	return projectID, true
+}
+
+// validateLog checks the fields the consumer relies on and returns the event
+// time of the log. Logs without a timestamp take the ingest time, which the
+// handlers replace with the first one for logs that pinsEventTime.
+func validateLog(incomingLog map[string]interface{}, ingestedAt time.Time) (time.Time, error) {
+	eventName, ok := incomingLog["event_name"].(string)
+	if !ok || eventName == "" {
+		return time.Time{}, errors.New("event_name must be a non-empty string")
+	}
+	if payload, present := incomingLog["payload"]; present && payload != nil {
+		if _, ok := payload.(map[string]interface{}); !ok {
+			return time.Time{}, errors.New("payload must be a JSON object")
+		}
+	}
+
+	raw, present := incomingLog["timestamp"]
+	if !present || raw == nil {
+		return ingestedAt, nil
+	}
+	eventTime, err := parseEventTime(raw)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if eventTime.Before(ingestedAt.Add(-maxEventAge)) {
+		return time.Time{}, fmt.Errorf("timestamp is more than %s in the past", maxEventAge)
+	}
+	if eventTime.After(ingestedAt.Add(maxEventSkew)) {
+		return time.Time{}, fmt.Errorf("timestamp is more than %s in the future", maxEventSkew)
+	}
+	return eventTime, nil
+}
+
+// parseEventTime accepts an RFC3339 string or a unix timestamp in seconds,
+// milliseconds, microseconds or nanoseconds. The unit of a numeric timestamp
+// is inferred from its magnitude, with the bounds the README documents.
+func parseEventTime(raw interface{}) (time.Time, error) {
+	var n float64
+	switch v := raw.(type) {
+	case float64:
+		n = v
+	case json.Number:
+		return parseUnixTime(string(v))
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, nil
+		}
+		return parseUnixTime(v)
+	default:
+		return time.Time{}, errors.New("timestamp must be RFC3339 or a unix timestamp")
+	}
+	return unixTime(n)
+}
+
+// parseUnixTime parses a numeric timestamp. Integers are converted exactly,
+// since nanoseconds do not fit a float64.
+func parseUnixTime(s string) (time.Time, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		switch {
+		case i <= 0:
+			return time.Time{}, errors.New("timestamp must be positive")
+		case i < 1e11:
+			return time.Unix(i, 0), nil
+		case i < 1e14:
+			return time.UnixMilli(i), nil
+		case i < 1e17:
+			return time.UnixMicro(i), nil
+		default:
+			return time.Unix(0, i), nil
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, errors.New("timestamp must be RFC3339 or a unix timestamp")
+	}
+	return unixTime(f)
+}
+
+func unixTime(n float64) (time.Time, error) {
+	if n <= 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+		return time.Time{}, errors.New("timestamp must be positive")
+	}
+
+	switch {
+	case n < 1e11:
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	case n < 1e14:
+		return time.UnixMilli(int64(n)), nil
+	case n < 1e17:
+		return time.UnixMicro(int64(n)), nil
+	default:
+		return time.Unix(0, int64(n)), nil
+	}
+}
+
+// resolveLogID picks the ID a log is stored under: the client's own log_id,
+// then one derived from the idempotency key, then a random one. Retries that
+// repeat either of the first two are deduplicated by the consumer.
+func resolveLogID(projectID, idempotencyKey string, incomingLog map[string]interface{}) (string, error) {
+	if raw, present := incomingLog["log_id"]; present && raw != nil {
+		s, ok := raw.(string)
+		if !ok {
+			return "", errors.New("log_id must be a UUID string")
+		}
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return "", errors.New("log_id must be a UUID string")
+		}
+		return id.String(), nil
+	}
+	if idempotencyKey != "" {
+		return uuid.NewSHA1(idempotencyNamespace, []byte(projectID+"/"+idempotencyKey)).String(), nil
+	}
+	return uuid.NewString(), nil
+}
+
+// pinsEventTime reports whether a log's event time is pinned to when its ID
+// was first ingested: it has a stable ID, its own log_id or one derived from
+// an Idempotency-Key, and no timestamp. A retry then keeps the first
+// attempt's event time, which is part of the logs_index sorting key, so it
+// replaces the stored log instead of adding a row.
+func pinsEventTime(incomingLog map[string]interface{}, idempotencyKey string) bool {
+	if raw, present := incomingLog["timestamp"]; present && raw != nil {
+		return false
+	}
+	raw, present := incomingLog["log_id"]
+	return idempotencyKey != "" || (present && raw != nil)
+}
+
+// firstIngestTimes records now as the ingest time of each of logIDs that has
+// none yet and returns the time each was first ingested.
+func firstIngestTimes(ctx context.Context, projectID string, logIDs []string, now time.Time) (map[string]time.Time, error) {
+	unique := make([]string, 0, len(logIDs))
+	seen := make(map[string]bool, len(logIDs))
+	for _, id := range logIDs {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	// Updating a row to itself makes RETURNING report the existing ones.
+	rows, err := db.QueryContext(ctx, `
+		INSERT INTO log_ingest_times (project_id, log_id, ingested_at)
+		SELECT $1, id, $3 FROM unnest($2::UUID[]) AS id
+		ON CONFLICT (project_id, log_id) DO UPDATE SET ingested_at = log_ingest_times.ingested_at
+		RETURNING log_id, ingested_at`,
+		projectID, pq.Array(unique), now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	times := make(map[string]time.Time, len(unique))
+	for rows.Next() {
+		var id string
+		var t time.Time
+		if err := rows.Scan(&id, &t); err != nil {
+			return nil, err
+		}
+		times[id] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range unique {
+		if _, ok := times[id]; !ok {
+			return nil, fmt.Errorf("no ingest time returned for log %s", id)
+		}
+	}
+	return times, nil
+}
+
+// streamKeyFor returns the client's ordering stream for a log: its
+// stream_key field, or the X-Stream-Key header.
+func streamKeyFor(r *http.Request, incomingLog map[string]interface{}) string {
+	if key, ok := incomingLog["stream_key"].(string); ok && key != "" {
+		return key
+	}
+	return r.Header.Get("X-Stream-Key")
+}
+
+// partitionKey is the Kafka message key. Logs with the same key land on the
+// same partition, so they are consumed in the order they were produced. A
+// stream key narrows ordering to one stream and spreads a busy project over
+// more partitions.
+func partitionKey(projectID, streamKey string) []byte {
+	if streamKey == "" {
+		return []byte(projectID)
+	}
+	return []byte(projectID + "/" + streamKey)
+}
+
+// newLogEnvelope wraps a validated log in the envelope the consumer expects.
+func newLogEnvelope(projectID, logID string, incomingLog map[string]interface{}, eventTime, ingestedAt time.Time) logEnvelope {
+	return logEnvelope{
+		ProjectID:  projectID,
+		LogID:      logID,
+		EventTime:  eventTime.UnixMilli(),
+		IngestedAt: ingestedAt.UnixMilli(),
+		Payload:    incomingLog,
+	}
+}
+
+// buildKafkaMessage serializes an envelope, keyed by its project and stream.
+func buildKafkaMessage(env logEnvelope, streamKey string) (kafka.Message, error) {
+	messageBytes, err := json.Marshal(env)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{Key: partitionKey(env.ProjectID, streamKey), Value: messageBytes}, nil
+}
+
+// unmarshalUseNumber decodes JSON keeping numbers as json.Number, so they
+// are passed on without being rounded through float64.
+func unmarshalUseNumber(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// splitBatch returns the raw entries of a batch body, which is either a JSON
+// array of objects or newline-delimited JSON.
+func splitBatch(body []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, errors.New("empty batch")
+	}
+
+	var entries []json.RawMessage
+	if trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("invalid JSON array: %w", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+		scanner.Buffer(make([]byte, 64*1024), maxBatchBodyBytes)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			entries = append(entries, json.RawMessage(append([]byte(nil), line...)))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("invalid NDJSON body: %w", err)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	if len(entries) > maxBatchEntries {
+		return nil, fmt.Errorf("batch has %d entries, the limit is %d", len(entries), maxBatchEntries)
+	}
+	return entries, nil
+}
+
+func apiBatchLogHandler(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := authenticateProject(w, r)
+	if !ok {
+		return
+	}
+	ackMode, ackTimeout, err := parseAckMode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The body is already decoded and capped by decompressRequest.
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := splitBatch(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// An Idempotency-Key on a batch covers every entry, told apart by index.
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	ingestedAt := time.Now()
+	resp := batchResponse{Results: make([]batchItemResult, len(entries))}
+	// accepted holds the entries that passed validation, by position in the
+	// batch.
+	type acceptedEntry struct {
+		index     int
+		env       logEnvelope
+		streamKey string
+		pinned    bool
+	}
+	var accepted []acceptedEntry
+	var pinnedIDs []string
+	for i, raw := range entries {
+		resp.Results[i] = batchItemResult{Index: i, Status: "rejected"}
+
+		var incomingLog map[string]interface{}
+		if err := unmarshalUseNumber(raw, &incomingLog); err != nil || incomingLog == nil {
+			resp.Results[i].Error = "entry is not a JSON object"
+			continue
+		}
+		eventTime, err := validateLog(incomingLog, ingestedAt)
+		if err != nil {
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+		violation, err := checkEventSchema(projectID, incomingLog)
+		if err != nil {
+			log.Printf("apiBatchLogHandler: error loading event schema: %v", err)
+			resp.Results[i].Error = "failed to validate log"
+			continue
+		}
+		if violation != nil {
+			resp.Results[i].Error = fmt.Sprintf("payload does not match schema version %d", violation.Version)
+			resp.Results[i].FieldErrors = violation.FieldErrors
+			continue
+		}
+		entryKey := ""
+		if idempotencyKey != "" {
+			entryKey = fmt.Sprintf("%s#%d", idempotencyKey, i)
+		}
+		logID, err := resolveLogID(projectID, entryKey, incomingLog)
+		if err != nil {
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+		env := newLogEnvelope(projectID, logID, incomingLog, eventTime, ingestedAt)
+		if ackMode == ackStored {
+			env.Ack = ackStored
+		}
+		pinned := pinsEventTime(incomingLog, entryKey)
+		if pinned {
+			pinnedIDs = append(pinnedIDs, logID)
+		}
+		accepted = append(accepted, acceptedEntry{index: i, env: env, streamKey: streamKeyFor(r, incomingLog), pinned: pinned})
+	}
+
+	if len(pinnedIDs) > 0 {
+		times, err := firstIngestTimes(r.Context(), projectID, pinnedIDs, ingestedAt)
+		if err != nil {
+			log.Printf("apiBatchLogHandler: error recording ingest times: %v", err)
+			http.Error(w, "Failed to submit logs", http.StatusInternalServerError)
+			return
+		}
+		for k := range accepted {
+			if accepted[k].pinned {
+				accepted[k].env.EventTime = times[accepted[k].env.LogID].UnixMilli()
+			}
+		}
+	}
+
+	var messages []kafka.Message
+	// messageIndex maps each Kafka message back to its position in the batch.
+	var messageIndex []int
+	var logIDs []string
+	for _, a := range accepted {
+		msg, err := buildKafkaMessage(a.env, a.streamKey)
+		if err != nil {
+			resp.Results[a.index].Error = "failed to serialize log message"
+			continue
+		}
+		messages = append(messages, msg)
+		messageIndex = append(messageIndex, a.index)
+		logIDs = append(logIDs, a.env.LogID)
+	}
+
+	if len(messages) > 0 {
+		// The batch is limited as a whole, so a 429 never leaves it half sent.
+		quota, ok := checkRateLimit(w, r, projectID, len(messages), messagesSize(messages))
+		if !ok {
+			return
+		}
+		err := kafkaWriter.WriteMessages(r.Context(), messages...)
+		refundUnwritten(quota, messages, err)
+		var writeErrs kafka.WriteErrors
+		switch {
+		case err == nil:
+		case errors.As(err, &writeErrs):
+			log.Printf("apiBatchLogHandler: %d of %d messages failed: %v", writeErrs.Count(), len(messages), err)
+		default:
+			log.Printf("apiBatchLogHandler: error writing to kafka: %v", err)
+			http.Error(w, "Failed to submit logs", http.StatusInternalServerError)
+			return
+		}
+		for j, i := range messageIndex {
+			if writeErrs != nil && writeErrs[j] != nil {
+				resp.Results[i].Error = "failed to submit log"
+				continue
+			}
+			resp.Results[i].Status = "accepted"
+			resp.Results[i].LogID = logIDs[j]
+		}
+	}
+
+	for _, res := range resp.Results {
+		if res.Status == "accepted" {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+
+	status := http.StatusAccepted
+	if resp.Accepted == 0 {
+		status = http.StatusBadRequest
+		if len(messages) > 0 {
+			status = http.StatusInternalServerError
+		}
+	} else if ackMode == ackStored {
+		status = waitForBatchAcks(r.Context(), projectID, &resp, ackTimeout)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestParseEventTime(t *testing.T) {
+	noon := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		in   interface{}
+		want time.Time
+		err  string
+	}{
+		{"RFC3339 UTC", "2024-03-10T12:00:00Z", noon, ""},
+		{"RFC3339 with an offset", "2024-03-10T14:00:00+02:00", noon, ""},
+		{"RFC3339 nanoseconds", "2024-03-10T07:00:00.123456789-05:00", noon.Add(123456789), ""},
+		{"seconds", json.Number("1710072000"), noon, ""},
+		{"fractional seconds", json.Number("1710072000.25"), noon.Add(250 * time.Millisecond), ""},
+		{"seconds as float64", float64(1710072000), noon, ""},
+		{"seconds as a string", "1710072000", noon, ""},
+		{"milliseconds", json.Number("1710072000123"), noon.Add(123 * time.Millisecond), ""},
+		{"microseconds", json.Number("1710072000123456"), noon.Add(123456 * time.Microsecond), ""},
+		{"nanoseconds are exact", json.Number("1710072000123456789"), noon.Add(123456789), ""},
+		{"last seconds value", json.Number("99999999999"), time.Unix(99999999999, 0), ""},
+		{"first milliseconds value", json.Number("100000000000"), time.UnixMilli(1e11), ""},
+		{"first milliseconds value as float64", float64(1e11), time.UnixMilli(1e11), ""},
+		{"last milliseconds value", json.Number("99999999999999"), time.UnixMilli(1e14 - 1), ""},
+		{"first microseconds value", json.Number("100000000000000"), time.UnixMicro(1e14), ""},
+		{"last microseconds value", json.Number("99999999999999999"), time.UnixMicro(1e17 - 1), ""},
+		{"first nanoseconds value", json.Number("100000000000000000"), time.Unix(0, 1e17), ""},
+		{"zero", json.Number("0"), time.Time{}, "timestamp must be positive"},
+		{"negative", json.Number("-5"), time.Time{}, "timestamp must be positive"},
+		{"negative float", float64(-0.5), time.Time{}, "timestamp must be positive"},
+		{"out of range", json.Number("1e400"), time.Time{}, "timestamp must be RFC3339 or a unix timestamp"},
+		{"not a date", "yesterday", time.Time{}, "timestamp must be RFC3339 or a unix timestamp"},
+		{"date without a zone", "2024-03-10 12:00:00", time.Time{}, "timestamp must be RFC3339 or a unix timestamp"},
+		{"bool", true, time.Time{}, "timestamp must be RFC3339 or a unix timestamp"},
+	}
+	for _, tt := range tests {
+		got, err := parseEventTime(tt.in)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: parseEventTime(%v) = %v, %v; want error %q", tt.name, tt.in, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("%s: parseEventTime(%v) = %v, %v; want %v", tt.name, tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateLog(t *testing.T) {
+	ingestedAt := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	millis := func(t time.Time) json.Number { return json.Number(strconv.FormatInt(t.UnixMilli(), 10)) }
+	oldest := ingestedAt.Add(-maxEventAge)
+	newest := ingestedAt.Add(maxEventSkew)
+
+	tests := []struct {
+		name string
+		log  map[string]interface{}
+		want time.Time
+		err  string
+	}{
+		{"no timestamp", map[string]interface{}{"event_name": "e"}, ingestedAt, ""},
+		{"null timestamp", map[string]interface{}{"event_name": "e", "timestamp": nil}, ingestedAt, ""},
+		{"null payload", map[string]interface{}{"event_name": "e", "payload": nil}, ingestedAt, ""},
+		{"RFC3339", map[string]interface{}{"event_name": "e", "timestamp": "2024-03-10T12:00:00+01:00"}, ingestedAt.Add(-time.Hour), ""},
+		{"oldest allowed", map[string]interface{}{"event_name": "e", "timestamp": millis(oldest)}, oldest, ""},
+		{"newest allowed", map[string]interface{}{"event_name": "e", "timestamp": millis(newest)}, newest, ""},
+		{"too old", map[string]interface{}{"event_name": "e", "timestamp": millis(oldest.Add(-time.Millisecond))}, time.Time{}, "in the past"},
+		{"too far ahead", map[string]interface{}{"event_name": "e", "timestamp": millis(newest.Add(time.Millisecond))}, time.Time{}, "in the future"},
+		{"seconds too far ahead", map[string]interface{}{"event_name": "e", "timestamp": json.Number("4102444800")}, time.Time{}, "in the future"},
+		{"invalid timestamp", map[string]interface{}{"event_name": "e", "timestamp": "soon"}, time.Time{}, "must be RFC3339"},
+		{"missing event name", map[string]interface{}{}, time.Time{}, "event_name must be a non-empty string"},
+		{"empty event name", map[string]interface{}{"event_name": ""}, time.Time{}, "event_name must be a non-empty string"},
+		{"event name not a string", map[string]interface{}{"event_name": json.Number("1")}, time.Time{}, "event_name must be a non-empty string"},
+		{"payload not an object", map[string]interface{}{"event_name": "e", "payload": []interface{}{}}, time.Time{}, "payload must be a JSON object"},
+	}
+	for _, tt := range tests {
+		got, err := validateLog(tt.log, ingestedAt)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: validateLog() = %v, %v; want an error containing %q", tt.name, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("%s: validateLog() = %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+		err  string
+	}{
+		{"JSON array", ` [{"a":1}, {"b":2}] `, []string{`{"a":1}`, `{"b":2}`}, ""},
+		{"NDJSON", "{\"a\":1}\n\n  {\"b\":2}  \r\n{\"c\":3}", []string{`{"a":1}`, `{"b":2}`, `{"c":3}`}, ""},
+		{"one object", `{"a":1}`, []string{`{"a":1}`}, ""},
+		{"array entries are not checked", `[1, "x", null]`, []string{`1`, `"x"`, `null`}, ""},
+		{"empty", "", nil, "empty batch"},
+		{"blank lines", "\n \n", nil, "empty batch"},
+		{"empty array", "[]", nil, "empty batch"},
+		{"invalid array", `[{"a":1},`, nil, "invalid JSON array"},
+		{"too many entries", "[" + strings.Repeat("{},", maxBatchEntries) + "{}]", nil, "the limit is 1000"},
+	}
+	for _, tt := range tests {
+		entries, err := splitBatch([]byte(tt.body))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: splitBatch() = %v, want an error containing %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: splitBatch() = %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, string(e))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: splitBatch() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// uuidArray reads back the pq.Array of log IDs a query was given.
+func uuidArray(arg driver.Value) []string {
+	s := strings.Trim(fmt.Sprint(arg), "{}")
+	if s == "" {
+		return nil
+	}
+	ids := strings.Split(s, ",")
+	for i, id := range ids {
+		ids[i] = strings.Trim(id, `"`)
+	}
+	return ids
+}
+
+// batchTestDB answers the queries the batch handler makes for project p1,
+// whose API key is key1. Logs with an ID were first ingested at firstSeen.
+func batchTestDB(t *testing.T, firstSeen time.Time) *fakeDB {
+	fdb := useFakeDB(t)
+	fdb.row("SELECT api_key FROM projects WHERE id = $1", []string{"api_key"}, "key1")
+	fdb.on("INSERT INTO log_ingest_times", func(args []driver.Value) (fakeResult, error) {
+		res := fakeResult{columns: []string{"log_id", "ingested_at"}}
+		for _, id := range uuidArray(args[1]) {
+			res.rows = append(res.rows, []driver.Value{id, firstSeen})
+		}
+		return res, nil
+	})
+	fdb.on("FROM log_acks", func(args []driver.Value) (fakeResult, error) {
+		res := fakeResult{columns: []string{"log_id", "status", "error"}}
+		for _, id := range uuidArray(args[1]) {
+			res.rows = append(res.rows, []driver.Value{id, ackStored, ""})
+		}
+		return res, nil
+	})
+	return fdb
+}
+
+func postBatch(t *testing.T, target, body string, header http.Header) (*httptest.ResponseRecorder, batchResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"projectID": "p1"})
+	req.Header.Set("X-API-KEY", "key1")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	apiBatchLogHandler(rec, req)
+
+	var resp batchResponse
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("response %s: %v", rec.Body, err)
+		}
+	}
+	return rec, resp
+}
+
+// sentEnvelope decodes a message the handler wrote to Kafka.
+func sentEnvelope(t *testing.T, msg kafka.Message) logEnvelope {
+	t.Helper()
+	var env logEnvelope
+	if err := json.Unmarshal(msg.Value, &env); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestBatchHandlerPartialRejection(t *testing.T) {
+	now := time.Now()
+	cacheSchema(t, "p1", "checkout", schemaModeStrict, `{"required": ["total"]}`)
+	ts := strconv.FormatInt(now.UnixMilli(), 10)
+	bodies := map[string]string{
+		"ndjson": `{"event_name": "login", "timestamp": ` + ts + `, "payload": {"user": "a"}}
+			{"payload": {}}
+			[1, 2]
+			{"event_name": "checkout", "payload": {}}
+			{"event_name": "login", "log_id": "nope"}
+			{"event_name": "logout", "stream_key": "s1"}`,
+		"array": `[{"event_name": "login", "timestamp": ` + ts + `, "payload": {"user": "a"}},
+			{"payload": {}}, [1, 2],
+			{"event_name": "checkout", "payload": {}},
+			{"event_name": "login", "log_id": "nope"},
+			{"event_name": "logout", "stream_key": "s1"}]`,
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			batchTestDB(t, now)
+			w := useFakeWriter(t)
+			rec, resp := postBatch(t, "/api/projects/p1/logs/batch", body, nil)
+
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if resp.Accepted != 2 || resp.Rejected != 4 || len(resp.Results) != 6 {
+				t.Fatalf("accepted %d, rejected %d, %d results", resp.Accepted, resp.Rejected, len(resp.Results))
+			}
+			wantErrors := []string{
+				"",
+				"event_name must be a non-empty string",
+				"entry is not a JSON object",
+				"payload does not match schema version 2",
+				"log_id must be a UUID string",
+				"",
+			}
+			for i, res := range resp.Results {
+				status := "rejected"
+				if wantErrors[i] == "" {
+					status = "accepted"
+				}
+				if res.Index != i || res.Status != status || res.Error != wantErrors[i] {
+					t.Errorf("result %d = %+v, want %s %q", i, res, status, wantErrors[i])
+				}
+			}
+			if want := []fieldError{{"payload.total", "is required"}}; !reflect.DeepEqual(resp.Results[3].FieldErrors, want) {
+				t.Errorf("field errors = %v, want %v", resp.Results[3].FieldErrors, want)
+			}
+
+			if len(w.messages) != 2 {
+				t.Fatalf("wrote %d messages, want 2", len(w.messages))
+			}
+			login, logout := sentEnvelope(t, w.messages[0]), sentEnvelope(t, w.messages[1])
+			if login.LogID != resp.Results[0].LogID || logout.LogID != resp.Results[5].LogID {
+				t.Errorf("log IDs %s, %s do not match the results", login.LogID, logout.LogID)
+			}
+			if login.EventTime != now.UnixMilli() || login.Payload["event_name"] != "login" {
+				t.Errorf("login envelope = %+v", login)
+			}
+			if string(w.messages[0].Key) != "p1" || string(w.messages[1].Key) != "p1/s1" {
+				t.Errorf("keys = %q, %q", w.messages[0].Key, w.messages[1].Key)
+			}
+		})
+	}
+}
+
+func TestBatchHandlerEventTime(t *testing.T) {
+	firstSeen := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	batchTestDB(t, firstSeen)
+	w := useFakeWriter(t)
+
+	const logID = "5b8efff7-9803-4103-9269-b633813fc60c"
+	body := `{"event_name": "a", "log_id": "` + logID + `"}
+		{"event_name": "b"}`
+	header := http.Header{"Idempotency-Key": {"retry-1"}}
+	for attempt := 0; attempt < 2; attempt++ {
+		w.messages = nil
+		rec, resp := postBatch(t, "/api/projects/p1/logs/batch", body, header)
+		if rec.Code != http.StatusAccepted || resp.Accepted != 2 {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		// Both entries have a stable ID, so a retry keeps the event time
+		// of the first attempt.
+		for i, msg := range w.messages {
+			if env := sentEnvelope(t, msg); env.EventTime != firstSeen.UnixMilli() {
+				t.Errorf("attempt %d, entry %d: event time %d, want %d", attempt, i, env.EventTime, firstSeen.UnixMilli())
+			}
+		}
+		if resp.Results[0].LogID != logID {
+			t.Errorf("log ID = %s, want the entry's own %s", resp.Results[0].LogID, logID)
+		}
+		want := uuid.NewSHA1(idempotencyNamespace, []byte("p1/retry-1#1")).String()
+		if resp.Results[1].LogID != want {
+			t.Errorf("log ID = %s, want %s from the Idempotency-Key", resp.Results[1].LogID, want)
+		}
+	}
+}
+
+func TestBatchHandlerStatus(t *testing.T) {
+	valid := `{"event_name": "a"}` + "\n" + `{"event_name": "b"}`
+	tests := []struct {
+		name     string
+		target   string
+		apiKey   string
+		body     string
+		writeErr error
+		status   int
+		results  []string // status of each entry
+	}{
+		{"missing API key", "/api/projects/p1/logs/batch", "", valid, nil, http.StatusUnauthorized, nil},
+		{"wrong API key", "/api/projects/p1/logs/batch", "key2", valid, nil, http.StatusUnauthorized, nil},
+		{"invalid ack", "/api/projects/p1/logs/batch?ack=maybe", "key1", valid, nil, http.StatusBadRequest, nil},
+		{"empty body", "/api/projects/p1/logs/batch", "key1", "", nil, http.StatusBadRequest, nil},
+		{"all rejected", "/api/projects/p1/logs/batch", "key1", `{"payload": {}}`, nil, http.StatusBadRequest, []string{"rejected"}},
+		{"kafka down", "/api/projects/p1/logs/batch", "key1", valid, errors.New("no brokers"), http.StatusInternalServerError, nil},
+		{
+			"one message not written", "/api/projects/p1/logs/batch", "key1", valid,
+			kafka.WriteErrors{nil, errors.New("leader not available")}, http.StatusAccepted, []string{"accepted", "rejected"},
+		},
+		{"stored", "/api/projects/p1/logs/batch?ack=stored", "key1", valid, nil, http.StatusOK, []string{"stored", "stored"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batchTestDB(t, time.Now())
+			w := useFakeWriter(t)
+			w.err = tt.writeErr
+			rec, resp := postBatch(t, tt.target, tt.body, http.Header{"X-Api-Key": {tt.apiKey}})
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			var got []string
+			for _, res := range resp.Results {
+				got = append(got, res.Status)
+			}
+			if !reflect.DeepEqual(got, tt.results) {
+				t.Errorf("results = %v, want %v", got, tt.results)
+			}
+		})
+	}
+}
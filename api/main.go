@@ -14,7 +14,10 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/gocql/gocql"
@@ -27,23 +30,41 @@ import (
 
 // Global variables
 var db *sql.DB
-var kafkaWriter *kafka.Writer
+var kafkaWriter messageWriter
 var clickhouseConn clickhouse.Conn
 var cassandraSession *gocql.Session
 
+// messageWriter is the part of *kafka.Writer the handlers use, so tests can
+// capture the messages instead of sending them.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
 // Structs
+// Timestamps are unix milliseconds.
 type ClickHouseLog struct {
-	LogID     string `json:"log_id"`
-	EventName string `json:"event_name"`
-	Timestamp int64  `json:"timestamp"`
+	LogID      string            `json:"log_id"`
+	EventName  string            `json:"event_name"`
+	Timestamp  int64             `json:"timestamp"`
+	IngestedAt int64             `json:"ingested_at"`
+	Searchable map[string]string `json:"searchable"`
+	// Highlight is a snippet of the payload's text around the search
+	// terms, HTML-escaped with matches in <mark>.
+	Highlight string `json:"highlight,omitempty"`
 }
 
+// CassandraLog is a stored log. Payload is the JSON object as it was
+// submitted; Fields is the same payload flattened to dotted keys with text
+// values.
 type CassandraLog struct {
-	ProjectID string            `json:"project_id"`
-	LogID     string            `json:"log_id"`
-	EventName string            `json:"event_name"`
-	Timestamp int64             `json:"timestamp"`
-	Payload   map[string]string `json:"payload"`
+	ProjectID  string            `json:"project_id"`
+	LogID      string            `json:"log_id"`
+	EventName  string            `json:"event_name"`
+	Timestamp  int64             `json:"timestamp"`
+	IngestedAt int64             `json:"ingested_at"`
+	Payload    json.RawMessage   `json:"payload"`
+	Fields     map[string]string `json:"fields"`
 }
 
 // Database initialization functions
@@ -69,9 +90,11 @@ func initKafka() error {
 	}
 
 	kafkaWriter = &kafka.Writer{
-		Addr:     kafka.TCP(strings.Split(kafkaBrokers, ",")...),
-		Topic:    "logs",
-		Balancer: &kafka.LeastBytes{},
+		Addr:  kafka.TCP(strings.Split(kafkaBrokers, ",")...),
+		Topic: "logs",
+		// Messages are keyed by project, so a project's logs share a
+		// partition and keep their order.
+		Balancer: &kafka.Hash{},
 	}
 	return nil
 }
@@ -161,6 +184,10 @@ func main() {
 	}
 	fmt.Println("Connected to Cassandra successfully!")
 
+	if err := initIngest(); err != nil {
+		panic("Failed to configure ingestion: " + err.Error())
+	}
+
 	r := mux.NewRouter()
 	r.HandleFunc("/", homeHandler)
 	r.HandleFunc("/login", loginHandler)
@@ -169,17 +196,75 @@ func main() {
 	r.HandleFunc("/dashboard", dashboardHandler).Methods("GET")
 	r.HandleFunc("/dashboard/{projectID}", projectHandler).Methods("GET")
 	r.HandleFunc("/projects/create", createProjectHandler)
-	r.HandleFunc("/api/projects/{projectID}/logs", apiLogHandler).Methods("POST")
+	r.HandleFunc("/api/projects/{projectID}/logs", decompressRequest(maxLogBodyBytes, apiLogHandler)).Methods("POST")
+	r.HandleFunc("/api/projects/{projectID}/logs/batch", decompressRequest(maxBatchBodyBytes, apiBatchLogHandler)).Methods("POST")
 	r.HandleFunc("/api/projects/{projectID}/logs", apiProjectLogsHandler).Methods("GET")
+	r.HandleFunc("/api/projects/{projectID}/histogram", apiProjectHistogramHandler).Methods("GET")
+	r.HandleFunc("/api/projects/{projectID}/facets", apiProjectFacetsHandler).Methods("GET")
+	r.HandleFunc("/v1/logs", decompressRequest(maxBatchBodyBytes, otlpLogsHandler)).Methods("POST")
+	r.HandleFunc("/api/projects/{projectID}/limits", apiProjectLimitsHandler).Methods("GET")
+	r.HandleFunc("/api/projects/{projectID}/backfill", apiBackfillStatusHandler).Methods("GET")
+	r.HandleFunc("/api/projects/{projectID}/backfill", apiStartBackfillHandler).Methods("POST")
+	r.HandleFunc("/api/projects/{projectID}/schemas", apiListSchemasHandler).Methods("GET")
+	r.HandleFunc("/api/projects/{projectID}/schemas/{eventName}", apiSchemaVersionsHandler).Methods("GET")
+	r.HandleFunc("/api/projects/{projectID}/schemas/{eventName}", apiRegisterSchemaHandler).Methods("POST")
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 	r.HandleFunc("/api/projects/{projectID}/logs/{logID}", apiProjectLogDetailHandler).Methods("GET")
 	r.HandleFunc("/projects/{projectID}/logs/{logID}", logDetailsPageHandler).Methods("GET")
 
 	port := ":8080"
-	fmt.Printf("Server starting at http://localhost%s ...", port)
-	err := http.ListenAndServe(port, r)
-	if err != nil {
-		fmt.Printf("server failed:%s", err)
+	srv := &http.Server{Addr: port, Handler: r}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go runUsageSync(ctx)
+	go func() {
+		fmt.Printf("Server starting at http://localhost%s ...", port)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("server failed:%s", err)
+			stop()
+		}
+	}()
+	<-ctx.Done()
+	stop()
+
+	// Stop accepting connections and let in-flight requests finish, so logs
+	// already read are written to Kafka before the writer is closed.
+	fmt.Println("Shutting down, draining in-flight requests...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		fmt.Printf("shutdown did not finish: %s\n", err)
+	}
+	closeConnections()
+	fmt.Println("Server stopped.")
+}
+
+// shutdownTimeout is how long in-flight requests get to finish on shutdown,
+// from SHUTDOWN_TIMEOUT (default 30s).
+func shutdownTimeout() time.Duration {
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("invalid SHUTDOWN_TIMEOUT %q, using 30s", v)
+	}
+	return 30 * time.Second
+}
+
+// closeConnections writes the usage counted for rate limits, flushes the
+// Kafka writer and closes every store.
+func closeConnections() {
+	syncUsage(context.Background())
+	if err := kafkaWriter.Close(); err != nil {
+		log.Printf("closeConnections: error closing kafka writer: %v", err)
+	}
+	if err := clickhouseConn.Close(); err != nil {
+		log.Printf("closeConnections: error closing clickhouse: %v", err)
+	}
+	cassandraSession.Close()
+	if err := db.Close(); err != nil {
+		log.Printf("closeConnections: error closing database: %v", err)
 	}
 }
 
@@ -495,59 +580,109 @@ func logDetailsPageHandler(w http.ResponseWriter, r *http.Request) {
 
 // API handlers
 func apiLogHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	projectID := vars["projectID"]
-	apiKey := r.Header.Get("X-API-KEY")
-
-	if apiKey == "" {
-		http.Error(w, "Missing API key", http.StatusUnauthorized)
+	projectID, ok := authenticateProject(w, r)
+	if !ok {
 		return
 	}
-
-	// Validate API key against the database
-	var dbApiKey string
-	err := db.QueryRow(`SELECT api_key FROM projects WHERE id = $1`, projectID).Scan(&dbApiKey)
-	if err != nil || dbApiKey != apiKey {
-		http.Error(w, "Invalid API key or project", http.StatusUnauthorized)
+	ackMode, ackTimeout, err := parseAckMode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// Decode the incoming JSON from the request body
+	// Numbers are kept as json.Number so they reach the consumer exactly as
+	// they were sent.
 	var incomingLog map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&incomingLog); err != nil {
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&incomingLog); err != nil || incomingLog == nil {
+		if isBodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	ingestedAt := time.Now()
+	eventTime, err := validateLog(incomingLog, ingestedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	violation, err := checkEventSchema(projectID, incomingLog)
+	if err != nil {
+		log.Printf("apiLogHandler: error loading event schema: %v", err)
+		http.Error(w, "Failed to validate log", http.StatusInternalServerError)
+		return
+	}
+	if violation != nil {
+		writeSchemaViolation(w, violation)
+		return
+	}
 
-	// Prepare the final message for Kafka, adding the projectID
-	messageForKafka := map[string]interface{}{
-		"project_id": projectID,
-		"payload":    incomingLog,
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	logID, err := resolveLogID(projectID, idempotencyKey, incomingLog)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pinsEventTime(incomingLog, idempotencyKey) {
+		times, err := firstIngestTimes(r.Context(), projectID, []string{logID}, ingestedAt)
+		if err != nil {
+			log.Printf("apiLogHandler: error recording ingest time: %v", err)
+			http.Error(w, "Failed to submit log", http.StatusInternalServerError)
+			return
+		}
+		eventTime = times[logID]
 	}
 
-	// Convert the map to a JSON byte array
-	messageBytes, err := json.Marshal(messageForKafka)
+	// Prepare the final message for Kafka, adding the projectID
+	streamKey := streamKeyFor(r, incomingLog)
+	env := newLogEnvelope(projectID, logID, incomingLog, eventTime, ingestedAt)
+	if ackMode == ackStored {
+		env.Ack = ackStored
+	}
+	message, err := buildKafkaMessage(env, streamKey)
 	if err != nil {
 		http.Error(w, "Failed to serialize log message", http.StatusInternalServerError)
 		return
 	}
 
+	quota, ok := checkRateLimit(w, r, projectID, 1, messagesSize([]kafka.Message{message}))
+	if !ok {
+		return
+	}
+
 	// Write the message to the Kafka topic
-	err = kafkaWriter.WriteMessages(context.Background(),
-		kafka.Message{
-			Value: messageBytes,
-		},
-	)
+	err = kafkaWriter.WriteMessages(context.Background(), message)
 
 	if err != nil {
+		quota.refund(1, messagesSize([]kafka.Message{message}))
 		log.Printf("apiLogHandler: error writing to kafka: %v", err)
 		http.Error(w, "Failed to submit log", http.StatusInternalServerError)
 		return
 	}
 
+	if ackMode == ackStored {
+		writeStoredAck(w, r, projectID, logID, ackTimeout)
+		return
+	}
+
 	// Respond with 202 Accepted
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
-	w.Write([]byte(`{"status":"accepted"}`))
+	json.NewEncoder(w).Encode(map[string]string{"status": "accepted", "log_id": logID})
+}
+
+// logsPage is a page of search results, newest first. Next and Prev are
+// cursors for the older and newer neighbouring pages, and Total counts
+// every matching log.
+type logsPage struct {
+	Logs  []ClickHouseLog `json:"logs"`
+	Next  *string         `json:"next"`
+	Prev  *string         `json:"prev"`
+	Total uint64          `json:"total"`
 }
 
 func apiProjectLogsHandler(w http.ResponseWriter, r *http.Request) {
@@ -555,55 +690,119 @@ func apiProjectLogsHandler(w http.ResponseWriter, r *http.Request) {
 	projectID := vars["projectID"]
 	ctx := context.Background()
 
-	search := strings.TrimSpace(r.URL.Query().Get("search"))
+	filter, ok := parseLogFilter(w, r, projectID)
+	if !ok {
+		return
+	}
+	limit, err := parsePageSize(r.URL.Query().Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var cursor *logCursor
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		if cursor, err = decodeCursor(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	var (
-		query string
-		args  []interface{}
-	)
-	if search != "" {
-		query = `
-          SELECT log_id, event_name, timestamp
-          FROM logs_index
-          WHERE project_id = ?
-            AND event_name ILIKE ?
-          ORDER BY timestamp DESC
-          LIMIT 100
-        `
-		args = []interface{}{projectID, "%" + search + "%"}
-	} else {
-		query = `
-          SELECT log_id, event_name, timestamp
-          FROM logs_index
-          WHERE project_id = ?
-          ORDER BY timestamp DESC
-          LIMIT 100
-        `
-		args = []interface{}{projectID}
+	page := logsPage{Logs: []ClickHouseLog{}}
+	countQuery := `SELECT count() FROM ` + logsIndex + ` WHERE ` + filter.where
+	if err := clickhouseConn.QueryRow(ctx, countQuery, filter.args...).Scan(&page.Total); err != nil {
+		log.Printf("apiProjectLogsHandler: error counting logs: %v", err)
+		http.Error(w, "Failed to query ClickHouse", http.StatusInternalServerError)
+		return
 	}
 
+	// Keyset pagination on (timestamp, log_id): a prev page is read oldest
+	// first from the cursor and reversed.
+	where, args := filter.where, filter.args
+	order := "timestamp DESC, log_id DESC"
+	backwards := cursor != nil && cursor.Dir == cursorPrev
+	if cursor != nil {
+		cmp := "<"
+		if backwards {
+			cmp, order = ">", "timestamp ASC, log_id ASC"
+		}
+		where += " AND (timestamp, log_id) " + cmp + " (fromUnixTimestamp64Milli(?), toUUID(?))"
+		args = append(append([]interface{}{}, args...), cursor.Timestamp, cursor.LogID)
+	}
+	// payload_text is only read when there is something to highlight.
+	text := "''"
+	if len(filter.terms) > 0 {
+		text = "payload_text"
+	}
+	query := `
+          SELECT log_id, event_name, timestamp, ingested_at, searchable, ` + text + `
+          FROM ` + logsIndex + `
+          WHERE ` + where + `
+          ORDER BY ` + order + `
+          LIMIT ?
+        `
+	args = append(args, limit+1)
+
 	rows, err := clickhouseConn.Query(ctx, query, args...)
 	if err != nil {
+		log.Printf("apiProjectLogsHandler: error querying ClickHouse: %v", err)
 		http.Error(w, "Failed to query ClickHouse", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	logs := []ClickHouseLog{}
 	for rows.Next() {
 		var l ClickHouseLog
-		if err := rows.Scan(&l.LogID, &l.EventName, &l.Timestamp); err != nil {
-			continue
+		var payloadText string
+		// A row that cannot be read would leave a hole in the page and
+		// break its cursors, so the request fails instead.
+		if err := rows.Scan(&l.LogID, &l.EventName, &l.Timestamp, &l.IngestedAt, &l.Searchable, &payloadText); err != nil {
+			log.Printf("apiProjectLogsHandler: error scanning log row: %v", err)
+			http.Error(w, "Failed to read logs", http.StatusInternalServerError)
+			return
 		}
-		logs = append(logs, l)
+		l.Highlight = highlight(payloadText, filter.terms)
+		page.Logs = append(page.Logs, l)
 	}
 	if err := rows.Err(); err != nil {
-		http.Error(w, "Error reading rows", http.StatusInternalServerError)
+		log.Printf("apiProjectLogsHandler: error reading log rows: %v", err)
+		http.Error(w, "Failed to read logs", http.StatusInternalServerError)
 		return
 	}
 
+	// The extra row only shows whether there is more in the direction read.
+	more := len(page.Logs) > limit
+	if more {
+		page.Logs = page.Logs[:limit]
+	}
+	if backwards {
+		for i, j := 0, len(page.Logs)-1; i < j; i, j = i+1, j-1 {
+			page.Logs[i], page.Logs[j] = page.Logs[j], page.Logs[i]
+		}
+	}
+	if n := len(page.Logs); n > 0 {
+		first, last := page.Logs[0], page.Logs[n-1]
+		if (backwards && more) || (!backwards && cursor != nil) {
+			prev := logCursor{Timestamp: first.Timestamp, LogID: first.LogID, Dir: cursorPrev}.encode()
+			page.Prev = &prev
+		}
+		if (!backwards && more) || backwards {
+			next := logCursor{Timestamp: last.Timestamp, LogID: last.LogID, Dir: cursorNext}.encode()
+			page.Next = &next
+		}
+	} else if cursor != nil {
+		// Past either end: offer the way back.
+		back := *cursor
+		back.Dir = map[string]string{cursorNext: cursorPrev, cursorPrev: cursorNext}[cursor.Dir]
+		s := back.encode()
+		if backwards {
+			page.Next = &s
+		} else {
+			page.Prev = &s
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(logs)
+	json.NewEncoder(w).Encode(page)
 }
 
 func apiProjectLogDetailHandler(w http.ResponseWriter, r *http.Request) {
@@ -617,20 +816,28 @@ func apiProjectLogDetailHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var logData CassandraLog
-	query := `SELECT project_id, log_id, event_name, timestamp, payload FROM logs WHERE project_id = ? AND log_id = ? LIMIT 1`
+	query := `SELECT project_id, log_id, event_name, timestamp, ingested_at, payload, payload_json FROM logs WHERE project_id = ? AND log_id = ? LIMIT 1`
 	m := map[string]string{}
+	var payloadJSON string
 	err := cassandraSession.Query(query, projectID, logID).Consistency(gocql.One).Scan(
 		&logData.ProjectID,
 		&logData.LogID,
 		&logData.EventName,
 		&logData.Timestamp,
+		&logData.IngestedAt,
 		&m,
+		&payloadJSON,
 	)
 	if err != nil {
 		http.Error(w, "Log not found", http.StatusNotFound)
 		return
 	}
-	logData.Payload = m
+	logData.Fields = m
+	logData.Payload = json.RawMessage(payloadJSON)
+	if payloadJSON == "" {
+		// Logs stored before payload_json existed only have the text map.
+		logData.Payload, _ = json.Marshal(m)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(logData)
 }
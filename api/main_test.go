@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestProjectLogsHandler(t *testing.T) {
+	logRow := func(id string, ts int64) []interface{} {
+		return []interface{}{id, "checkout", ts, ts + 5, map[string]string{"user": "a"}, ""}
+	}
+	tests := []struct {
+		name   string
+		rows   *fakeCHRows
+		status int
+		logs   []string
+	}{
+		{
+			name:   "page",
+			rows:   &fakeCHRows{rows: [][]interface{}{logRow("l2", 2000), logRow("l1", 1000)}},
+			status: http.StatusOK,
+			logs:   []string{"l2", "l1"},
+		},
+		{
+			name:   "a row that cannot be scanned",
+			rows:   &fakeCHRows{rows: [][]interface{}{logRow("l2", 2000), logRow("l1", 1000)}, scanErrAt: 2, scanErr: errors.New("bad column")},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "an error reading the rows",
+			rows:   &fakeCHRows{rows: [][]interface{}{logRow("l2", 2000)}, err: errors.New("connection reset")},
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeClickhouse(t, &fakeClickhouse{count: 2, rows: tt.rows})
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/projects/p1/logs?limit=10", nil), map[string]string{"projectID": "p1"})
+			rec := httptest.NewRecorder()
+			apiProjectLogsHandler(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var page logsPage
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, l := range page.Logs {
+				ids = append(ids, l.LogID)
+			}
+			if !reflect.DeepEqual(ids, tt.logs) || page.Total != 2 || page.Next != nil || page.Prev != nil {
+				t.Errorf("page = %+v, want logs %v", page, tt.logs)
+			}
+		})
+	}
+}
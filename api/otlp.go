@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaultOTLPEventName is used for log records that carry neither an
+// event_name nor an event.name attribute.
+const defaultOTLPEventName = "otlp.log"
+
+// otlpLog is one OTLP log record with its resource and scope, decoded from
+// either the protobuf or the JSON encoding.
+type otlpLog struct {
+	eventName            string
+	timeUnixNano         uint64
+	observedTimeUnixNano uint64
+	severityNumber       int32
+	severityText         string
+	body                 interface{}
+	attributes           map[string]interface{}
+	resource             map[string]interface{}
+	scopeName            string
+	scopeVersion         string
+	traceID              string
+	spanID               string
+}
+
+// toIncomingLog maps an OTLP record onto the same shape a client would POST
+// to /api/projects/{projectID}/logs. Log attributes become payload keys and
+// resource attributes are prefixed with "resource.".
+func (l otlpLog) toIncomingLog() map[string]interface{} {
+	payload := map[string]interface{}{}
+	for k, v := range l.attributes {
+		payload[k] = v
+	}
+	for k, v := range l.resource {
+		payload["resource."+k] = v
+	}
+	if l.body != nil {
+		payload["body"] = l.body
+	}
+	if l.severityText != "" {
+		payload["severity_text"] = l.severityText
+	}
+	if l.severityNumber != 0 {
+		payload["severity_number"] = l.severityNumber
+	}
+	if l.traceID != "" {
+		payload["trace_id"] = l.traceID
+	}
+	if l.spanID != "" {
+		payload["span_id"] = l.spanID
+	}
+	if l.scopeName != "" {
+		payload["scope.name"] = l.scopeName
+	}
+	if l.scopeVersion != "" {
+		payload["scope.version"] = l.scopeVersion
+	}
+
+	eventName := l.eventName
+	if eventName == "" {
+		eventName, _ = l.attributes["event.name"].(string)
+	}
+	if eventName == "" {
+		eventName = defaultOTLPEventName
+	}
+
+	incomingLog := map[string]interface{}{
+		"event_name": eventName,
+		"payload":    payload,
+	}
+	ts := l.timeUnixNano
+	if ts == 0 {
+		ts = l.observedTimeUnixNano
+	}
+	if ts != 0 {
+		incomingLog["timestamp"] = time.Unix(0, int64(ts)).UTC().Format(time.RFC3339Nano)
+	}
+	return incomingLog
+}
+
+// otlpLogsHandler implements the OTLP/HTTP logs receiver. The project is
+// found from its API key, since OTLP exporters post to a fixed path.
+func otlpLogsHandler(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := authenticateAPIKey(w, r)
+	if !ok {
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json"
+	if !isJSON && mediaType != "application/x-protobuf" {
+		http.Error(w, "Content-Type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	var records []otlpLog
+	if isJSON {
+		records, err = decodeOTLPJSON(body)
+	} else {
+		records, err = decodeOTLPProto(body)
+	}
+	if err != nil {
+		http.Error(w, "Invalid OTLP logs request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ingestedAt := time.Now()
+	var messages []kafka.Message
+	rejected := 0
+	var firstErr string
+	reject := func(msg string) {
+		rejected++
+		if firstErr == "" {
+			firstErr = msg
+		}
+	}
+	for _, rec := range records {
+		incomingLog := rec.toIncomingLog()
+		eventTime, err := validateLog(incomingLog, ingestedAt)
+		if err != nil {
+			reject(err.Error())
+			continue
+		}
+		violation, err := checkEventSchema(projectID, incomingLog)
+		if err != nil {
+			log.Printf("otlpLogsHandler: error loading event schema: %v", err)
+			reject("failed to validate log")
+			continue
+		}
+		if violation != nil {
+			reject(fmt.Sprintf("payload of %q does not match schema version %d", violation.EventName, violation.Version))
+			continue
+		}
+		logID, _ := resolveLogID(projectID, "", incomingLog)
+		msg, err := buildKafkaMessage(newLogEnvelope(projectID, logID, incomingLog, eventTime, ingestedAt), "")
+		if err != nil {
+			reject("failed to serialize log message")
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	if len(messages) > 0 {
+		quota, ok := checkRateLimit(w, r, projectID, len(messages), messagesSize(messages))
+		if !ok {
+			return
+		}
+		err := kafkaWriter.WriteMessages(r.Context(), messages...)
+		refundUnwritten(quota, messages, err)
+		var writeErrs kafka.WriteErrors
+		switch {
+		case err == nil:
+		case errors.As(err, &writeErrs) && writeErrs.Count() < len(messages):
+			log.Printf("otlpLogsHandler: %d of %d messages failed: %v", writeErrs.Count(), len(messages), err)
+			for i := 0; i < writeErrs.Count(); i++ {
+				reject("failed to submit log")
+			}
+		default:
+			// Nothing was accepted; let the exporter retry the whole request.
+			log.Printf("otlpLogsHandler: error writing to kafka: %v", err)
+			http.Error(w, "Failed to submit logs", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	writeOTLPResponse(w, isJSON, rejected, firstErr)
+}
+
+// writeOTLPResponse writes an ExportLogsServiceResponse in the request's
+// encoding, with a partial_success when some records were rejected.
+func writeOTLPResponse(w http.ResponseWriter, isJSON bool, rejected int, errMsg string) {
+	if isJSON {
+		resp := map[string]interface{}{}
+		if rejected > 0 {
+			resp["partialSuccess"] = map[string]interface{}{
+				"rejectedLogRecords": strconv.Itoa(rejected),
+				"errorMessage":       errMsg,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	// ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; }
+	// ExportLogsPartialSuccess { int64 rejected_log_records = 1; string error_message = 2; }
+	var out []byte
+	if rejected > 0 {
+		var partial []byte
+		partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+		partial = protowire.AppendVarint(partial, uint64(rejected))
+		partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+		partial = protowire.AppendString(partial, errMsg)
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, partial)
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// decodeOTLPProto decodes an ExportLogsServiceRequest. It has the same wire
+// format as LogsData, which avoids pulling in the gRPC service packages.
+func decodeOTLPProto(body []byte) ([]otlpLog, error) {
+	var req logspb.LogsData
+	if err := proto.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	var records []otlpLog
+	for _, rl := range req.GetResourceLogs() {
+		resource := protoAttributes(rl.GetResource().GetAttributes())
+		for _, sl := range rl.GetScopeLogs() {
+			for _, lr := range sl.GetLogRecords() {
+				rec := otlpLog{
+					eventName:            lr.GetEventName(),
+					timeUnixNano:         lr.GetTimeUnixNano(),
+					observedTimeUnixNano: lr.GetObservedTimeUnixNano(),
+					severityNumber:       int32(lr.GetSeverityNumber()),
+					severityText:         lr.GetSeverityText(),
+					attributes:           protoAttributes(lr.GetAttributes()),
+					resource:             resource,
+					scopeName:            sl.GetScope().GetName(),
+					scopeVersion:         sl.GetScope().GetVersion(),
+					traceID:              hex.EncodeToString(lr.GetTraceId()),
+					spanID:               hex.EncodeToString(lr.GetSpanId()),
+				}
+				if lr.GetBody() != nil {
+					rec.body = protoAnyValue(lr.GetBody())
+				}
+				records = append(records, rec)
+			}
+		}
+	}
+	return records, nil
+}
+
+func protoAttributes(kvs []*commonpb.KeyValue) map[string]interface{} {
+	attrs := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		attrs[kv.GetKey()] = protoAnyValue(kv.GetValue())
+	}
+	return attrs
+}
+
+func protoAnyValue(v *commonpb.AnyValue) interface{} {
+	switch val := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return val.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return val.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return val.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return val.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(val.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		items := []interface{}{}
+		for _, item := range val.ArrayValue.GetValues() {
+			items = append(items, protoAnyValue(item))
+		}
+		return items
+	case *commonpb.AnyValue_KvlistValue:
+		return protoAttributes(val.KvlistValue.GetValues())
+	}
+	return nil
+}
+
+// OTLP/JSON differs from the protobuf JSON mapping: trace and span IDs are
+// hex strings, and 64-bit integers may be sent as strings or numbers.
+
+type otlpJSONRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"scope"`
+			LogRecords []otlpJSONLogRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type otlpJSONLogRecord struct {
+	TimeUnixNano         otlpJSONInt        `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpJSONInt        `json:"observedTimeUnixNano"`
+	SeverityNumber       int32              `json:"severityNumber"`
+	SeverityText         string             `json:"severityText"`
+	EventName            string             `json:"eventName"`
+	Body                 *otlpJSONAnyValue  `json:"body"`
+	Attributes           []otlpJSONKeyValue `json:"attributes"`
+	TraceID              string             `json:"traceId"`
+	SpanID               string             `json:"spanId"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+type otlpJSONAnyValue struct {
+	StringValue *string      `json:"stringValue"`
+	BoolValue   *bool        `json:"boolValue"`
+	IntValue    *otlpJSONInt `json:"intValue"`
+	DoubleValue *float64     `json:"doubleValue"`
+	BytesValue  *string      `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []otlpJSONAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJSONKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+// otlpJSONInt accepts a 64-bit integer encoded as a JSON number or string.
+type otlpJSONInt int64
+
+func (n *otlpJSONInt) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*n = otlpJSONInt(v)
+		return nil
+	}
+	// Unix nanoseconds past 2262 overflow int64 but fit in uint64.
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid integer %s", data)
+	}
+	*n = otlpJSONInt(v)
+	return nil
+}
+
+func decodeOTLPJSON(body []byte) ([]otlpLog, error) {
+	var req otlpJSONRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	var records []otlpLog
+	for _, rl := range req.ResourceLogs {
+		resource := jsonAttributes(rl.Resource.Attributes)
+		for _, sl := range rl.ScopeLogs {
+			for _, lr := range sl.LogRecords {
+				rec := otlpLog{
+					eventName:            lr.EventName,
+					timeUnixNano:         uint64(lr.TimeUnixNano),
+					observedTimeUnixNano: uint64(lr.ObservedTimeUnixNano),
+					severityNumber:       lr.SeverityNumber,
+					severityText:         lr.SeverityText,
+					attributes:           jsonAttributes(lr.Attributes),
+					resource:             resource,
+					scopeName:            sl.Scope.Name,
+					scopeVersion:         sl.Scope.Version,
+					traceID:              strings.ToLower(lr.TraceID),
+					spanID:               strings.ToLower(lr.SpanID),
+				}
+				if lr.Body != nil {
+					rec.body = jsonAnyValue(*lr.Body)
+				}
+				records = append(records, rec)
+			}
+		}
+	}
+	return records, nil
+}
+
+func jsonAttributes(kvs []otlpJSONKeyValue) map[string]interface{} {
+	attrs := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		attrs[kv.Key] = jsonAnyValue(kv.Value)
+	}
+	return attrs
+}
+
+func jsonAnyValue(v otlpJSONAnyValue) interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	case v.ArrayValue != nil:
+		items := []interface{}{}
+		for _, item := range v.ArrayValue.Values {
+			items = append(items, jsonAnyValue(item))
+		}
+		return items
+	case v.KvlistValue != nil:
+		return jsonAttributes(v.KvlistValue.Values)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func stringValue(s string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+}
+
+func intValue(n int64) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: n}}
+}
+
+func keyValue(k string, v *commonpb.AnyValue) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: v}
+}
+
+// otlpProtoRequest and otlpJSONBody encode the same three records: a full
+// one, one with only an observed time and a kvlist body, and one too old
+// to accept.
+func otlpProtoRequest(t *testing.T, now, old time.Time) []byte {
+	t.Helper()
+	req := &logspb.LogsData{ResourceLogs: []*logspb.ResourceLogs{{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			keyValue("service.name", stringValue("checkout")),
+			keyValue("host.cpus", intValue(8)),
+		}},
+		ScopeLogs: []*logspb.ScopeLogs{{
+			Scope: &commonpb.InstrumentationScope{Name: "app", Version: "1.2"},
+			LogRecords: []*logspb.LogRecord{
+				{
+					TimeUnixNano:   uint64(now.UnixNano()),
+					SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+					SeverityText:   "ERROR",
+					Body:           stringValue("card declined"),
+					Attributes: []*commonpb.KeyValue{
+						keyValue("event.name", stringValue("payment.failed")),
+						keyValue("amount", &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 9.5}}),
+						keyValue("retry", &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: true}}),
+						keyValue("raw", &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: []byte{1, 2}}}),
+						keyValue("tags", &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{
+							Values: []*commonpb.AnyValue{stringValue("a"), intValue(1)},
+						}}}),
+						keyValue("user", &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+							Values: []*commonpb.KeyValue{keyValue("id", intValue(42))},
+						}}}),
+					},
+					TraceId: []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c},
+					SpanId:  []byte{0xee, 0xe1, 0x9b, 0x7e, 0xc3, 0xc1, 0xb1, 0x74},
+				},
+				{
+					ObservedTimeUnixNano: uint64(now.UnixNano()),
+					EventName:            "heartbeat",
+					Body: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+						Values: []*commonpb.KeyValue{keyValue("up", &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: true}})},
+					}}},
+				},
+				{TimeUnixNano: uint64(old.UnixNano()), EventName: "stale"},
+			},
+		}},
+	}}}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func otlpJSONBody(now, old time.Time) []byte {
+	return []byte(fmt.Sprintf(`{"resourceLogs": [{
+		"resource": {"attributes": [
+			{"key": "service.name", "value": {"stringValue": "checkout"}},
+			{"key": "host.cpus", "value": {"intValue": "8"}}
+		]},
+		"scopeLogs": [{
+			"scope": {"name": "app", "version": "1.2"},
+			"logRecords": [
+				{
+					"timeUnixNano": "%d",
+					"severityNumber": 17,
+					"severityText": "ERROR",
+					"body": {"stringValue": "card declined"},
+					"attributes": [
+						{"key": "event.name", "value": {"stringValue": "payment.failed"}},
+						{"key": "amount", "value": {"doubleValue": 9.5}},
+						{"key": "retry", "value": {"boolValue": true}},
+						{"key": "raw", "value": {"bytesValue": "AQI="}},
+						{"key": "tags", "value": {"arrayValue": {"values": [{"stringValue": "a"}, {"intValue": 1}]}}},
+						{"key": "user", "value": {"kvlistValue": {"values": [{"key": "id", "value": {"intValue": 42}}]}}}
+					],
+					"traceId": "5B8EFFF798038103D269B633813FC60C",
+					"spanId": "eee19b7ec3c1b174"
+				},
+				{
+					"observedTimeUnixNano": %d,
+					"eventName": "heartbeat",
+					"body": {"kvlistValue": {"values": [{"key": "up", "value": {"boolValue": true}}]}}
+				},
+				{"timeUnixNano": "%d", "eventName": "stale"}
+			]
+		}]
+	}]}`, now.UnixNano(), now.UnixNano(), old.UnixNano()))
+}
+
+// partialSuccess decodes an ExportLogsServiceResponse in either encoding.
+func partialSuccess(t *testing.T, isJSON bool, body []byte) (int64, string) {
+	t.Helper()
+	if isJSON {
+		var resp struct {
+			PartialSuccess struct {
+				RejectedLogRecords string `json:"rejectedLogRecords"`
+				ErrorMessage       string `json:"errorMessage"`
+			} `json:"partialSuccess"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("response %s: %v", body, err)
+		}
+		if resp.PartialSuccess.RejectedLogRecords == "" {
+			return 0, resp.PartialSuccess.ErrorMessage
+		}
+		n, err := strconv.ParseInt(resp.PartialSuccess.RejectedLogRecords, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n, resp.PartialSuccess.ErrorMessage
+	}
+
+	var rejected int64
+	var errMsg string
+	for len(body) > 0 {
+		num, typ, n := protowire.ConsumeTag(body)
+		if n < 0 || num != 1 || typ != protowire.BytesType {
+			t.Fatalf("unexpected field %d in response", num)
+		}
+		body = body[n:]
+		partial, n := protowire.ConsumeBytes(body)
+		body = body[n:]
+		for len(partial) > 0 {
+			num, _, n := protowire.ConsumeTag(partial)
+			partial = partial[n:]
+			switch num {
+			case 1:
+				v, n := protowire.ConsumeVarint(partial)
+				rejected = int64(v)
+				partial = partial[n:]
+			case 2:
+				v, n := protowire.ConsumeString(partial)
+				errMsg = v
+				partial = partial[n:]
+			default:
+				t.Fatalf("unexpected field %d in partial_success", num)
+			}
+		}
+	}
+	return rejected, errMsg
+}
+
+func TestOTLPLogsHandler(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	old := now.Add(-maxEventAge - time.Hour)
+	wantPayloads := []map[string]interface{}{
+		{
+			"event.name":            "payment.failed",
+			"amount":                9.5,
+			"retry":                 true,
+			"raw":                   "AQI=",
+			"tags":                  []interface{}{"a", 1.0},
+			"user":                  map[string]interface{}{"id": 42.0},
+			"resource.service.name": "checkout",
+			"resource.host.cpus":    8.0,
+			"body":                  "card declined",
+			"severity_text":         "ERROR",
+			"severity_number":       17.0,
+			"trace_id":              "5b8efff798038103d269b633813fc60c",
+			"span_id":               "eee19b7ec3c1b174",
+			"scope.name":            "app",
+			"scope.version":         "1.2",
+		},
+		{
+			"resource.service.name": "checkout",
+			"resource.host.cpus":    8.0,
+			"body":                  map[string]interface{}{"up": true},
+			"scope.name":            "app",
+			"scope.version":         "1.2",
+		},
+	}
+	wantEvents := []string{"payment.failed", "heartbeat"}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"protobuf", "application/x-protobuf", otlpProtoRequest(t, now, old)},
+		{"json", "application/json; charset=utf-8", otlpJSONBody(now, old)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fdb := useFakeDB(t)
+			fdb.on("FROM projects WHERE api_key", func(args []driver.Value) (fakeResult, error) {
+				if args[0] != "key1" {
+					return fakeResult{}, nil
+				}
+				return fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{"p1"}}}, nil
+			})
+			w := useFakeWriter(t)
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("X-API-KEY", "key1")
+			rec := httptest.NewRecorder()
+			otlpLogsHandler(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			isJSON := tt.name == "json"
+			if ct := rec.Header().Get("Content-Type"); isJSON != (ct == "application/json") {
+				t.Errorf("response Content-Type = %q", ct)
+			}
+			rejected, errMsg := partialSuccess(t, isJSON, rec.Body.Bytes())
+			if rejected != 1 || errMsg != "timestamp is more than 168h0m0s in the past" {
+				t.Errorf("partial_success = %d, %q", rejected, errMsg)
+			}
+
+			if len(w.messages) != len(wantPayloads) {
+				t.Fatalf("wrote %d messages, want %d", len(w.messages), len(wantPayloads))
+			}
+			for i, msg := range w.messages {
+				var env struct {
+					ProjectID string `json:"project_id"`
+					LogID     string `json:"log_id"`
+					EventTime int64  `json:"event_time"`
+					Payload   struct {
+						EventName string                 `json:"event_name"`
+						Payload   map[string]interface{} `json:"payload"`
+					} `json:"payload"`
+				}
+				if err := json.Unmarshal(msg.Value, &env); err != nil {
+					t.Fatal(err)
+				}
+				if string(msg.Key) != "p1" || env.ProjectID != "p1" || env.LogID == "" {
+					t.Errorf("message %d: key %q, project %q, log ID %q", i, msg.Key, env.ProjectID, env.LogID)
+				}
+				if env.EventTime != now.UnixMilli() {
+					t.Errorf("message %d: event time %d, want %d", i, env.EventTime, now.UnixMilli())
+				}
+				if env.Payload.EventName != wantEvents[i] {
+					t.Errorf("message %d: event name %q, want %q", i, env.Payload.EventName, wantEvents[i])
+				}
+				if !reflect.DeepEqual(env.Payload.Payload, wantPayloads[i]) {
+					t.Errorf("message %d: payload\n  %v\nwant\n  %v", i, env.Payload.Payload, wantPayloads[i])
+				}
+			}
+		})
+	}
+}
+
+func TestOTLPLogsHandlerErrors(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		contentType string
+		apiKey      string
+		body        []byte
+		writeErr    error
+		status      int
+	}{
+		{"unknown API key", "application/json", "nope", otlpJSONBody(now, now), nil, http.StatusUnauthorized},
+		{"unsupported content type", "text/plain", "key1", []byte("hi"), nil, http.StatusUnsupportedMediaType},
+		{"invalid protobuf", "application/x-protobuf", "key1", []byte{0xff}, nil, http.StatusBadRequest},
+		{"invalid JSON", "application/json", "key1", []byte("{"), nil, http.StatusBadRequest},
+		{"kafka down", "application/json", "key1", otlpJSONBody(now, now), errors.New("no brokers"), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fdb := useFakeDB(t)
+			if tt.apiKey == "key1" {
+				fdb.row("FROM projects WHERE api_key = $1", []string{"id"}, "p1")
+			}
+			w := useFakeWriter(t)
+			w.err = tt.writeErr
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/logs", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("X-API-KEY", tt.apiKey)
+			rec := httptest.NewRecorder()
+			otlpLogsHandler(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestOTLPEmptyResponse(t *testing.T) {
+	for _, isJSON := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		writeOTLPResponse(rec, isJSON, 0, "")
+		if rejected, errMsg := partialSuccess(t, isJSON, rec.Body.Bytes()); rejected != 0 || errMsg != "" {
+			t.Errorf("isJSON=%v: partial_success = %d, %q, want none", isJSON, rejected, errMsg)
+		}
+	}
+}
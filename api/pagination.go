@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Page sizes for the logs API.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Cursor directions. Logs are listed newest first, so next pages go back in
+// time and prev pages forward.
+const (
+	cursorNext = "next"
+	cursorPrev = "prev"
+)
+
+// logCursor is a position in a newest-first list of logs: the
+// (timestamp, log_id) key of the row a page continues from, exclusive. It
+// is handed to clients as opaque base64.
+type logCursor struct {
+	Timestamp int64  `json:"ts"`
+	LogID     string `json:"id"`
+	Dir       string `json:"dir"`
+}
+
+func (c logCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func decodeCursor(s string) (*logCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var c logCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errInvalidCursor
+	}
+	if _, err := uuid.Parse(c.LogID); err != nil || (c.Dir != cursorNext && c.Dir != cursorPrev) {
+		return nil, errInvalidCursor
+	}
+	return &c, nil
+}
+
+// parseTimeParam reads a from/to parameter: RFC3339, a date
+// (2006-01-02, UTC), unix milliseconds, "now", or now plus or minus a
+// duration such as now-15m, now-2h, now-7d or now-1w.
+func parseTimeParam(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if rest, ok := strings.CutPrefix(s, "now"); ok {
+		if rest == "" {
+			return now, nil
+		}
+		sign := rest[0]
+		if sign != '-' && sign != '+' {
+			return time.Time{}, fmt.Errorf("invalid time %q", s)
+		}
+		d, err := parseRelativeDuration(rest[1:])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time %q: %v", s, err)
+		}
+		if sign == '-' {
+			d = -d
+		}
+		return now.Add(d), nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, want RFC3339, a date, unix milliseconds or now-15m", s)
+}
+
+// parseRelativeDuration is time.ParseDuration plus days (d) and weeks (w).
+func parseRelativeDuration(s string) (time.Duration, error) {
+	for unit, size := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, unit); ok {
+			v, err := strconv.Atoi(n)
+			if err != nil || v < 0 {
+				return 0, errors.New("invalid duration")
+			}
+			return time.Duration(v) * size, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid duration")
+	}
+	return d, nil
+}
+
+// parsePageSize reads the limit parameter.
+func parsePageSize(s string) (int, error) {
+	if s == "" {
+		return defaultPageSize, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	return n, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, c := range []logCursor{
+		{Timestamp: 1700000000000, LogID: "6f1c2c1e-0b7a-4e55-9d8e-0c6f3b1f2a11", Dir: cursorNext},
+		{Timestamp: 0, LogID: "00000000-0000-0000-0000-000000000000", Dir: cursorPrev},
+	} {
+		got, err := decodeCursor(c.encode())
+		if err != nil {
+			t.Fatalf("decodeCursor(%+v) error: %v", c, err)
+		}
+		if *got != c {
+			t.Errorf("decodeCursor(encode(%+v)) = %+v", c, *got)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	enc := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"ts":1}`))},
+		{"not json", enc("hello")},
+		{"bad log id", enc(`{"ts":1,"id":"abc","dir":"next"}`)},
+		{"bad direction", enc(`{"ts":1,"id":"6f1c2c1e-0b7a-4e55-9d8e-0c6f3b1f2a11","dir":"up"}`)},
+		{"wrong types", enc(`{"ts":"1","id":"6f1c2c1e-0b7a-4e55-9d8e-0c6f3b1f2a11","dir":"next"}`)},
+	}
+	for _, tt := range tests {
+		if c, err := decodeCursor(tt.in); err != errInvalidCursor {
+			t.Errorf("%s: decodeCursor(%q) = %+v, %v; want errInvalidCursor", tt.name, tt.in, c, err)
+		}
+	}
+}
+
+func TestParseTimeParam(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"now", now},
+		{" now ", now},
+		{"now-15m", now.Add(-15 * time.Minute)},
+		{"now-6h", now.Add(-6 * time.Hour)},
+		{"now+1h30m", now.Add(90 * time.Minute)},
+		{"now-7d", now.AddDate(0, 0, -7)},
+		{"now-1w", now.AddDate(0, 0, -7)},
+		{"1700000000000", time.UnixMilli(1700000000000)},
+		{"2024-03-01T10:00:00Z", time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)},
+		{"2024-03-01T10:00:00.5+02:00", time.Date(2024, 3, 1, 8, 0, 0, 5e8, time.UTC)},
+		{"2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeParam(tt.in, now)
+		if err != nil {
+			t.Errorf("parseTimeParam(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseTimeParam(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimeParamErrors(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 30, 0, 0, time.UTC)
+	for _, in := range []string{"", "yesterday", "now*5m", "now-", "now--5m", "now-5x", "now-1.5d", "2024-13-01", "2024-03-01 10:00"} {
+		if got, err := parseTimeParam(in, now); err == nil {
+			t.Errorf("parseTimeParam(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestParsePageSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		ok   bool
+	}{
+		{"", defaultPageSize, true},
+		{"1", 1, true},
+		{"1000", maxPageSize, true},
+		{"0", 0, false},
+		{"1001", 0, false},
+		{"-5", 0, false},
+		{"ten", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePageSize(tt.in)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("parsePageSize(%q) = %d, %v; want %d, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// Log search queries look like
+//
+//	event:checkout AND user_id=42 AND NOT status:ok AND amount>100
+//
+// Terms are joined with AND (also implied between terms), OR and NOT, and
+// grouped with parentheses. A term is one of
+//
+//	field:value  field=value  field!=value   equality; * and ? are wildcards
+//	field>n  field>=n  field<n  field<=n      comparison
+//	field:[a TO b]  field:{a TO b}            inclusive / exclusive range, * for open
+//	field IN (a, b, c)                        any of the values
+//	text                                      free text (see below)
+//
+// Values with spaces or special characters are quoted ("a b"); wildcards in
+// quoted values are literal. Keywords are case-insensitive.
+//
+// Free text matches a log if it appears in the event name, in a searchable
+// value, or in the payload's text (payload_text), which is searched through
+// the full-text index: a bare word as a whole token, word* as a token
+// prefix and "a phrase" as exact text. See fulltext.go.
+
+// maxQueryLength and maxQueryDepth bound the work one query can cause.
+const (
+	maxQueryLength = 2000
+	maxQueryDepth  = 32
+)
+
+// queryError is a parse error at a character position (0-based) of the
+// query.
+type queryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("at position %d: %s", e.Pos, e.Msg)
+}
+
+type queryNode interface{ node() }
+
+type andNode struct{ children []queryNode }
+type orNode struct{ children []queryNode }
+type notNode struct{ child queryNode }
+
+// textNode is free text without a field.
+type textNode struct{ value queryValue }
+
+// compareNode is field op value, where op is one of : = != > >= < <=.
+type compareNode struct {
+	field string
+	op    string
+	value queryValue
+}
+
+// rangeNode is field:[low TO high]; a nil bound is open.
+type rangeNode struct {
+	field             string
+	low, high         *queryValue
+	lowIncl, highIncl bool
+}
+
+type inNode struct {
+	field  string
+	values []queryValue
+}
+
+func (andNode) node()     {}
+func (orNode) node()      {}
+func (notNode) node()     {}
+func (textNode) node()    {}
+func (compareNode) node() {}
+func (rangeNode) node()   {}
+func (inNode) node()      {}
+
+// queryValue is a value as written. Quoted values match literally.
+type queryValue struct {
+	text   string
+	quoted bool
+	pos    int
+}
+
+// wildcard reports whether the value is a pattern.
+func (v queryValue) wildcard() bool {
+	return !v.quoted && strings.ContainsAny(v.text, "*?")
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokLBrace
+	tokRBrace
+	tokComma
+	tokOp // : = != > >= < <=
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// keyword reports whether t is the unquoted keyword kw.
+func (t token) keyword(kw string) bool {
+	return t.kind == tokWord && strings.EqualFold(t.text, kw)
+}
+
+func (t token) describe() string {
+	if t.kind == tokEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// isDelimiter reports whether r ends a word.
+func isDelimiter(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`()[]{},:=!<>"`, r)
+}
+
+func lexQuery(q string) ([]token, error) {
+	rs := []rune(q)
+	var toks []token
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"':
+			start := i
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(rs) {
+					return nil, &queryError{Pos: start, Msg: "unterminated quoted value"}
+				}
+				if rs[i] == '\\' && i+1 < len(rs) {
+					b.WriteRune(rs[i+1])
+					i += 2
+					continue
+				}
+				if rs[i] == '"' {
+					i++
+					break
+				}
+				b.WriteRune(rs[i])
+				i++
+			}
+			toks = append(toks, token{kind: tokString, text: b.String(), pos: start})
+		case strings.ContainsRune("()[]{},", r):
+			kind := map[rune]tokenKind{'(': tokLParen, ')': tokRParen, '[': tokLBracket, ']': tokRBracket, '{': tokLBrace, '}': tokRBrace, ',': tokComma}[r]
+			toks = append(toks, token{kind: kind, text: string(r), pos: i})
+			i++
+		case r == ':' || r == '=':
+			toks = append(toks, token{kind: tokOp, text: string(r), pos: i})
+			i++
+		case r == '!' || r == '<' || r == '>':
+			op := string(r)
+			if i+1 < len(rs) && rs[i+1] == '=' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, &queryError{Pos: i, Msg: `expected "!="`}
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		default:
+			start := i
+			for i < len(rs) && !isDelimiter(rs[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: tokWord, text: string(rs[start:i]), pos: start})
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(rs)}), nil
+}
+
+type queryParser struct {
+	toks  []token
+	i     int
+	depth int
+}
+
+// parseQuery parses a search query into its AST. An empty query returns
+// nil.
+func parseQuery(q string) (queryNode, error) {
+	if n := len([]rune(q)); n > maxQueryLength {
+		return nil, &queryError{Pos: maxQueryLength, Msg: fmt.Sprintf("query is longer than %d characters", maxQueryLength)}
+	}
+	toks, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks}
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &queryError{Pos: t.pos, Msg: "unexpected " + t.describe()}
+	}
+	return n, nil
+}
+
+func (p *queryParser) peek() token { return p.toks[p.i] }
+
+func (p *queryParser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	children := []queryNode{first}
+	for p.peek().keyword("OR") {
+		p.next()
+		n, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, n)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return orNode{children}, nil
+}
+
+// parseAnd parses terms joined by AND, or by nothing at all.
+func (p *queryParser) parseAnd() (queryNode, error) {
+	first, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	children := []queryNode{first}
+	for {
+		t := p.peek()
+		if t.keyword("AND") {
+			p.next()
+		} else if t.kind == tokEOF || t.kind == tokRParen || t.keyword("OR") {
+			break
+		}
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, n)
+	}
+	if len(children) == 1 {
+		return first, nil
+	}
+	return andNode{children}, nil
+}
+
+func (p *queryParser) parseNot() (queryNode, error) {
+	if p.peek().keyword("NOT") {
+		p.next()
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokLParen:
+		if p.depth++; p.depth > maxQueryDepth {
+			return nil, &queryError{Pos: t.pos, Msg: fmt.Sprintf("groups are nested more than %d deep", maxQueryDepth)}
+		}
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, &queryError{Pos: c.pos, Msg: "expected \")\" to close the group at position " + fmt.Sprint(t.pos)}
+		}
+		p.depth--
+		return n, nil
+	case tokString:
+		return textNode{queryValue{text: t.text, quoted: true, pos: t.pos}}, nil
+	case tokWord:
+		if t.keyword("AND") || t.keyword("OR") {
+			return nil, &queryError{Pos: t.pos, Msg: "expected a term before " + strings.ToUpper(t.text)}
+		}
+		next := p.peek()
+		switch {
+		case next.kind == tokOp:
+			return p.parseComparison(t)
+		case next.keyword("IN"):
+			return p.parseIn(t)
+		}
+		return textNode{queryValue{text: t.text, pos: t.pos}}, nil
+	case tokEOF:
+		return nil, &queryError{Pos: t.pos, Msg: "expected a term"}
+	default:
+		return nil, &queryError{Pos: t.pos, Msg: "unexpected " + t.describe()}
+	}
+}
+
+func (p *queryParser) parseComparison(field token) (queryNode, error) {
+	if err := checkField(field); err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if op.text == ":" {
+		if t := p.peek(); t.kind == tokLBracket || t.kind == tokLBrace {
+			return p.parseRange(field)
+		}
+	}
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if op.text != ":" && op.text != "=" && op.text != "!=" && v.wildcard() {
+		return nil, &queryError{Pos: v.pos, Msg: "wildcards can only be used with :, = and !="}
+	}
+	return compareNode{field: field.text, op: op.text, value: v}, nil
+}
+
+func (p *queryParser) parseRange(field token) (queryNode, error) {
+	open := p.next()
+	n := rangeNode{field: field.text, lowIncl: open.kind == tokLBracket}
+	low, err := p.parseBound()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.next(); !t.keyword("TO") {
+		return nil, &queryError{Pos: t.pos, Msg: "expected TO in range"}
+	}
+	high, err := p.parseBound()
+	if err != nil {
+		return nil, err
+	}
+	switch t := p.next(); t.kind {
+	case tokRBracket:
+		n.highIncl = true
+	case tokRBrace:
+	default:
+		return nil, &queryError{Pos: t.pos, Msg: `expected "]" or "}" to close the range`}
+	}
+	if low == nil && high == nil {
+		return nil, &queryError{Pos: open.pos, Msg: "range needs at least one bound"}
+	}
+	n.low, n.high = low, high
+	return n, nil
+}
+
+// parseBound parses a range bound, where an unquoted * is open.
+func (p *queryParser) parseBound() (*queryValue, error) {
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if !v.quoted && v.text == "*" {
+		return nil, nil
+	}
+	if v.wildcard() {
+		return nil, &queryError{Pos: v.pos, Msg: "wildcards cannot be used in a range"}
+	}
+	return &v, nil
+}
+
+func (p *queryParser) parseIn(field token) (queryNode, error) {
+	if err := checkField(field); err != nil {
+		return nil, err
+	}
+	p.next() // IN
+	if t := p.next(); t.kind != tokLParen {
+		return nil, &queryError{Pos: t.pos, Msg: `expected "(" after IN`}
+	}
+	n := inNode{field: field.text}
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		n.values = append(n.values, v)
+		t := p.next()
+		if t.kind == tokRParen {
+			return n, nil
+		}
+		if t.kind != tokComma {
+			return nil, &queryError{Pos: t.pos, Msg: `expected "," or ")" in IN list`}
+		}
+	}
+}
+
+func (p *queryParser) parseValue() (queryValue, error) {
+	t := p.next()
+	switch t.kind {
+	case tokWord:
+		return queryValue{text: t.text, pos: t.pos}, nil
+	case tokString:
+		return queryValue{text: t.text, quoted: true, pos: t.pos}, nil
+	default:
+		return queryValue{}, &queryError{Pos: t.pos, Msg: "expected a value, got " + t.describe()}
+	}
+}
+
+// checkField rejects field names that could not be payload keys.
+func checkField(t token) error {
+	for _, r := range t.text {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-@$/", r)) {
+			return &queryError{Pos: t.pos, Msg: fmt.Sprintf("invalid field name %q", t.text)}
+		}
+	}
+	return nil
+}
+
+// writeQueryError answers a query that does not parse with 400, giving the
+// position of the error so clients can point at it.
+func writeQueryError(w http.ResponseWriter, err error) {
+	body := map[string]interface{}{"error": err.Error()}
+	var qe *queryError
+	if errors.As(err, &qe) {
+		body["error"] = qe.Msg
+		body["position"] = qe.Pos
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(body)
+}
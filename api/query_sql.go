@@ -0,0 +1,207 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// queryColumns are the fields that are logs_index columns. Any other field
+// is a payload key, looked up in the typed payload maps and in searchable.
+var queryColumns = map[string]string{
+	"event":      "event_name",
+	"event_name": "event_name",
+	"log_id":     "toString(log_id)",
+}
+
+// sqlBuilder compiles a query AST into a ClickHouse boolean expression.
+// Every value and payload key is bound as a ? parameter, never written into
+// the SQL text.
+type sqlBuilder struct {
+	sb   strings.Builder
+	args []interface{}
+}
+
+// compileQuery returns the SQL condition for a parsed query and its
+// arguments.
+func compileQuery(n queryNode) (string, []interface{}) {
+	var b sqlBuilder
+	b.node(n)
+	return b.sb.String(), b.args
+}
+
+func (b *sqlBuilder) write(sql string, args ...interface{}) {
+	b.sb.WriteString(sql)
+	b.args = append(b.args, args...)
+}
+
+func (b *sqlBuilder) join(op string, parts []func()) {
+	b.write("(")
+	for i, part := range parts {
+		if i > 0 {
+			b.write(" " + op + " ")
+		}
+		part()
+	}
+	b.write(")")
+}
+
+func (b *sqlBuilder) node(n queryNode) {
+	switch n := n.(type) {
+	case andNode:
+		b.join("AND", b.children(n.children))
+	case orNode:
+		b.join("OR", b.children(n.children))
+	case notNode:
+		b.write("NOT ")
+		b.join("", []func(){func() { b.node(n.child) }})
+	case textNode:
+		p := likePattern(n.value, true)
+		b.write("(event_name ILIKE ? OR arrayExists(v -> v ILIKE ?, mapValues(searchable)) OR ", p, p)
+		b.fullText(n.value)
+		b.write(")")
+	case compareNode:
+		b.compare(n.field, n.op, n.value)
+	case rangeNode:
+		var parts []func()
+		if n.low != nil {
+			op := ">"
+			if n.lowIncl {
+				op = ">="
+			}
+			parts = append(parts, func() { b.compare(n.field, op, *n.low) })
+		}
+		if n.high != nil {
+			op := "<"
+			if n.highIncl {
+				op = "<="
+			}
+			parts = append(parts, func() { b.compare(n.field, op, *n.high) })
+		}
+		b.join("AND", parts)
+	case inNode:
+		parts := make([]func(), len(n.values))
+		for i, v := range n.values {
+			v := v
+			parts[i] = func() { b.compare(n.field, "=", v) }
+		}
+		b.join("OR", parts)
+	}
+}
+
+func (b *sqlBuilder) children(nodes []queryNode) []func() {
+	parts := make([]func(), len(nodes))
+	for i, c := range nodes {
+		c := c
+		parts[i] = func() { b.node(c) }
+	}
+	return parts
+}
+
+// compare compiles field op value. Equality on a payload key matches the
+// value as text, and also as a number or boolean when it reads as one.
+// Ordering compares numerically when the value is a number and as text
+// otherwise.
+func (b *sqlBuilder) compare(field, op string, v queryValue) {
+	if op == "!=" {
+		b.write("NOT ")
+		b.compare(field, "=", v)
+		return
+	}
+	if op == ":" {
+		op = "="
+	}
+
+	if col, ok := queryColumns[field]; ok {
+		if op == "=" && v.wildcard() {
+			b.write(col+" LIKE ?", likePattern(v, false))
+			return
+		}
+		b.write(col+" "+op+" ?", v.text)
+		return
+	}
+
+	var parts []func()
+	if op == "=" {
+		if v.wildcard() {
+			p := likePattern(v, false)
+			for _, m := range []string{"payload_string", "searchable"} {
+				m := m
+				parts = append(parts, func() { b.mapCond(m, field, m+"[?] LIKE ?", p) })
+			}
+			b.join("OR", parts)
+			return
+		}
+		for _, m := range []string{"payload_string", "searchable"} {
+			m := m
+			parts = append(parts, func() { b.mapCond(m, field, m+"[?] = ?", v.text) })
+		}
+		if n, ok := queryNumber(v); ok {
+			parts = append(parts, func() { b.mapCond("payload_number", field, "payload_number[?] = ?", n) })
+		}
+		if !v.quoted && (v.text == "true" || v.text == "false") {
+			parts = append(parts, func() { b.mapCond("payload_bool", field, "payload_bool[?] = ?", v.text == "true") })
+		}
+		b.join("OR", parts)
+		return
+	}
+
+	if n, ok := queryNumber(v); ok {
+		parts = append(parts,
+			func() { b.mapCond("payload_number", field, "payload_number[?] "+op+" ?", n) },
+			func() { b.mapCond("searchable", field, "toFloat64OrNull(searchable[?]) "+op+" ?", n) },
+		)
+	} else {
+		for _, m := range []string{"payload_string", "searchable"} {
+			m := m
+			parts = append(parts, func() { b.mapCond(m, field, m+"[?] "+op+" ?", v.text) })
+		}
+	}
+	b.join("OR", parts)
+}
+
+// mapCond writes cond on a map column, guarded by the key being present so
+// a missing key (which reads as the zero value) never matches. cond has a
+// ? for the key followed by one for value.
+func (b *sqlBuilder) mapCond(col, key, cond string, value interface{}) {
+	b.write("(mapContains("+col+", ?) AND "+cond+")", key, key, value)
+}
+
+// queryNumber reads an unquoted value as a finite number.
+func queryNumber(v queryValue) (float64, bool) {
+	if v.quoted {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(v.text, 64)
+	if err != nil || math.IsInf(n, 0) || math.IsNaN(n) {
+		return 0, false
+	}
+	return n, true
+}
+
+// likePattern turns a value into a LIKE pattern. LIKE's own wildcards are
+// escaped; in unquoted values * and ? become % and _. contains wraps the
+// pattern in %.
+func likePattern(v queryValue, contains bool) string {
+	var sb strings.Builder
+	if contains {
+		sb.WriteByte('%')
+	}
+	for _, r := range v.text {
+		switch {
+		case r == '\\' || r == '%' || r == '_':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '*' && !v.quoted:
+			sb.WriteByte('%')
+		case r == '?' && !v.quoted:
+			sb.WriteByte('_')
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	if contains {
+		sb.WriteByte('%')
+	}
+	return sb.String()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileQuery(t *testing.T) {
+	tests := []struct {
+		in   string
+		sql  string
+		args []interface{}
+	}{
+		{
+			in:   "event:checkout",
+			sql:  "event_name = ?",
+			args: []interface{}{"checkout"},
+		},
+		{
+			in:   "event_name:check*",
+			sql:  "event_name LIKE ?",
+			args: []interface{}{"check%"},
+		},
+		{
+			in:   "log_id!=abc",
+			sql:  "NOT toString(log_id) = ?",
+			args: []interface{}{"abc"},
+		},
+		{
+			in:  "user_id=42",
+			sql: "((mapContains(payload_string, ?) AND payload_string[?] = ?) OR (mapContains(searchable, ?) AND searchable[?] = ?) OR (mapContains(payload_number, ?) AND payload_number[?] = ?))",
+			args: []interface{}{
+				"user_id", "user_id", "42",
+				"user_id", "user_id", "42",
+				"user_id", "user_id", 42.0,
+			},
+		},
+		{
+			in:  "paid:true",
+			sql: "((mapContains(payload_string, ?) AND payload_string[?] = ?) OR (mapContains(searchable, ?) AND searchable[?] = ?) OR (mapContains(payload_bool, ?) AND payload_bool[?] = ?))",
+			args: []interface{}{
+				"paid", "paid", "true",
+				"paid", "paid", "true",
+				"paid", "paid", true,
+			},
+		},
+		{
+			in:   `code:"42"`,
+			sql:  "((mapContains(payload_string, ?) AND payload_string[?] = ?) OR (mapContains(searchable, ?) AND searchable[?] = ?))",
+			args: []interface{}{"code", "code", "42", "code", "code", "42"},
+		},
+		{
+			in:   "path:/api/50%_*",
+			sql:  "((mapContains(payload_string, ?) AND payload_string[?] LIKE ?) OR (mapContains(searchable, ?) AND searchable[?] LIKE ?))",
+			args: []interface{}{"path", "path", `/api/50\%\_%`, "path", "path", `/api/50\%\_%`},
+		},
+		{
+			in:   "amount>=1.5",
+			sql:  "((mapContains(payload_number, ?) AND payload_number[?] >= ?) OR (mapContains(searchable, ?) AND toFloat64OrNull(searchable[?]) >= ?))",
+			args: []interface{}{"amount", "amount", 1.5, "amount", "amount", 1.5},
+		},
+		{
+			in:   "name<m",
+			sql:  "((mapContains(payload_string, ?) AND payload_string[?] < ?) OR (mapContains(searchable, ?) AND searchable[?] < ?))",
+			args: []interface{}{"name", "name", "m", "name", "name", "m"},
+		},
+		{
+			in:   "n:{1 TO *]",
+			sql:  "(((mapContains(payload_number, ?) AND payload_number[?] > ?) OR (mapContains(searchable, ?) AND toFloat64OrNull(searchable[?]) > ?)))",
+			args: []interface{}{"n", "n", 1.0, "n", "n", 1.0},
+		},
+		{
+			in:   "event IN (a, b)",
+			sql:  "(event_name = ? OR event_name = ?)",
+			args: []interface{}{"a", "b"},
+		},
+		{
+			in:   "event:a OR NOT event:b",
+			sql:  "(event_name = ? OR NOT (event_name = ?))",
+			args: []interface{}{"a", "b"},
+		},
+		{
+			in:   "declined",
+			sql:  "(event_name ILIKE ? OR arrayExists(v -> v ILIKE ?, mapValues(searchable)) OR hasToken(lowerUTF8(payload_text), ?))",
+			args: []interface{}{"%declined%", "%declined%", "declined"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			n, err := parseQuery(tt.in)
+			if err != nil {
+				t.Fatalf("parseQuery(%q) error: %v", tt.in, err)
+			}
+			sql, args := compileQuery(n)
+			if sql != tt.sql {
+				t.Errorf("sql =\n  %s\nwant\n  %s", sql, tt.sql)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %#v, want %#v", args, tt.args)
+			}
+			if got, want := strings.Count(sql, "?"), len(args); got != want {
+				t.Errorf("%d placeholders for %d args", got, want)
+			}
+		})
+	}
+}
+
+func TestLikePattern(t *testing.T) {
+	tests := []struct {
+		text     string
+		quoted   bool
+		contains bool
+		want     string
+	}{
+		{"abc", false, false, "abc"},
+		{"abc", false, true, "%abc%"},
+		{"a*c?", false, false, "a%c_"},
+		{"a*c?", true, false, "a*c?"},
+		{`50%_\`, false, false, `50\%\_\\`},
+		{`50%_\`, true, true, `%50\%\_\\%`},
+	}
+	for _, tt := range tests {
+		v := queryValue{text: tt.text, quoted: tt.quoted}
+		if got := likePattern(v, tt.contains); got != tt.want {
+			t.Errorf("likePattern(%q, quoted=%v, contains=%v) = %q, want %q", tt.text, tt.quoted, tt.contains, got, tt.want)
+		}
+	}
+}
+
+func TestQueryNumber(t *testing.T) {
+	tests := []struct {
+		v    queryValue
+		want float64
+		ok   bool
+	}{
+		{queryValue{text: "42"}, 42, true},
+		{queryValue{text: "-1.5e3"}, -1500, true},
+		{queryValue{text: "42", quoted: true}, 0, false},
+		{queryValue{text: "Inf"}, 0, false},
+		{queryValue{text: "NaN"}, 0, false},
+		{queryValue{text: "12abc"}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := queryNumber(tt.v)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("queryNumber(%+v) = %v, %v; want %v, %v", tt.v, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// dumpQuery writes an AST as an s-expression, with quoted values in quotes.
+func dumpQuery(n queryNode) string {
+	value := func(v queryValue) string {
+		if v.quoted {
+			return `"` + v.text + `"`
+		}
+		return v.text
+	}
+	list := func(name string, children []queryNode) string {
+		parts := []string{name}
+		for _, c := range children {
+			parts = append(parts, dumpQuery(c))
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+	switch n := n.(type) {
+	case nil:
+		return "<nil>"
+	case andNode:
+		return list("and", n.children)
+	case orNode:
+		return list("or", n.children)
+	case notNode:
+		return "(not " + dumpQuery(n.child) + ")"
+	case textNode:
+		return "(text " + value(n.value) + ")"
+	case compareNode:
+		return "(" + n.op + " " + n.field + " " + value(n.value) + ")"
+	case rangeNode:
+		bound := func(v *queryValue) string {
+			if v == nil {
+				return "*"
+			}
+			return value(*v)
+		}
+		open, close := "{", "}"
+		if n.lowIncl {
+			open = "["
+		}
+		if n.highIncl {
+			close = "]"
+		}
+		return "(range " + n.field + " " + open + bound(n.low) + " " + bound(n.high) + close + ")"
+	case inNode:
+		parts := []string{"in", n.field}
+		for _, v := range n.values {
+			parts = append(parts, value(v))
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	}
+	return "?"
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "<nil>"},
+		{"   ", "<nil>"},
+		{"timeout", "(text timeout)"},
+		{`"card declined"`, `(text "card declined")`},
+		{"event:checkout", "(: event checkout)"},
+		{"user_id=42", "(= user_id 42)"},
+		{"status!=ok", "(!= status ok)"},
+		{"amount>100 amount<=200", "(and (> amount 100) (<= amount 200))"},
+		{"a:1 AND b:2", "(and (: a 1) (: b 2))"},
+		{"a:1 or b:2 and c:3", "(or (: a 1) (and (: b 2) (: c 3)))"},
+		{"(a:1 OR b:2) c:3", "(and (or (: a 1) (: b 2)) (: c 3))"},
+		{"NOT a:1", "(not (: a 1))"},
+		{"not not a:1", "(not (not (: a 1)))"},
+		{"-x NOT y", "(and (text -x) (not (text y)))"},
+		{"name:chec*", "(: name chec*)"},
+		{`name:"chec*"`, `(: name "chec*")`},
+		{`msg:"say \"hi\""`, `(: msg "say "hi"")`},
+		{"user.id:7", "(: user.id 7)"},
+		{"n:[1 TO 5]", "(range n [1 5])"},
+		{"n:{1 TO 5]", "(range n {1 5])"},
+		{"n:[* to 5}", "(range n [* 5})"},
+		{"n:[1 TO *]", "(range n [1 *])"},
+		{"level IN (warn, error)", "(in level warn error)"},
+		{`level in ("a b")`, `(in level "a b")`},
+		{"höhe:groß", "(: höhe groß)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			n, err := parseQuery(tt.in)
+			if err != nil {
+				t.Fatalf("parseQuery(%q) error: %v", tt.in, err)
+			}
+			if got := dumpQuery(n); got != tt.want {
+				t.Errorf("parseQuery(%q) = %s, want %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		pos int
+	}{
+		{`"open`, 0},
+		{"a ! b", 2},
+		{"a:1 AND", 7},
+		{"AND a:1", 0},
+		{"a:1 OR OR b:2", 7},
+		{"(a:1", 4},
+		{"a:1)", 3},
+		{"a:", 2},
+		{"a>b*", 2},
+		{"n:[1 5]", 5},
+		{"n:[1 TO 5", 9},
+		{"n:[* TO *]", 2},
+		{"n:[1* TO 5]", 3},
+		{"level IN warn", 9},
+		{"level IN (a b)", 12},
+		{"a+b:1", 0},
+		{strings.Repeat("(", maxQueryDepth+1) + "a" + strings.Repeat(")", maxQueryDepth+1), maxQueryDepth},
+		{strings.Repeat("a", maxQueryLength+1), maxQueryLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			n, err := parseQuery(tt.in)
+			var qe *queryError
+			if !errors.As(err, &qe) {
+				t.Fatalf("parseQuery(%q) = %s, %v; want a queryError", tt.in, dumpQuery(n), err)
+			}
+			if qe.Pos != tt.pos {
+				t.Errorf("parseQuery(%q) error at %d (%s), want %d", tt.in, qe.Pos, qe.Msg, tt.pos)
+			}
+		})
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// limitsCacheTTL bounds how long a replica keeps using a project's limits
+// after they are changed in the database.
+const limitsCacheTTL = 30 * time.Second
+
+// usageSyncInterval is how often a replica adds the usage it has counted to
+// project_daily_usage and project_rate_buckets and reads back the state
+// every replica shares.
+const usageSyncInterval = time.Second
+
+// projectLimits is a row of project_limits. Zero means unlimited.
+type projectLimits struct {
+	LogsPerSecond  float64 `json:"logs_per_second"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	BurstLogs      float64 `json:"burst_logs"`
+	BurstBytes     float64 `json:"burst_bytes"`
+	DailyLogQuota  int64   `json:"daily_log_quota"`
+	DailyByteQuota int64   `json:"daily_byte_quota"`
+}
+
+// rateDecision is the outcome of reserving capacity for a request.
+// TooLarge means the request is bigger than a burst, so it can never be
+// allowed and retrying it is pointless.
+type rateDecision struct {
+	Allowed    bool
+	TooLarge   bool
+	Reason     string
+	RetryAfter time.Duration
+
+	limits        *projectLimits
+	usage         *projectUsage
+	day           string
+	logTokens     float64
+	dailyLogsUsed int64
+	resetAfter    time.Duration
+}
+
+// projectUsage is a replica's limiter state for one project. The token
+// buckets are shared through project_rate_buckets: logTokens and byteTokens
+// are the levels as of the last sync, refilled locally since and less what
+// this replica has taken since, which is also kept in spentLogs and
+// spentBytes until it is written. The day's usage is shared the same way
+// through project_daily_usage: dailyLogs and dailyBytes are the total as of
+// the last sync plus what this replica has counted since, which is also
+// kept in pendingLogs and pendingBytes.
+type projectUsage struct {
+	mu         sync.Mutex
+	limits     *projectLimits
+	logTokens  float64
+	byteTokens float64
+	refilled   time.Time
+	spentLogs  float64
+	spentBytes float64
+
+	day          string
+	dailyLogs    int64
+	dailyBytes   int64
+	pendingLogs  int64
+	pendingBytes int64
+	synced       time.Time
+	used         time.Time
+}
+
+type limitsCacheEntry struct {
+	limits *projectLimits
+	loaded time.Time
+}
+
+var limitsCache = struct {
+	sync.Mutex
+	entries map[string]limitsCacheEntry
+}{entries: make(map[string]limitsCacheEntry)}
+
+var usageState = struct {
+	sync.Mutex
+	projects map[string]*projectUsage
+}{projects: make(map[string]*projectUsage)}
+
+// limitsFor returns the limits of a project, or nil when it has none.
+func limitsFor(projectID string) (*projectLimits, error) {
+	limitsCache.Lock()
+	entry, ok := limitsCache.entries[projectID]
+	limitsCache.Unlock()
+	if ok && time.Since(entry.loaded) < limitsCacheTTL {
+		return entry.limits, nil
+	}
+
+	var l projectLimits
+	err := db.QueryRow(`
+		SELECT logs_per_second, bytes_per_second, burst_logs, burst_bytes, daily_log_quota, daily_byte_quota
+		FROM project_limits WHERE project_id = $1`, projectID,
+	).Scan(&l.LogsPerSecond, &l.BytesPerSecond, &l.BurstLogs, &l.BurstBytes, &l.DailyLogQuota, &l.DailyByteQuota)
+
+	var limits *projectLimits
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		// A burst defaults to one second's worth of the rate.
+		if l.BurstLogs <= 0 {
+			l.BurstLogs = math.Max(l.LogsPerSecond, 1)
+		}
+		if l.BurstBytes <= 0 {
+			l.BurstBytes = math.Max(l.BytesPerSecond, 1)
+		}
+		limits = &l
+	}
+
+	limitsCache.Lock()
+	limitsCache.entries[projectID] = limitsCacheEntry{limits: limits, loaded: time.Now()}
+	limitsCache.Unlock()
+	return limits, nil
+}
+
+// reserveQuota takes logs and bytes out of the project's token buckets and
+// daily quota, or reports why it cannot. It only reads CockroachDB when the
+// project has not been synced recently; see syncUsage.
+func reserveQuota(ctx context.Context, projectID string, logs int, bytes int64) (*rateDecision, error) {
+	limits, err := limitsFor(projectID)
+	if err != nil {
+		return nil, err
+	}
+	if limits == nil {
+		return &rateDecision{Allowed: true}, nil
+	}
+
+	now := time.Now()
+	u := usageFor(projectID)
+	u.mu.Lock()
+	u.limits = limits
+	u.mu.Unlock()
+	if err := u.load(ctx, projectID, now); err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.reserve(limits, float64(logs), bytes, now), nil
+}
+
+// reserve decides a request against the buckets and the day's usage, and
+// takes its capacity when it is allowed. Between syncs the buckets refill
+// at the full rate on every replica, and each replica may spend what the
+// shared bucket held at the last sync, so the limits can be overshot by
+// about a sync interval's worth of traffic on each replica.
+func (u *projectUsage) reserve(limits *projectLimits, logs float64, bytes int64, now time.Time) *rateDecision {
+	logRate, byteRate := limits.LogsPerSecond, limits.BytesPerSecond
+	if u.refilled.IsZero() {
+		u.logTokens, u.byteTokens = limits.BurstLogs, limits.BurstBytes
+	} else {
+		elapsed := math.Max(now.Sub(u.refilled).Seconds(), 0)
+		u.logTokens = math.Min(limits.BurstLogs, u.logTokens+elapsed*logRate)
+		u.byteTokens = math.Min(limits.BurstBytes, u.byteTokens+elapsed*byteRate)
+	}
+	u.refilled = now
+
+	d := &rateDecision{limits: limits, usage: u, day: u.day, logTokens: u.logTokens, dailyLogsUsed: u.dailyLogs}
+	untilMidnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+	deny := func(reason string, retryAfter time.Duration) *rateDecision {
+		d.Reason = reason
+		d.RetryAfter = retryAfter
+		return d
+	}
+
+	switch {
+	case limits.LogsPerSecond > 0 && logs > limits.BurstLogs:
+		d.TooLarge = true
+		return deny(fmt.Sprintf("request of %.0f logs exceeds the burst of %.0f", logs, limits.BurstLogs), 0)
+	case limits.BytesPerSecond > 0 && float64(bytes) > limits.BurstBytes:
+		d.TooLarge = true
+		return deny(fmt.Sprintf("request of %d bytes exceeds the burst of %.0f", bytes, limits.BurstBytes), 0)
+	case limits.DailyLogQuota > 0 && u.dailyLogs+int64(logs) > limits.DailyLogQuota:
+		return deny("daily log quota exceeded", untilMidnight)
+	case limits.DailyByteQuota > 0 && u.dailyBytes+bytes > limits.DailyByteQuota:
+		return deny("daily byte quota exceeded", untilMidnight)
+	case limits.LogsPerSecond > 0 && u.logTokens < logs:
+		return deny("log rate limit exceeded", secondsToRefill(logs-u.logTokens, logRate))
+	case limits.BytesPerSecond > 0 && u.byteTokens < float64(bytes):
+		return deny("byte rate limit exceeded", secondsToRefill(float64(bytes)-u.byteTokens, byteRate))
+	}
+
+	if limits.LogsPerSecond > 0 {
+		u.logTokens -= logs
+		u.spentLogs += logs
+	}
+	if limits.BytesPerSecond > 0 {
+		u.byteTokens -= float64(bytes)
+		u.spentBytes += float64(bytes)
+	}
+	u.dailyLogs += int64(logs)
+	u.dailyBytes += bytes
+	u.pendingLogs += int64(logs)
+	u.pendingBytes += bytes
+
+	d.Allowed = true
+	d.logTokens = u.logTokens
+	d.dailyLogsUsed = u.dailyLogs
+	if limits.LogsPerSecond > 0 {
+		d.resetAfter = secondsToRefill(limits.BurstLogs-u.logTokens, logRate)
+	}
+	return d
+}
+
+// refund gives back what an allowed request reserved for logs that were
+// not written after all.
+func (d *rateDecision) refund(logs int, bytes int64) {
+	if d == nil || d.usage == nil || logs == 0 {
+		return
+	}
+	u := d.usage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if d.limits.LogsPerSecond > 0 {
+		u.logTokens = math.Min(d.limits.BurstLogs, u.logTokens+float64(logs))
+		u.spentLogs -= float64(logs)
+	}
+	if d.limits.BytesPerSecond > 0 {
+		u.byteTokens = math.Min(d.limits.BurstBytes, u.byteTokens+float64(bytes))
+		u.spentBytes -= float64(bytes)
+	}
+	if u.day == d.day {
+		u.dailyLogs -= int64(logs)
+		u.dailyBytes -= bytes
+		u.pendingLogs -= int64(logs)
+		u.pendingBytes -= bytes
+	}
+}
+
+// refundUnwritten refunds the messages a Kafka write did not deliver: all
+// of them, or the ones with an error when the write failed in part.
+func refundUnwritten(d *rateDecision, messages []kafka.Message, err error) {
+	if err == nil {
+		return
+	}
+	failed := messages
+	var writeErrs kafka.WriteErrors
+	if errors.As(err, &writeErrs) {
+		failed = nil
+		for i, e := range writeErrs {
+			if e != nil && i < len(messages) {
+				failed = append(failed, messages[i])
+			}
+		}
+	}
+	d.refund(len(failed), messagesSize(failed))
+}
+
+func usageFor(projectID string) *projectUsage {
+	usageState.Lock()
+	defer usageState.Unlock()
+	u, ok := usageState.projects[projectID]
+	if !ok {
+		u = &projectUsage{}
+		usageState.projects[projectID] = u
+	}
+	return u
+}
+
+// load makes sure the buckets and the day's usage are recent before a
+// request is decided.
+// On a new day it first writes what is still pending for the day before.
+func (u *projectUsage) load(ctx context.Context, projectID string, now time.Time) error {
+	day := now.UTC().Format("2006-01-02")
+	u.mu.Lock()
+	u.used = now
+	fresh := u.day == day && now.Sub(u.synced) < 2*usageSyncInterval
+	previous := u.day != "" && u.day != day && (u.pendingLogs != 0 || u.pendingBytes != 0)
+	u.mu.Unlock()
+	if fresh {
+		return nil
+	}
+	if previous {
+		if err := u.sync(ctx, projectID); err != nil {
+			return err
+		}
+	}
+
+	u.mu.Lock()
+	if u.day != day {
+		u.day = day
+		u.dailyLogs, u.dailyBytes = 0, 0
+		u.pendingLogs, u.pendingBytes = 0, 0
+		u.synced = time.Time{}
+	}
+	u.mu.Unlock()
+	return u.sync(ctx, projectID)
+}
+
+// sync writes what this replica has taken from the buckets and the day's
+// quota since the last sync, and reads back the state shared by every
+// replica.
+func (u *projectUsage) sync(ctx context.Context, projectID string) error {
+	if err := u.syncBuckets(ctx, projectID); err != nil {
+		return err
+	}
+	return u.syncDaily(ctx, projectID)
+}
+
+// syncBuckets refills the project's shared buckets in project_rate_buckets
+// for the time since they were last written, takes out what this replica
+// has spent since its last sync and reads back the levels. A project
+// without a rate limit has no bucket row.
+func (u *projectUsage) syncBuckets(ctx context.Context, projectID string) error {
+	u.mu.Lock()
+	limits, logs, bytes := u.limits, u.spentLogs, u.spentBytes
+	u.spentLogs, u.spentBytes = 0, 0
+	u.mu.Unlock()
+	if limits == nil || (limits.LogsPerSecond <= 0 && limits.BytesPerSecond <= 0) {
+		return nil
+	}
+
+	// A new bucket starts full. The refill uses the database's clock, so
+	// replicas with skewed clocks agree on it.
+	var logTokens, byteTokens float64
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO project_rate_buckets (project_id, log_tokens, byte_tokens, updated_at)
+		VALUES ($1, $2::FLOAT8 - $4::FLOAT8, $3::FLOAT8 - $5::FLOAT8, now())
+		ON CONFLICT (project_id) DO UPDATE SET
+			log_tokens = least($2::FLOAT8, project_rate_buckets.log_tokens + extract(epoch FROM now() - project_rate_buckets.updated_at) * $6::FLOAT8 - $4::FLOAT8),
+			byte_tokens = least($3::FLOAT8, project_rate_buckets.byte_tokens + extract(epoch FROM now() - project_rate_buckets.updated_at) * $7::FLOAT8 - $5::FLOAT8),
+			updated_at = now()
+		RETURNING log_tokens, byte_tokens`,
+		projectID, limits.BurstLogs, limits.BurstBytes, logs, bytes, limits.LogsPerSecond, limits.BytesPerSecond,
+	).Scan(&logTokens, &byteTokens)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err != nil {
+		u.spentLogs += logs
+		u.spentBytes += bytes
+		return err
+	}
+	u.setBuckets(logTokens, byteTokens, time.Now())
+	return nil
+}
+
+// setBuckets takes the shared levels read back by a sync, less what was
+// spent here while the sync ran. It must be called with mu held.
+func (u *projectUsage) setBuckets(logTokens, byteTokens float64, now time.Time) {
+	u.logTokens = logTokens - u.spentLogs
+	u.byteTokens = byteTokens - u.spentBytes
+	u.refilled = now
+}
+
+// syncDaily adds the pending usage to project_daily_usage and reads back
+// the day's total across replicas. Nothing is written when nothing is
+// pending.
+func (u *projectUsage) syncDaily(ctx context.Context, projectID string) error {
+	u.mu.Lock()
+	day, logs, bytes := u.day, u.pendingLogs, u.pendingBytes
+	u.pendingLogs, u.pendingBytes = 0, 0
+	u.mu.Unlock()
+	if day == "" {
+		return nil
+	}
+
+	var totalLogs, totalBytes int64
+	var err error
+	if logs == 0 && bytes == 0 {
+		err = db.QueryRowContext(ctx,
+			`SELECT logs, bytes FROM project_daily_usage WHERE project_id = $1 AND day = $2`,
+			projectID, day,
+		).Scan(&totalLogs, &totalBytes)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+	} else {
+		err = db.QueryRowContext(ctx, `
+			INSERT INTO project_daily_usage (project_id, day, logs, bytes) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (project_id, day) DO UPDATE SET logs = project_daily_usage.logs + excluded.logs, bytes = project_daily_usage.bytes + excluded.bytes
+			RETURNING logs, bytes`,
+			projectID, day, logs, bytes,
+		).Scan(&totalLogs, &totalBytes)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.day != day {
+		if err != nil {
+			log.Printf("sync: dropping %d logs of usage for project %s on %s: %v", logs, projectID, day, err)
+		}
+		return nil
+	}
+	if err != nil {
+		u.pendingLogs += logs
+		u.pendingBytes += bytes
+		return err
+	}
+	u.dailyLogs, u.dailyBytes = totalLogs+u.pendingLogs, totalBytes+u.pendingBytes
+	u.synced = time.Now()
+	return nil
+}
+
+// runUsageSync calls syncUsage every usageSyncInterval until ctx is done.
+func runUsageSync(ctx context.Context) {
+	ticker := time.NewTicker(usageSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			syncUsage(ctx)
+		}
+	}
+}
+
+// syncUsage syncs every project with usage pending or a recent request, so
+// each replica's checks see the others' usage within about
+// usageSyncInterval.
+func syncUsage(ctx context.Context) {
+	usageState.Lock()
+	projects := make(map[string]*projectUsage, len(usageState.projects))
+	for id, u := range usageState.projects {
+		projects[id] = u
+	}
+	usageState.Unlock()
+
+	for id, u := range projects {
+		u.mu.Lock()
+		idle := u.pendingLogs == 0 && u.pendingBytes == 0 && u.spentLogs == 0 && u.spentBytes == 0 && time.Since(u.used) > limitsCacheTTL
+		u.mu.Unlock()
+		if idle {
+			continue
+		}
+		if err := u.sync(ctx, id); err != nil {
+			log.Printf("syncUsage: error syncing usage of project %s: %v", id, err)
+		}
+	}
+}
+
+func secondsToRefill(missing, rate float64) time.Duration {
+	return time.Duration(math.Ceil(missing/rate)) * time.Second
+}
+
+// writeRateLimitHeaders reports the project's log rate and daily quota.
+func writeRateLimitHeaders(w http.ResponseWriter, d *rateDecision) {
+	if d == nil || d.limits == nil {
+		return
+	}
+	h := w.Header()
+	if d.limits.LogsPerSecond > 0 {
+		h.Set("X-RateLimit-Limit", strconv.FormatFloat(d.limits.BurstLogs, 'f', 0, 64))
+		h.Set("X-RateLimit-Remaining", strconv.FormatFloat(math.Max(math.Floor(d.logTokens), 0), 'f', 0, 64))
+		h.Set("X-RateLimit-Reset", strconv.Itoa(int(d.resetAfter.Seconds())))
+	}
+	if d.limits.DailyLogQuota > 0 {
+		h.Set("X-RateLimit-Daily-Limit", strconv.FormatInt(d.limits.DailyLogQuota, 10))
+		remaining := d.limits.DailyLogQuota - d.dailyLogsUsed
+		if remaining < 0 {
+			remaining = 0
+		}
+		h.Set("X-RateLimit-Daily-Remaining", strconv.FormatInt(remaining, 10))
+	}
+}
+
+// checkRateLimit reserves capacity for a request and writes the rate limit
+// headers. When the request is over a limit it writes a 429 and returns false.
+// A request bigger than a burst gets a 413 without Retry-After, since it
+// would never fit; the client has to split it. Capacity for logs that are
+// then not written to Kafka is given back with refundUnwritten.
+func checkRateLimit(w http.ResponseWriter, r *http.Request, projectID string, logs int, bytes int64) (*rateDecision, bool) {
+	d, err := reserveQuota(r.Context(), projectID, logs, bytes)
+	if err != nil {
+		log.Printf("checkRateLimit: error reserving quota for project %s: %v", projectID, err)
+		http.Error(w, "Failed to check rate limit", http.StatusInternalServerError)
+		return nil, false
+	}
+	writeRateLimitHeaders(w, d)
+	if d.Allowed {
+		return d, true
+	}
+	if d.TooLarge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": d.Reason})
+		return nil, false
+	}
+
+	retryAfter := int(math.Ceil(d.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       d.Reason,
+		"retry_after": retryAfter,
+	})
+	return nil, false
+}
+
+// messagesSize is what a request counts against the byte limits.
+func messagesSize(messages []kafka.Message) int64 {
+	var n int64
+	for _, m := range messages {
+		n += int64(len(m.Value))
+	}
+	return n
+}
+
+// apiProjectLimitsHandler returns a project's limits and today's usage.
+func apiProjectLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := authenticateProject(w, r)
+	if !ok {
+		return
+	}
+	limits, err := limitsFor(projectID)
+	if err != nil {
+		log.Printf("apiProjectLimitsHandler: error loading limits: %v", err)
+		http.Error(w, "Could not load limits", http.StatusInternalServerError)
+		return
+	}
+
+	var dailyLogs, dailyBytes int64
+	err = db.QueryRow(
+		`SELECT logs, bytes FROM project_daily_usage WHERE project_id = $1 AND day = $2`,
+		projectID, time.Now().UTC().Format("2006-01-02"),
+	).Scan(&dailyLogs, &dailyBytes)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("apiProjectLimitsHandler: error loading usage: %v", err)
+		http.Error(w, "Could not load usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"limits": limits,
+		"usage_today": map[string]int64{
+			"logs":  dailyLogs,
+			"bytes": dailyBytes,
+		},
+	})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestReserve(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	rate := &projectLimits{LogsPerSecond: 10, BurstLogs: 20, BytesPerSecond: 1000, BurstBytes: 2000}
+	quota := &projectLimits{DailyLogQuota: 100, DailyByteQuota: 5000}
+
+	type request struct {
+		at    time.Duration
+		logs  float64
+		bytes int64
+	}
+	tests := []struct {
+		name       string
+		limits     *projectLimits
+		used       int64 // logs already used today
+		before     []request
+		req        request
+		allowed    bool
+		tooLarge   bool
+		retryAfter time.Duration
+		tokensLeft float64
+	}{
+		{name: "a fresh bucket holds the burst", limits: rate, req: request{logs: 20}, allowed: true, tokensLeft: 0},
+		{name: "over the burst is too large", limits: rate, req: request{logs: 21}, tooLarge: true, tokensLeft: 20},
+		{name: "bytes over the burst are too large", limits: rate, req: request{logs: 1, bytes: 2001}, tooLarge: true, tokensLeft: 20},
+		{
+			name: "empty bucket waits for the refill", limits: rate,
+			before: []request{{logs: 20}}, req: request{logs: 5},
+			retryAfter: time.Second, tokensLeft: 0,
+		},
+		{
+			name: "refills at the rate", limits: rate,
+			before: []request{{logs: 20}}, req: request{at: time.Second, logs: 10},
+			allowed: true, tokensLeft: 0,
+		},
+		{
+			name: "refill stops at the burst", limits: rate,
+			before: []request{{logs: 5}}, req: request{at: time.Hour, logs: 1},
+			allowed: true, tokensLeft: 19,
+		},
+		{
+			name: "retry after rounds up to whole seconds", limits: rate,
+			before: []request{{logs: 20}}, req: request{at: 500 * time.Millisecond, logs: 20},
+			retryAfter: 2 * time.Second, tokensLeft: 5,
+		},
+		{name: "within the daily quota", limits: quota, used: 99, req: request{logs: 1}, allowed: true},
+		{name: "over the daily log quota", limits: quota, used: 99, req: request{logs: 2}, retryAfter: 12 * time.Hour},
+		{name: "over the daily byte quota", limits: quota, req: request{logs: 1, bytes: 5001}, retryAfter: 12 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &projectUsage{day: "2024-01-01", dailyLogs: tt.used}
+			for _, b := range tt.before {
+				if d := u.reserve(tt.limits, b.logs, b.bytes, start.Add(b.at)); !d.Allowed {
+					t.Fatalf("setup request of %v logs denied: %s", b.logs, d.Reason)
+				}
+			}
+			d := u.reserve(tt.limits, tt.req.logs, tt.req.bytes, start.Add(tt.req.at))
+			if d.Allowed != tt.allowed || d.TooLarge != tt.tooLarge {
+				t.Fatalf("allowed=%v tooLarge=%v (%s), want allowed=%v tooLarge=%v", d.Allowed, d.TooLarge, d.Reason, tt.allowed, tt.tooLarge)
+			}
+			if d.RetryAfter != tt.retryAfter {
+				t.Errorf("RetryAfter = %v, want %v", d.RetryAfter, tt.retryAfter)
+			}
+			if tt.limits.LogsPerSecond > 0 && u.logTokens != tt.tokensLeft {
+				t.Errorf("log tokens = %v, want %v", u.logTokens, tt.tokensLeft)
+			}
+		})
+	}
+}
+
+func TestReserveCountsUsage(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	u := &projectUsage{day: "2024-01-01", dailyLogs: 10, dailyBytes: 100}
+	limits := &projectLimits{DailyLogQuota: 1000}
+
+	if d := u.reserve(limits, 5, 50, now); !d.Allowed || d.dailyLogsUsed != 15 {
+		t.Fatalf("reserve: allowed=%v dailyLogsUsed=%d, want true and 15", d.Allowed, d.dailyLogsUsed)
+	}
+	if u.dailyLogs != 15 || u.dailyBytes != 150 || u.pendingLogs != 5 || u.pendingBytes != 50 {
+		t.Errorf("usage = %d logs, %d bytes, pending %d, %d; want 15, 150, pending 5, 50", u.dailyLogs, u.dailyBytes, u.pendingLogs, u.pendingBytes)
+	}
+	if d := u.reserve(limits, 1000, 0, now); d.Allowed {
+		t.Fatal("reserve over the quota was allowed")
+	}
+	if u.pendingLogs != 5 {
+		t.Errorf("a denied request changed pending usage to %d", u.pendingLogs)
+	}
+}
+
+func TestReserveCountsSpentTokens(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limits := &projectLimits{LogsPerSecond: 10, BurstLogs: 20, BytesPerSecond: 100, BurstBytes: 200}
+	u := &projectUsage{day: "2024-01-01"}
+
+	u.reserve(limits, 5, 50, now)
+	u.reserve(limits, 3, 30, now)
+	if u.spentLogs != 8 || u.spentBytes != 80 {
+		t.Errorf("spent = %v logs, %v bytes; want 8, 80", u.spentLogs, u.spentBytes)
+	}
+	if d := u.reserve(limits, 100, 0, now); d.Allowed || u.spentLogs != 8 {
+		t.Errorf("a denied request changed spent logs to %v", u.spentLogs)
+	}
+	// Unlimited buckets are not synced, so nothing is counted for them.
+	u = &projectUsage{day: "2024-01-01"}
+	u.reserve(&projectLimits{DailyLogQuota: 100}, 5, 50, now)
+	if u.spentLogs != 0 || u.spentBytes != 0 {
+		t.Errorf("spent = %v logs, %v bytes without a rate limit; want 0, 0", u.spentLogs, u.spentBytes)
+	}
+}
+
+func TestSetBuckets(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limits := &projectLimits{LogsPerSecond: 10, BurstLogs: 20}
+
+	tests := []struct {
+		name       string
+		shared     float64 // level read back from project_rate_buckets
+		spent      float64 // taken here while the sync ran
+		later      time.Duration
+		logs       float64
+		allowed    bool
+		tokensLeft float64
+	}{
+		{name: "takes the shared level", shared: 12, logs: 12, allowed: true, tokensLeft: 0},
+		{name: "other replicas' spending is seen", shared: 3, logs: 4, tokensLeft: 3},
+		{name: "spending during the sync is kept", shared: 10, spent: 4, logs: 7, tokensLeft: 6},
+		{name: "refills from the shared level", shared: 0, later: 500 * time.Millisecond, logs: 5, allowed: true, tokensLeft: 0},
+		{name: "a shared debt has to be refilled first", shared: -10, later: time.Second, logs: 1, tokensLeft: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &projectUsage{day: "2024-01-01", spentLogs: tt.spent}
+			u.setBuckets(tt.shared, 0, now)
+			d := u.reserve(limits, tt.logs, 0, now.Add(tt.later))
+			if d.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v (%s), want %v", d.Allowed, d.Reason, tt.allowed)
+			}
+			if u.logTokens != tt.tokensLeft {
+				t.Errorf("log tokens = %v, want %v", u.logTokens, tt.tokensLeft)
+			}
+		})
+	}
+}
+
+func TestRefund(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limits := &projectLimits{LogsPerSecond: 10, BurstLogs: 20, BytesPerSecond: 100, BurstBytes: 200, DailyLogQuota: 1000}
+
+	t.Run("gives back tokens and usage", func(t *testing.T) {
+		u := &projectUsage{day: "2024-01-01"}
+		d := u.reserve(limits, 8, 80, now)
+		d.refund(3, 30)
+		if u.logTokens != 15 || u.byteTokens != 150 {
+			t.Errorf("tokens = %v logs, %v bytes; want 15, 150", u.logTokens, u.byteTokens)
+		}
+		if u.dailyLogs != 5 || u.pendingLogs != 5 || u.pendingBytes != 50 {
+			t.Errorf("usage = %d, pending %d logs %d bytes; want 5, 5, 50", u.dailyLogs, u.pendingLogs, u.pendingBytes)
+		}
+		if u.spentLogs != 5 || u.spentBytes != 50 {
+			t.Errorf("spent = %v logs, %v bytes; want 5, 50", u.spentLogs, u.spentBytes)
+		}
+	})
+	t.Run("never fills past the burst", func(t *testing.T) {
+		u := &projectUsage{day: "2024-01-01"}
+		d := u.reserve(limits, 1, 10, now)
+		d.refund(5, 50)
+		if u.logTokens != 20 || u.byteTokens != 200 {
+			t.Errorf("tokens = %v logs, %v bytes; want 20, 200", u.logTokens, u.byteTokens)
+		}
+	})
+	t.Run("leaves a new day's usage alone", func(t *testing.T) {
+		u := &projectUsage{day: "2024-01-01"}
+		d := u.reserve(limits, 4, 40, now)
+		u.day, u.dailyLogs, u.pendingLogs = "2024-01-02", 0, 0
+		d.refund(4, 40)
+		if u.dailyLogs != 0 || u.pendingLogs != 0 {
+			t.Errorf("refund changed the next day's usage to %d, pending %d", u.dailyLogs, u.pendingLogs)
+		}
+	})
+	t.Run("nil and unlimited decisions", func(t *testing.T) {
+		var d *rateDecision
+		d.refund(1, 1)
+		(&rateDecision{Allowed: true}).refund(1, 1)
+	})
+}
+
+func TestRefundUnwritten(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limits := &projectLimits{DailyLogQuota: 1000}
+	messages := []kafka.Message{{Value: []byte("aa")}, {Value: []byte("bbb")}, {Value: []byte("c")}}
+
+	tests := []struct {
+		name      string
+		err       error
+		wantLogs  int64
+		wantBytes int64
+	}{
+		{name: "written", err: nil, wantLogs: 3, wantBytes: 6},
+		{name: "failed", err: errors.New("broker down"), wantLogs: 0, wantBytes: 0},
+		{name: "failed in part", err: kafka.WriteErrors{nil, errors.New("x"), nil}, wantLogs: 2, wantBytes: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &projectUsage{day: "2024-01-01"}
+			d := u.reserve(limits, float64(len(messages)), messagesSize(messages), now)
+			refundUnwritten(d, messages, tt.err)
+			if u.dailyLogs != tt.wantLogs || u.dailyBytes != tt.wantBytes {
+				t.Errorf("usage = %d logs, %d bytes; want %d, %d", u.dailyLogs, u.dailyBytes, tt.wantLogs, tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestSecondsToRefill(t *testing.T) {
+	tests := []struct {
+		missing, rate float64
+		want          time.Duration
+	}{
+		{10, 10, time.Second},
+		{1, 10, time.Second},
+		{11, 10, 2 * time.Second},
+		{0.5, 0.25, 2 * time.Second},
+		{0, 10, 0},
+	}
+	for _, tt := range tests {
+		if got := secondsToRefill(tt.missing, tt.rate); got != tt.want {
+			t.Errorf("secondsToRefill(%v, %v) = %v, want %v", tt.missing, tt.rate, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Schema modes. Strict rejects non-conforming logs, warn accepts them and
+// logs the mismatch, off skips validation.
+const (
+	schemaModeStrict = "strict"
+	schemaModeWarn   = "warn"
+	schemaModeOff    = "off"
+)
+
+// schemaCacheTTL bounds how long a replica keeps using a schema after another
+// replica registers a newer version.
+const schemaCacheTTL = 30 * time.Second
+
+// registeredSchema is the active (latest) schema version of one event name.
+type registeredSchema struct {
+	Version int
+	Mode    string
+	Schema  *eventSchema
+}
+
+// schemaVersion is how a stored schema version is returned by the API.
+type schemaVersion struct {
+	EventName string          `json:"event_name"`
+	Version   int             `json:"version"`
+	Mode      string          `json:"mode"`
+	Schema    json.RawMessage `json:"schema"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// schemaViolation is returned when a log fails a strict schema.
+type schemaViolation struct {
+	EventName   string       `json:"event_name"`
+	Version     int          `json:"schema_version"`
+	FieldErrors []fieldError `json:"field_errors"`
+}
+
+type schemaCacheEntry struct {
+	schema *registeredSchema
+	loaded time.Time
+}
+
+var schemaCache = struct {
+	sync.Mutex
+	entries map[string]schemaCacheEntry
+}{entries: make(map[string]schemaCacheEntry)}
+
+// activeSchema returns the latest schema registered for an event, or nil when
+// the event has none. Lookups are cached for schemaCacheTTL.
+func activeSchema(projectID, eventName string) (*registeredSchema, error) {
+	key := projectID + "/" + eventName
+	schemaCache.Lock()
+	entry, ok := schemaCache.entries[key]
+	schemaCache.Unlock()
+	if ok && time.Since(entry.loaded) < schemaCacheTTL {
+		return entry.schema, nil
+	}
+
+	var version int
+	var mode string
+	var raw []byte
+	err := db.QueryRow(
+		`SELECT version, mode, schema FROM event_schemas WHERE project_id = $1 AND event_name = $2 ORDER BY version DESC LIMIT 1`,
+		projectID, eventName,
+	).Scan(&version, &mode, &raw)
+
+	var active *registeredSchema
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	default:
+		parsed, err := parseEventSchema(raw)
+		if err != nil {
+			return nil, fmt.Errorf("stored schema %s v%d: %w", key, version, err)
+		}
+		active = &registeredSchema{Version: version, Mode: mode, Schema: parsed}
+	}
+
+	schemaCache.Lock()
+	schemaCache.entries[key] = schemaCacheEntry{schema: active, loaded: time.Now()}
+	schemaCache.Unlock()
+	return active, nil
+}
+
+func invalidateSchema(projectID, eventName string) {
+	schemaCache.Lock()
+	delete(schemaCache.entries, projectID+"/"+eventName)
+	schemaCache.Unlock()
+}
+
+// checkEventSchema validates the payload of a log against the schema of its
+// event. It returns a violation only when a strict schema fails.
+func checkEventSchema(projectID string, incomingLog map[string]interface{}) (*schemaViolation, error) {
+	eventName, _ := incomingLog["event_name"].(string)
+	active, err := activeSchema(projectID, eventName)
+	if err != nil {
+		return nil, err
+	}
+	if active == nil || active.Mode == schemaModeOff {
+		return nil, nil
+	}
+
+	payload, _ := incomingLog["payload"].(map[string]interface{})
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	errs := active.Schema.validate("payload", payload)
+	if len(errs) == 0 {
+		return nil, nil
+	}
+	if active.Mode == schemaModeWarn {
+		log.Printf("checkEventSchema: project %s event %q does not match schema v%d: %v", projectID, eventName, active.Version, errs)
+		return nil, nil
+	}
+	return &schemaViolation{EventName: eventName, Version: active.Version, FieldErrors: errs}, nil
+}
+
+func writeSchemaViolation(w http.ResponseWriter, v *schemaViolation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		*schemaViolation
+	}{Error: "payload does not match schema", schemaViolation: v})
+}
+
+// Schema management handlers
+
+func apiListSchemasHandler(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := authenticateProject(w, r)
+	if !ok {
+		return
+	}
+	rows, err := db.Query(`
+		SELECT DISTINCT ON (event_name) event_name, version, mode, schema, created_at
+		FROM event_schemas
+		WHERE project_id = $1
+		ORDER BY event_name, version DESC`, projectID)
+	if err != nil {
+		log.Printf("apiListSchemasHandler: error querying schemas: %v", err)
+		http.Error(w, "Could not load schemas", http.StatusInternalServerError)
+		return
+	}
+	writeSchemaRows(w, rows)
+}
+
+func apiSchemaVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := authenticateProject(w, r)
+	if !ok {
+		return
+	}
+	eventName := mux.Vars(r)["eventName"]
+	rows, err := db.Query(`
+		SELECT event_name, version, mode, schema, created_at
+		FROM event_schemas
+		WHERE project_id = $1 AND event_name = $2
+		ORDER BY version DESC`, projectID, eventName)
+	if err != nil {
+		log.Printf("apiSchemaVersionsHandler: error querying schemas: %v", err)
+		http.Error(w, "Could not load schemas", http.StatusInternalServerError)
+		return
+	}
+	writeSchemaRows(w, rows)
+}
+
+func writeSchemaRows(w http.ResponseWriter, rows *sql.Rows) {
+	defer rows.Close()
+	versions := []schemaVersion{}
+	for rows.Next() {
+		var v schemaVersion
+		var raw []byte
+		if err := rows.Scan(&v.EventName, &v.Version, &v.Mode, &raw, &v.CreatedAt); err != nil {
+			log.Printf("writeSchemaRows: error scanning schema row: %v", err)
+			continue
+		}
+		v.Schema = raw
+		versions = append(versions, v)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error reading rows", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// apiRegisterSchemaHandler stores a new version of an event's schema. Older
+// versions are kept; the newest one is enforced.
+func apiRegisterSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := authenticateProject(w, r)
+	if !ok {
+		return
+	}
+	eventName := mux.Vars(r)["eventName"]
+
+	var req struct {
+		Mode   string          `json:"mode"`
+		Schema json.RawMessage `json:"schema"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = schemaModeStrict
+	}
+	if req.Mode != schemaModeStrict && req.Mode != schemaModeWarn && req.Mode != schemaModeOff {
+		http.Error(w, "mode must be strict, warn or off", http.StatusBadRequest)
+		return
+	}
+	if len(req.Schema) == 0 {
+		http.Error(w, "schema is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := parseEventSchema(req.Schema); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	v := schemaVersion{EventName: eventName, Mode: req.Mode, Schema: req.Schema}
+	err := db.QueryRow(`
+		INSERT INTO event_schemas (project_id, event_name, version, mode, schema)
+		SELECT $1::UUID, $2::STRING, COALESCE(MAX(version), 0) + 1, $3::STRING, $4::JSONB
+		FROM event_schemas
+		WHERE project_id = $1::UUID AND event_name = $2::STRING
+		RETURNING version, created_at`,
+		projectID, eventName, req.Mode, string(req.Schema),
+	).Scan(&v.Version, &v.CreatedAt)
+	if err != nil {
+		// A concurrent registration took the same version number.
+		log.Printf("apiRegisterSchemaHandler: error inserting schema for %q: %v", eventName, err)
+		http.Error(w, "Could not register schema, retry the request", http.StatusConflict)
+		return
+	}
+	invalidateSchema(projectID, eventName)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEventSchema(t *testing.T) {
+	tests := []struct {
+		schema string
+		err    string
+	}{
+		{`{"type": "object", "properties": {"id": {"type": "integer"}}}`, ""},
+		{`{"type": ["string", "null"]}`, ""},
+		{`{"type": "object", "properties": {"tags": {"type": "array", "items": {"type": "string"}}}}`, ""},
+		{`{"type": "date"}`, `payload: unknown type "date"`},
+		{`{"type": 3}`, "type must be a string or an array of strings"},
+		{`{"properties": {"user": {"properties": {"id": {"type": "uuid"}}}}}`, `payload.user.id: unknown type "uuid"`},
+		{`{"properties": {"id": null}}`, "payload.id: schema must be an object"},
+		{`{"items": {"type": "set"}}`, `payload[]: unknown type "set"`},
+		{`{"minLength": -1}`, "payload: minLength must not be negative"},
+		{`{"maxLength": -1}`, "payload: maxLength must not be negative"},
+		{`[]`, "invalid schema"},
+	}
+	for _, tt := range tests {
+		_, err := parseEventSchema(json.RawMessage(tt.schema))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("parseEventSchema(%s) = %v", tt.schema, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseEventSchema(%s) = %v, want an error containing %q", tt.schema, err, tt.err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		payload string
+		want    []fieldError
+	}{
+		{
+			name:    "type",
+			schema:  `{"properties": {"id": {"type": "string"}}}`,
+			payload: `{"id": 42}`,
+			want:    []fieldError{{"payload.id", "must be of type string"}},
+		},
+		{
+			name:    "type union",
+			schema:  `{"properties": {"a": {"type": ["string", "null"]}, "b": {"type": ["string", "null"]}}}`,
+			payload: `{"a": null, "b": "x"}`,
+		},
+		{
+			name:    "integer",
+			schema:  `{"properties": {"a": {"type": "integer"}, "b": {"type": "integer"}, "c": {"type": "integer"}}}`,
+			payload: `{"a": 3, "b": 3.0, "c": 3.5}`,
+			want:    []fieldError{{"payload.c", "must be of type integer"}},
+		},
+		{
+			name:    "a wrong type skips the other checks",
+			schema:  `{"properties": {"a": {"type": "string", "enum": ["x"], "minLength": 5}}}`,
+			payload: `{"a": true}`,
+			want:    []fieldError{{"payload.a", "must be of type string"}},
+		},
+		{
+			name:    "required",
+			schema:  `{"type": "object", "required": ["id", "name"]}`,
+			payload: `{"name": "x"}`,
+			want:    []fieldError{{"payload.id", "is required"}},
+		},
+		{
+			name:    "required null is present",
+			schema:  `{"required": ["id"]}`,
+			payload: `{"id": null}`,
+		},
+		{
+			name:    "enum",
+			schema:  `{"properties": {"level": {"enum": ["info", "error"]}, "code": {"enum": [1, 2]}, "other": {"enum": [1, 2]}}}`,
+			payload: `{"level": "debug", "code": 1.0, "other": "1"}`,
+			want: []fieldError{
+				{"payload.level", "must be one of the allowed values"},
+				{"payload.other", "must be one of the allowed values"},
+			},
+		},
+		{
+			name: "nested properties",
+			schema: `{"properties": {"user": {"type": "object", "required": ["id"],
+				"properties": {"id": {"type": "integer"}, "address": {"properties": {"zip": {"type": "string"}}}}}}}`,
+			payload: `{"user": {"address": {"zip": 1234}}}`,
+			want: []fieldError{
+				{"payload.user.id", "is required"},
+				{"payload.user.address.zip", "must be of type string"},
+			},
+		},
+		{
+			name:    "additionalProperties false",
+			schema:  `{"properties": {"id": {}}, "additionalProperties": false}`,
+			payload: `{"id": 1, "zeta": 1, "extra": 2}`,
+			want: []fieldError{
+				{"payload.extra", "is not allowed"},
+				{"payload.zeta", "is not allowed"},
+			},
+		},
+		{
+			name:    "additionalProperties by default",
+			schema:  `{"properties": {"id": {}}}`,
+			payload: `{"id": 1, "extra": 2}`,
+		},
+		{
+			name:    "nested additionalProperties",
+			schema:  `{"properties": {"user": {"properties": {"id": {}}, "additionalProperties": false}}}`,
+			payload: `{"user": {"id": 1, "email": "x"}, "extra": 2}`,
+			want:    []fieldError{{"payload.user.email", "is not allowed"}},
+		},
+		{
+			name:    "array items",
+			schema:  `{"properties": {"tags": {"type": "array", "items": {"type": "string"}}}}`,
+			payload: `{"tags": ["a", 2, "c", null]}`,
+			want: []fieldError{
+				{"payload.tags[1]", "must be of type string"},
+				{"payload.tags[3]", "must be of type string"},
+			},
+		},
+		{
+			name:    "string length counts characters",
+			schema:  `{"properties": {"a": {"minLength": 2}, "b": {"maxLength": 3}, "c": {"maxLength": 5}}}`,
+			payload: `{"a": "x", "b": "abcd", "c": "größe"}`,
+			want: []fieldError{
+				{"payload.a", "must be at least 2 characters"},
+				{"payload.b", "must be at most 3 characters"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseEventSchema(json.RawMessage(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var payload interface{}
+			if err := unmarshalUseNumber([]byte(tt.payload), &payload); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.validate("payload", payload); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validate(%s) = %v, want %v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+// cacheSchema makes activeSchema return schema for an event without a
+// database lookup.
+func cacheSchema(t *testing.T, projectID, eventName, mode, schema string) {
+	t.Helper()
+	var active *registeredSchema
+	if schema != "" {
+		parsed, err := parseEventSchema(json.RawMessage(schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+		active = &registeredSchema{Version: 2, Mode: mode, Schema: parsed}
+	}
+	schemaCache.Lock()
+	schemaCache.entries[projectID+"/"+eventName] = schemaCacheEntry{schema: active, loaded: time.Now()}
+	schemaCache.Unlock()
+	t.Cleanup(func() { invalidateSchema(projectID, eventName) })
+}
+
+func TestCheckEventSchema(t *testing.T) {
+	const schema = `{"type": "object", "required": ["id"], "properties": {"id": {"type": "integer"}}}`
+	cacheSchema(t, "p1", "strict", schemaModeStrict, schema)
+	cacheSchema(t, "p1", "warn", schemaModeWarn, schema)
+	cacheSchema(t, "p1", "off", schemaModeOff, schema)
+	cacheSchema(t, "p1", "none", "", "")
+
+	tests := []struct {
+		event   string
+		payload string
+		want    *schemaViolation
+	}{
+		{"strict", `{"id": 1}`, nil},
+		{"strict", `{"id": "x"}`, &schemaViolation{EventName: "strict", Version: 2, FieldErrors: []fieldError{{"payload.id", "must be of type integer"}}}},
+		{"strict", ``, &schemaViolation{EventName: "strict", Version: 2, FieldErrors: []fieldError{{"payload.id", "is required"}}}},
+		{"warn", `{"id": "x"}`, nil},
+		{"off", `{"id": "x"}`, nil},
+		{"none", `{"id": "x"}`, nil},
+	}
+	for _, tt := range tests {
+		incomingLog := map[string]interface{}{"event_name": tt.event}
+		if tt.payload != "" {
+			var payload map[string]interface{}
+			if err := unmarshalUseNumber([]byte(tt.payload), &payload); err != nil {
+				t.Fatal(err)
+			}
+			incomingLog["payload"] = payload
+		}
+		got, err := checkEventSchema("p1", incomingLog)
+		if err != nil {
+			t.Fatalf("checkEventSchema(%s, %s) = %v", tt.event, tt.payload, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("checkEventSchema(%s, %s) = %+v, want %+v", tt.event, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestWriteSchemaViolation(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeSchemaViolation(rec, &schemaViolation{EventName: "checkout", Version: 3, FieldErrors: []fieldError{{"payload.id", "is required"}}})
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want 422", rec.Code)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"error":          "payload does not match schema",
+		"event_name":     "checkout",
+		"schema_version": 3.0,
+		"field_errors":   []interface{}{map[string]interface{}{"field": "payload.id", "error": "is required"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("body = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// eventSchema is the subset of JSON Schema the registry understands: types,
+// required keys, nested properties, array items, enums and string lengths.
+type eventSchema struct {
+	Type                 schemaTypes             `json:"type,omitempty"`
+	Required             []string                `json:"required,omitempty"`
+	Properties           map[string]*eventSchema `json:"properties,omitempty"`
+	AdditionalProperties *bool                   `json:"additionalProperties,omitempty"`
+	Items                *eventSchema            `json:"items,omitempty"`
+	Enum                 []interface{}           `json:"enum,omitempty"`
+	MinLength            *int                    `json:"minLength,omitempty"`
+	MaxLength            *int                    `json:"maxLength,omitempty"`
+}
+
+// schemaTypes accepts both "type": "string" and "type": ["string", "null"].
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or an array of strings")
+	}
+	*t = many
+	return nil
+}
+
+var knownSchemaTypes = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true,
+	"object": true, "array": true, "null": true,
+}
+
+// fieldError describes one way a payload fails its schema.
+type fieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+// parseEventSchema decodes and checks a schema document before it is stored.
+func parseEventSchema(raw json.RawMessage) (*eventSchema, error) {
+	var s eventSchema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := s.check("payload"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *eventSchema) check(path string) error {
+	for _, t := range s.Type {
+		if !knownSchemaTypes[t] {
+			return fmt.Errorf("%s: unknown type %q", path, t)
+		}
+	}
+	if s.MinLength != nil && *s.MinLength < 0 {
+		return fmt.Errorf("%s: minLength must not be negative", path)
+	}
+	if s.MaxLength != nil && *s.MaxLength < 0 {
+		return fmt.Errorf("%s: maxLength must not be negative", path)
+	}
+	for name, prop := range s.Properties {
+		if prop == nil {
+			return fmt.Errorf("%s.%s: schema must be an object", path, name)
+		}
+		if err := prop.check(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.check(path + "[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate returns every mismatch between value and the schema, in a stable order.
+func (s *eventSchema) validate(path string, value interface{}) []fieldError {
+	var errs []fieldError
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, fieldError{Field: field, Error: fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.Type) > 0 && !s.Type.matches(value) {
+		fail(path, "must be of type %s", strings.Join(s.Type, " or "))
+		return errs
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		fail(path, "must be one of the allowed values")
+	}
+
+	switch v := value.(type) {
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			fail(path, "must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail(path, "must be at most %d characters", *s.MaxLength)
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				fail(path+"."+key, "is required")
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			prop, ok := s.Properties[key]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					fail(path+"."+key, "is not allowed")
+				}
+				continue
+			}
+			errs = append(errs, prop.validate(path+"."+key, v[key])...)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+	}
+	return errs
+}
+
+func (t schemaTypes) matches(value interface{}) bool {
+	for _, typ := range t {
+		switch v := value.(type) {
+		case nil:
+			if typ == "null" {
+				return true
+			}
+		case string:
+			if typ == "string" {
+				return true
+			}
+		case bool:
+			if typ == "boolean" {
+				return true
+			}
+		case float64:
+			if typ == "number" || (typ == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case json.Number:
+			if typ == "number" {
+				return true
+			}
+			if typ == "integer" {
+				if _, err := v.Int64(); err == nil {
+					return true
+				}
+				if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+					return true
+				}
+			}
+		case int64, int32:
+			// Integer attributes decoded from OTLP.
+			if typ == "number" || typ == "integer" {
+				return true
+			}
+		case map[string]interface{}:
+			if typ == "object" {
+				return true
+			}
+		case []interface{}:
+			if typ == "array" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	// Compare numbers by value, so 1.0 matches an enum of 1.
+	if n, ok := value.(json.Number); ok {
+		if f, err := n.Float64(); err == nil {
+			value = f
+		}
+	}
+	want, _ := json.Marshal(value)
+	for _, e := range enum {
+		got, _ := json.Marshal(e)
+		if string(got) == string(want) {
+			return true
+		}
+	}
+	return false
+}
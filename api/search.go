@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// logsIndex is the table searches read. logs_index is a ReplacingMergeTree
+// keyed on each log's ID, and FINAL collapses copies of a log that were
+// written more than once but not merged yet.
+const logsIndex = "logs_index FINAL"
+
+// logFilter is the WHERE clause of a logs_index search: the project, the
+// q and search parameters and the from/to time range. terms is the free
+// text hits are highlighted with. from and to are the time range, zero
+// when not given.
+type logFilter struct {
+	where    string
+	args     []interface{}
+	terms    []queryValue
+	from, to time.Time
+}
+
+// parseLogFilter reads the search parameters shared by the logs, histogram
+// and facet endpoints. On a bad parameter it writes a 400 and returns false.
+func parseLogFilter(w http.ResponseWriter, r *http.Request, projectID string) (*logFilter, bool) {
+	params := r.URL.Query()
+
+	// q is a search query (see query.go). search, the older parameter,
+	// is free text.
+	node, err := parseQuery(params.Get("q"))
+	if err != nil {
+		writeQueryError(w, err)
+		return nil, false
+	}
+	if search := strings.TrimSpace(params.Get("search")); search != "" {
+		text := textNode{queryValue{text: search, quoted: true}}
+		if node == nil {
+			node = text
+		} else {
+			node = andNode{[]queryNode{node, text}}
+		}
+	}
+
+	f := &logFilter{where: "project_id = ?", args: []interface{}{projectID}}
+	now := time.Now()
+	if s := params.Get("from"); s != "" {
+		if f.from, err = parseTimeParam(s, now); err != nil {
+			http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		f.and("timestamp >= fromUnixTimestamp64Milli(?)", f.from.UnixMilli())
+	}
+	if s := params.Get("to"); s != "" {
+		if f.to, err = parseTimeParam(s, now); err != nil {
+			http.Error(w, "to: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		f.and("timestamp < fromUnixTimestamp64Milli(?)", f.to.UnixMilli())
+	}
+	if !f.from.IsZero() && !f.to.IsZero() && !f.from.Before(f.to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return nil, false
+	}
+
+	if node != nil {
+		cond, args := compileQuery(node)
+		f.and(cond, args...)
+		f.terms = textTerms(node)
+	}
+	return f, true
+}
+
+// and adds a condition to the filter.
+func (f *logFilter) and(cond string, args ...interface{}) {
+	f.where += " AND " + cond
+	f.args = append(f.args, args...)
+}
+
+// errUnknownGroupField is returned for a group field that is neither
+// event_name nor one of the project's searchable keys.
+var errUnknownGroupField = errors.New("can only group by event_name or a searchable key")
+
+// groupColumn returns the logs_index expression for a field results are
+// grouped by: the event name or a searchable key's value, which is "" for
+// logs without it.
+func groupColumn(projectID, field string) (string, []interface{}, error) {
+	if col, ok := queryColumns[field]; ok && col == "event_name" {
+		return col, nil, nil
+	}
+	var found bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM project_searchable_keys WHERE project_id = $1 AND key_name = $2)`, projectID, field).Scan(&found)
+	if err != nil {
+		return "", nil, err
+	}
+	if !found {
+		return "", nil, errUnknownGroupField
+	}
+	return "searchable[?]", []interface{}{field}, nil
+}
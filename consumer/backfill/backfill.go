@@ -0,0 +1,249 @@
+// Package backfill rebuilds a project's logs_index rows in ClickHouse from
+// the logs kept in Cassandra, for example after a searchable key is added
+// or ClickHouse data is lost. Jobs are queued in the index_backfills table
+// by the API and run by the consumer one at a time.
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"log-analysis-system/consumer/config"
+	"log-analysis-system/consumer/database"
+	"log-analysis-system/consumer/sink"
+)
+
+// maxAttempts is how many times a page is read or written before the job
+// is marked failed.
+const maxAttempts = 5
+
+// Runner claims queued backfill jobs and runs them.
+type Runner struct {
+	cfg       config.BackfillConfig
+	crdb      *database.CockroachClient
+	cassandra *database.CassandraClient
+	index     *database.ClickhouseClient
+}
+
+func NewRunner(cfg config.BackfillConfig, crdb *database.CockroachClient, cassandra *database.CassandraClient, index *database.ClickhouseClient) *Runner {
+	return &Runner{cfg: cfg, crdb: crdb, cassandra: cassandra, index: index}
+}
+
+// Run looks for a job every PollInterval and runs it until ctx is
+// cancelled. A job interrupted by shutdown is checkpointed and released, so
+// the next worker continues it.
+func (r *Runner) Run(ctx context.Context) {
+	for {
+		job, err := r.crdb.ClaimBackfill(ctx, r.cfg.Lease)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("ERROR: could not claim backfill job: %v", err)
+		}
+		if job != nil {
+			r.run(ctx, job)
+			continue
+		}
+		if !sleep(ctx, r.cfg.PollInterval) {
+			return
+		}
+	}
+}
+
+func (r *Runner) run(ctx context.Context, job *database.Backfill) {
+	log.Printf("INFO: backfill of project %s started at %d/%d logs", job.ProjectID, job.Scanned, job.Total)
+	err := r.rebuild(ctx, job)
+	switch {
+	case errors.Is(err, database.ErrBackfillLost):
+		log.Printf("INFO: backfill of project %s was taken over, stopping", job.ProjectID)
+	case ctx.Err() != nil:
+		if err := r.crdb.SaveBackfill(context.Background(), job, 0); err != nil {
+			log.Printf("ERROR: could not release backfill of project %s: %v", job.ProjectID, err)
+		}
+	case err != nil:
+		log.Printf("ERROR: backfill of project %s failed: %v", job.ProjectID, err)
+		if err := r.crdb.FinishBackfill(context.Background(), job, err.Error()); err != nil {
+			log.Printf("ERROR: could not record failed backfill of project %s: %v", job.ProjectID, err)
+		}
+	default:
+		log.Printf("INFO: backfill of project %s finished: %d logs scanned, %d written", job.ProjectID, job.Scanned, job.Written)
+		if err := r.crdb.FinishBackfill(context.Background(), job, ""); err != nil {
+			log.Printf("ERROR: could not record finished backfill of project %s: %v", job.ProjectID, err)
+		}
+	}
+}
+
+// rebuild rewrites the project's rows page by page, checkpointing after
+// each page, then deletes the rows it superseded. Rows ingested after the
+// cutoff were indexed by the live consumer and are skipped. The old rows
+// stay searchable until a new version of them is written, and a page
+// written twice after a crash replaces its own rows.
+func (r *Runner) rebuild(ctx context.Context, job *database.Backfill) error {
+	keys, err := r.crdb.SearchableKeys(ctx, job.ProjectID)
+	if err != nil {
+		return fmt.Errorf("could not load searchable keys: %w", err)
+	}
+
+	if job.RewriteFrom == 0 {
+		if job.Total, err = r.cassandra.CountProject(ctx, job.ProjectID); err != nil {
+			return fmt.Errorf("could not count logs: %w", err)
+		}
+		if job.RewriteFrom, err = r.index.Now(ctx); err != nil {
+			return fmt.Errorf("could not read ClickHouse time: %w", err)
+		}
+		if err := r.crdb.SaveBackfill(ctx, job, r.cfg.Lease); err != nil {
+			return err
+		}
+	}
+
+	for {
+		started := time.Now()
+		var rows []database.LogPayload
+		var next []byte
+		err := retry(ctx, func() error {
+			var err error
+			rows, next, err = r.cassandra.ScanProject(ctx, job.ProjectID, job.PageState, r.cfg.PageSize)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not read logs: %w", err)
+		}
+
+		written, err := r.writePage(ctx, rows, job.Cutoff, keys)
+		if err != nil {
+			return fmt.Errorf("could not write logs: %w", err)
+		}
+		job.PageState = next
+		job.Scanned += int64(len(rows))
+		job.Written += int64(written)
+		if len(next) == 0 {
+			break
+		}
+		if err := r.crdb.SaveBackfill(ctx, job, r.cfg.Lease); err != nil {
+			return err
+		}
+
+		// Throttle to Rate rows per second.
+		wait := time.Duration(len(rows))*time.Second/time.Duration(r.cfg.Rate) - time.Since(started)
+		if !sleep(ctx, wait) {
+			return ctx.Err()
+		}
+	}
+
+	// Every log in Cassandra from before the cutoff has now been indexed
+	// since RewriteFrom, so an older row of those is either a superseded
+	// version or a log no longer in Cassandra.
+	err = retry(ctx, func() error {
+		return r.index.DeleteSuperseded(ctx, job.ProjectID, job.Cutoff, job.RewriteFrom)
+	})
+	if err != nil {
+		return fmt.Errorf("could not delete superseded rows: %w", err)
+	}
+	job.Cleared = true
+	return nil
+}
+
+// writePage writes the rows of one page at once, so they share a ClickHouse
+// batch, retrying the rows that failed. A row written again replaces the
+// earlier copy, so retries and resumed pages are safe. It returns how many
+// were written.
+func (r *Runner) writePage(ctx context.Context, rows []database.LogPayload, cutoff int64, keys []string) (int, error) {
+	var pending []database.LogIndex
+	for _, row := range rows {
+		if row.IngestedAt >= cutoff {
+			continue
+		}
+		l, err := logFrom(row, keys)
+		if err != nil {
+			log.Printf("ERROR: skipping log %s in backfill: %v", row.LogID, err)
+			continue
+		}
+		pending = append(pending, sink.IndexRow(l))
+	}
+	written := len(pending)
+
+	err := retry(ctx, func() error {
+		results := make([]<-chan error, len(pending))
+		for i, row := range pending {
+			results[i] = r.index.WriteLog(ctx, row)
+		}
+		errs := make([]error, len(pending))
+		for i, result := range results {
+			errs[i] = <-result
+		}
+
+		var failed []database.LogIndex
+		for i, err := range errs {
+			if err != nil {
+				failed = append(failed, pending[i])
+			}
+		}
+		pending = failed
+		return errors.Join(errs...)
+	})
+	return written, err
+}
+
+// logFrom rebuilds the log the consumer stored. Logs stored before
+// payload_json existed only have their text fields.
+func logFrom(row database.LogPayload, keys []string) (sink.Log, error) {
+	l := sink.Log{
+		ProjectID:  row.ProjectID,
+		LogID:      row.LogID,
+		EventName:  row.EventName,
+		Timestamp:  row.Timestamp,
+		IngestedAt: row.IngestedAt,
+	}
+	if row.PayloadJSON == "" {
+		l.Payload = make(map[string]interface{}, len(row.Payload))
+		for k, v := range row.Payload {
+			l.Payload[k] = v
+		}
+		l.Fields = l.Payload
+		l.RawPayload, _ = json.Marshal(row.Payload)
+	} else {
+		payload, err := sink.DecodePayload(json.RawMessage(row.PayloadJSON))
+		if err != nil {
+			return sink.Log{}, err
+		}
+		l.Payload = payload
+		l.Fields = sink.Flatten(payload)
+		l.RawPayload = json.RawMessage(row.PayloadJSON)
+	}
+	l.Searchable = sink.SearchableValues(l.Payload, keys)
+	return l, nil
+}
+
+// retry runs fn up to maxAttempts times, doubling the wait between tries
+// from one second.
+func retry(ctx context.Context, fn func() error) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == maxAttempts || !database.IsTransient(err) {
+			return err
+		}
+		log.Printf("ERROR: backfill attempt %d failed, retrying: %v", attempt, err)
+		if !sleep(ctx, delay) {
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// sleep waits for d, or returns false if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -5,7 +5,9 @@ package config
 import(
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ClickhouseConfig struct{
@@ -14,6 +16,11 @@ type ClickhouseConfig struct{
 	Database string
 	Username string
 	Password string
+	// Rows are buffered and inserted together once BatchRows rows or
+	// BatchBytes bytes are waiting, or the oldest has waited BatchDelay.
+	BatchRows int
+	BatchBytes int
+	BatchDelay time.Duration
 }
 
 type CassandraConfig struct{
@@ -27,24 +34,87 @@ type KafkaConfig struct{
 	Brokers []string
 	Topic string
 	GroupID string
+	// Workers is how many goroutines hand messages to the sinks, and
+	// QueueSize how many fetched messages may wait for each worker.
+	// MaxInFlight caps the messages handed to the sinks and not yet stored.
+	Workers int
+	QueueSize int
+	MaxInFlight int
+	// CommitInterval batches offset commits; zero commits synchronously.
+	CommitInterval time.Duration
+	// DeadLetterTopic receives messages that cannot be decoded or still fail
+	// to store after MaxAttempts.
+	DeadLetterTopic string
+	MaxAttempts int
+}
+
+// DedupConfig controls how long a log ID is remembered, so retried and
+// redelivered copies of a log are stored once.
+type DedupConfig struct{
+	Window time.Duration
+}
+
+// RetryConfig controls how failed writes to a store are retried. Retries
+// back off exponentially from BaseDelay up to MaxDelay. After
+// BreakerThreshold transient failures in a row the store's circuit breaker
+// opens and consumption pauses for BreakerCooldown, doubling up to
+// BreakerMaxCooldown while the store stays down.
+type RetryConfig struct{
+	BaseDelay time.Duration
+	MaxDelay time.Duration
+	BreakerThreshold int
+	BreakerCooldown time.Duration
+	BreakerMaxCooldown time.Duration
+}
+
+// FileSinkConfig is where the file sink appends logs as JSON lines.
+type FileSinkConfig struct{
+	Path string
+}
+
+// CockroachConfig points at the database the API uses. The consumer records
+// ack=stored outcomes there and reads each project's searchable keys, which
+// it reloads every SearchableKeysRefresh.
+type CockroachConfig struct{
+	URL string
+	SearchableKeysRefresh time.Duration
+}
+
+// BackfillConfig controls the job that rebuilds a project's logs_index rows
+// from Cassandra. Queued jobs are looked for every PollInterval, rows are
+// read PageSize at a time and written at most Rate per second, and a job
+// left unfinished by a worker is taken over once its Lease runs out.
+type BackfillConfig struct{
+	PollInterval time.Duration
+	PageSize int
+	Rate int
+	Lease time.Duration
 }
 
 type Config struct{
+	// Sinks names the stores every log is written to, in order.
+	Sinks []string
 	Clickhouse ClickhouseConfig
 	Cassandra CassandraConfig
+	File FileSinkConfig
 	Kafka KafkaConfig
+	Dedup DedupConfig
+	Cockroach CockroachConfig
+	Retry RetryConfig
+	Backfill BackfillConfig
+	// MetricsAddr serves expvar metrics on /debug/vars when set.
+	MetricsAddr string
 }
 
 func Load()(*Config,error){
-	kafkaBrokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
-
-	if len(kafkaBrokers) == 0 || kafkaBrokers[0] == "" {
-		return nil, fmt.Errorf("required environment variable KAFKA_BROKERS is not set")
+	kafkaCfg, err := LoadKafka()
+	if err != nil {
+		return nil, err
 	}
 
-	cassandraHosts := strings.Split(os.Getenv("CASSANDRA_HOSTS"), ",")
-	if len(cassandraHosts) == 0 || cassandraHosts[0] == "" {
-		return nil, fmt.Errorf("required environment variable CASSANDRA_HOSTS is not set")
+	var cassandraHosts []string
+	if hosts := os.Getenv("CASSANDRA_HOSTS"); hosts != "" {
+		cassandraHosts = strings.Split(hosts, ",")
 	}
 
 		cfg := &Config{
@@ -61,17 +131,146 @@ func Load()(*Config,error){
 			Username: os.Getenv("CASSANDRA_USER"),
 			Password: os.Getenv("CASSANDRA_PASSWORD"),
 		},
-		Kafka: KafkaConfig{
-			Brokers: kafkaBrokers,
-			Topic:   "logs",
-			GroupID: "log-processors",
+		Kafka: *kafkaCfg,
+		File: FileSinkConfig{
+			Path: os.Getenv("FILE_SINK_PATH"),
 		},
+		Sinks: []string{"clickhouse", "cassandra"},
+	}
+	if sinks := os.Getenv("SINKS"); sinks != "" {
+		cfg.Sinks = nil
+		for _, name := range strings.Split(sinks, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				cfg.Sinks = append(cfg.Sinks, name)
+			}
+		}
 	}
+	if cfg.File.Path == "" {
+		cfg.File.Path = "logs.ndjson"
+	}
+
+	dedupWindow, err := durationEnv("DEDUP_WINDOW", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Dedup.Window = dedupWindow
+
+	if cfg.Clickhouse.BatchRows, err = intEnv("CLICKHOUSE_BATCH_ROWS", 5000); err != nil {
+		return nil, err
+	}
+	if cfg.Clickhouse.BatchBytes, err = intEnv("CLICKHOUSE_BATCH_BYTES", 16<<20); err != nil {
+		return nil, err
+	}
+	if cfg.Clickhouse.BatchDelay, err = durationEnv("CLICKHOUSE_BATCH_DELAY", 500*time.Millisecond); err != nil {
+		return nil, err
+	}
+	cfg.MetricsAddr = os.Getenv("METRICS_ADDR")
 
-	if cfg.Clickhouse.Host == "" {
-		return nil, fmt.Errorf("required environment variable CLICKHOUSE_HOST is not set")
+	if cfg.Retry.BaseDelay, err = durationEnv("RETRY_BASE_DELAY", 100*time.Millisecond); err != nil {
+		return nil, err
+	}
+	if cfg.Retry.MaxDelay, err = durationEnv("RETRY_MAX_DELAY", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Retry.BreakerThreshold, err = intEnv("BREAKER_THRESHOLD", 5); err != nil {
+		return nil, err
+	}
+	if cfg.Retry.BreakerCooldown, err = durationEnv("BREAKER_COOLDOWN", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Retry.BreakerMaxCooldown, err = durationEnv("BREAKER_MAX_COOLDOWN", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Retry.BaseDelay <= 0 || cfg.Retry.MaxDelay < cfg.Retry.BaseDelay {
+		return nil, fmt.Errorf("RETRY_BASE_DELAY must be positive and at most RETRY_MAX_DELAY")
+	}
+
+	cfg.Cockroach.URL = os.Getenv("DATABASE_URL")
+	if cfg.Cockroach.URL == "" {
+		cfg.Cockroach.URL = "postgresql://root@localhost:26257/log?sslmode=disable"
+	}
+	if cfg.Cockroach.SearchableKeysRefresh, err = durationEnv("SEARCHABLE_KEYS_REFRESH", time.Minute); err != nil {
+		return nil, err
+	}
+
+	if cfg.Backfill.PollInterval, err = durationEnv("BACKFILL_POLL_INTERVAL", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Backfill.PageSize, err = intEnv("BACKFILL_PAGE_SIZE", 500); err != nil {
+		return nil, err
+	}
+	if cfg.Backfill.Rate, err = intEnv("BACKFILL_RATE", 1000); err != nil {
+		return nil, err
+	}
+	if cfg.Backfill.Lease, err = durationEnv("BACKFILL_LEASE", time.Minute); err != nil {
+		return nil, err
 	}
 
 	return cfg,nil
 
-}
\ No newline at end of file
+}
+
+// LoadKafka reads only the Kafka settings, for commands that do not touch
+// the stores.
+func LoadKafka() (*KafkaConfig, error) {
+	kafkaBrokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
+	if len(kafkaBrokers) == 0 || kafkaBrokers[0] == "" {
+		return nil, fmt.Errorf("required environment variable KAFKA_BROKERS is not set")
+	}
+
+	cfg := &KafkaConfig{
+		Brokers:         kafkaBrokers,
+		Topic:           "logs",
+		GroupID:         "log-processors",
+		DeadLetterTopic: os.Getenv("KAFKA_DEAD_LETTER_TOPIC"),
+	}
+	if cfg.DeadLetterTopic == "" {
+		cfg.DeadLetterTopic = "logs-dead-letter"
+	}
+
+	var err error
+	if cfg.Workers, err = intEnv("CONSUMER_WORKERS", 16); err != nil {
+		return nil, err
+	}
+	if cfg.QueueSize, err = intEnv("CONSUMER_QUEUE_SIZE", 100); err != nil {
+		return nil, err
+	}
+	if cfg.MaxInFlight, err = intEnv("CONSUMER_MAX_IN_FLIGHT", 10000); err != nil {
+		return nil, err
+	}
+	if cfg.CommitInterval, err = durationEnv("KAFKA_COMMIT_INTERVAL", time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.MaxAttempts, err = intEnv("CONSUMER_MAX_ATTEMPTS", 5); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// durationEnv reads a duration such as "10m" from the environment, falling
+// back to def when the variable is unset.
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return d, nil
+}
+
+// intEnv reads a positive integer from the environment, falling back to def
+// when the variable is unset.
+func intEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be a positive integer", name)
+	}
+	return n, nil
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Backfill statuses in index_backfills.
+const (
+	BackfillPending = "pending"
+	BackfillRunning = "running"
+	BackfillDone    = "done"
+	BackfillFailed  = "failed"
+)
+
+// ErrBackfillLost is returned when a job was restarted or taken over by
+// another worker since it was claimed.
+var ErrBackfillLost = errors.New("backfill was restarted or claimed by another worker")
+
+// Backfill is a job rebuilding one project's logs_index rows from Cassandra.
+// Rows ingested before Cutoff (unix milliseconds) are rebuilt; later ones
+// were written by the live consumer. PageState is the Cassandra page to
+// continue from. RewriteFrom is ClickHouse's time when the job began
+// writing, so rows indexed before it are the ones the job supersedes, and
+// Cleared records that they have been deleted.
+type Backfill struct {
+	ProjectID   string
+	claimID     string
+	Cutoff      int64
+	Cleared     bool
+	RewriteFrom int64
+	PageState   []byte
+	Total       int64
+	Scanned     int64
+	Written     int64
+}
+
+// ClaimBackfill takes the oldest queued job, or a running one whose worker
+// let its lease run out, and holds it for lease. It returns nil when there
+// is nothing to do.
+func (c *CockroachClient) ClaimBackfill(ctx context.Context, lease time.Duration) (*Backfill, error) {
+	var b Backfill
+	var cutoff time.Time
+	var rewriteFrom sql.NullTime
+	err := c.DB.QueryRowContext(ctx, `
+		UPDATE index_backfills
+		SET status = 'running', claim_id = gen_random_uuid(),
+			lease_until = now() + $1 * INTERVAL '1 millisecond',
+			started_at = COALESCE(started_at, now()), updated_at = now()
+		WHERE project_id = (
+			SELECT project_id FROM index_backfills
+			WHERE status = 'pending' OR (status = 'running' AND lease_until < now())
+			ORDER BY requested_at LIMIT 1
+		) AND (status = 'pending' OR (status = 'running' AND lease_until < now()))
+		RETURNING project_id, claim_id, cutoff, cleared, rewrite_from, paging_state, total, scanned, written`,
+		lease.Milliseconds(),
+	).Scan(&b.ProjectID, &b.claimID, &cutoff, &b.Cleared, &rewriteFrom, &b.PageState, &b.Total, &b.Scanned, &b.Written)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.Cutoff = cutoff.UnixMilli()
+	if rewriteFrom.Valid {
+		b.RewriteFrom = rewriteFrom.Time.UnixMilli()
+	}
+	return &b, nil
+}
+
+// SaveBackfill checkpoints a job's progress and extends its lease. A zero
+// lease releases the job, so another worker can continue it at once.
+func (c *CockroachClient) SaveBackfill(ctx context.Context, b *Backfill, lease time.Duration) error {
+	res, err := c.DB.ExecContext(ctx, `
+		UPDATE index_backfills
+		SET cleared = $3, rewrite_from = $4, paging_state = $5, total = $6, scanned = $7, written = $8,
+			lease_until = now() + $9 * INTERVAL '1 millisecond', updated_at = now()
+		WHERE project_id = $1 AND claim_id = $2 AND status = 'running'`,
+		b.ProjectID, b.claimID, b.Cleared, b.rewriteFrom(), b.PageState, b.Total, b.Scanned, b.Written, lease.Milliseconds(),
+	)
+	return checkClaim(res, err)
+}
+
+// FinishBackfill marks a job done, or failed with errMsg. A failed job keeps
+// its checkpoint, so starting it again continues where it stopped.
+func (c *CockroachClient) FinishBackfill(ctx context.Context, b *Backfill, errMsg string) error {
+	status := BackfillDone
+	if errMsg != "" {
+		status = BackfillFailed
+	}
+	res, err := c.DB.ExecContext(ctx, `
+		UPDATE index_backfills
+		SET status = $3, error = $4, cleared = $5, rewrite_from = $6, paging_state = $7, total = $8, scanned = $9, written = $10,
+			lease_until = NULL, finished_at = now(), updated_at = now()
+		WHERE project_id = $1 AND claim_id = $2 AND status = 'running'`,
+		b.ProjectID, b.claimID, status, errMsg, b.Cleared, b.rewriteFrom(), b.PageState, b.Total, b.Scanned, b.Written,
+	)
+	return checkClaim(res, err)
+}
+
+// rewriteFrom is RewriteFrom for the rewrite_from column, NULL until set.
+func (b *Backfill) rewriteFrom() sql.NullTime {
+	if b.RewriteFrom == 0 {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: time.UnixMilli(b.RewriteFrom), Valid: true}
+}
+
+func checkClaim(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrBackfillLost
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -15,12 +16,17 @@ type CassandraClient struct{
 
 
 // LogPayload represents the full log data for the Cassandra table.
+// Timestamp (event time) and IngestedAt are unix milliseconds.
 type LogPayload struct {
-	ProjectID string
-	LogID     string
-	EventName string
-	Timestamp int64
-	Payload   map[string]string
+	ProjectID  string
+	LogID      string
+	EventName  string
+	Timestamp  int64
+	IngestedAt int64
+	// Payload holds the flattened payload fields as text, and PayloadJSON
+	// the payload as it was submitted.
+	Payload     map[string]string
+	PayloadJSON string
 }
 
 
@@ -45,13 +51,15 @@ func (c *CassandraClient) WriteLog(logData LogPayload) error {
 
 	log.Printf("DEBUG: Writing to Cassandra. Data: %+v, Timestamp Type: %T", logData, logData.Timestamp)
 	err := c.Session.Query(`
-		INSERT INTO logs (project_id, log_id, event_name, timestamp, payload) VALUES (?, ?, ?, ?, ?)
+		INSERT INTO logs (project_id, log_id, event_name, timestamp, ingested_at, payload, payload_json) VALUES (?, ?, ?, ?, ?, ?, ?)
 	`,
 		logData.ProjectID,
 		logData.LogID,
 		logData.EventName,
-		time.Unix(logData.Timestamp, 0),
+		time.UnixMilli(logData.Timestamp),
+		time.UnixMilli(logData.IngestedAt),
 		logData.Payload,
+		logData.PayloadJSON,
 	).Exec()
 
 	if err != nil {
@@ -61,3 +69,50 @@ func (c *CassandraClient) WriteLog(logData LogPayload) error {
 	return nil
 }
 
+
+// ScanProject reads one page of a project's logs, starting at pageState (nil
+// for the first page). It returns the state of the next page, which is
+// empty after the last one.
+func (c *CassandraClient) ScanProject(ctx context.Context, projectID string, pageState []byte, pageSize int) ([]LogPayload, []byte, error) {
+	iter := c.Session.Query(`
+		SELECT log_id, event_name, timestamp, ingested_at, payload, payload_json FROM logs WHERE project_id = ?
+	`, projectID).WithContext(ctx).PageSize(pageSize).PageState(pageState).Iter()
+	next := iter.PageState()
+
+	var logs []LogPayload
+	var logID, eventName, payloadJSON string
+	var timestamp, ingestedAt time.Time
+	var payload map[string]string
+	for iter.Scan(&logID, &eventName, &timestamp, &ingestedAt, &payload, &payloadJSON) {
+		logs = append(logs, LogPayload{
+			ProjectID:   projectID,
+			LogID:       logID,
+			EventName:   eventName,
+			Timestamp:   timestamp.UnixMilli(),
+			IngestedAt:  ingestedAt.UnixMilli(),
+			Payload:     payload,
+			PayloadJSON: payloadJSON,
+		})
+		payload, payloadJSON = nil, ""
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return logs, next, nil
+}
+
+// CountProject counts a project's logs.
+func (c *CassandraClient) CountProject(ctx context.Context, projectID string) (int64, error) {
+	var n int64
+	err := c.Session.Query(`SELECT COUNT(*) FROM logs WHERE project_id = ?`, projectID).WithContext(ctx).Scan(&n)
+	return n, err
+}
+
+// Ping checks that a Cassandra node answers.
+func (c *CassandraClient) Ping(ctx context.Context) error {
+	return c.Session.Query(`SELECT now() FROM system.local`).WithContext(ctx).Exec()
+}
+
+func (c *CassandraClient) Close() {
+	c.Session.Close()
+}
@@ -2,26 +2,66 @@ package database
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"log-analysis-system/consumer/config"
 	"github.com/ClickHouse/clickhouse-go/v2"
 )
 
 
+// ClickhouseClient buffers rows and inserts them into logs_index in batches.
+// WriteLog queues a row and reports on a channel once its batch has been
+// sent.
 type ClickhouseClient struct {
 	Conn clickhouse.Conn
+
+	batchRows  int
+	batchBytes int
+	batchDelay time.Duration
+
+	rows     chan pendingRow
+	flushes  chan chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+	closeOne sync.Once
+	closeErr error
+}
+
+// pendingRow is a row waiting for its batch, and where to report the result.
+type pendingRow struct {
+	index  LogIndex
+	queued time.Time
+	done   chan error
 }
 
+// errClickhouseClosed is returned by WriteLog after Close.
+var errClickhouseClosed = errors.New("clickhouse client is closed")
+
+// batchMetrics reports batch sizes and latencies on /debug/vars.
+var batchMetrics = expvar.NewMap("clickhouse_batches")
+
 
 // LogIndex represents the data structure for the ClickHouse table.
+// Timestamp (event time) and IngestedAt are unix milliseconds.
 type LogIndex struct {
 	ProjectID string
 	LogID string
 	EventName string
 	Timestamp int64
-	SearchableKey string
+	IngestedAt int64
+	// Searchable maps each of the project's searchable keys to its value.
+	Searchable map[string]string
+	// Strings, Numbers and Bools hold the flattened payload fields by type.
+	Strings map[string]string
+	Numbers map[string]float64
+	Bools   map[string]bool
+	// Text is the payload's string values, for full-text search.
+	Text string
 }
 
 func NewClickHouseClient(cfg config.ClickhouseConfig)(*ClickhouseClient, error){
@@ -43,8 +83,18 @@ func NewClickHouseClient(cfg config.ClickhouseConfig)(*ClickhouseClient, error){
 		return nil,err
 	}
 	
-	//nil means no error
-	return &ClickhouseClient{Conn: conn},nil
+	client := &ClickhouseClient{
+		Conn:       conn,
+		batchRows:  cfg.BatchRows,
+		batchBytes: cfg.BatchBytes,
+		batchDelay: cfg.BatchDelay,
+		rows:       make(chan pendingRow),
+		flushes:    make(chan chan struct{}),
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go client.run()
+	return client, nil
 }
 
 
@@ -53,21 +103,227 @@ func (c *CassandraClient) WriteLog(...): This declares a method named WriteLog.
 */
 
 
-func (c *ClickhouseClient) WriteLog(logData LogIndex) error {
-	ctx := context.Background()
-	err := c.Conn.Exec(ctx, `INSERT INTO logs_index (project_id, log_id, event_name, timestamp, searchable_key_1) VALUES (?, ?, ?, ?, ?)`,
-		logData.ProjectID,
-		logData.LogID,
-		logData.EventName,
-		logData.Timestamp,
-		logData.SearchableKey, 
-	)
+// WriteLog queues a row for the next batch and returns a channel that
+// receives the result once that batch has been inserted. It only waits
+// while the batcher is busy sending a batch, so a caller can have many
+// rows in flight. If ctx ends before the row is queued, the channel
+// receives ctx's error.
+func (c *ClickhouseClient) WriteLog(ctx context.Context, logData LogIndex) <-chan error {
+	row := pendingRow{index: logData, queued: time.Now(), done: make(chan error, 1)}
+	select {
+	case c.rows <- row:
+	case <-c.stopped:
+		row.done <- errClickhouseClosed
+	case <-ctx.Done():
+		row.done <- ctx.Err()
+	}
+	return row.done
+}
+
+// Flush sends the rows buffered so far without waiting for a batch limit.
+func (c *ClickhouseClient) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case c.flushes <- done:
+	case <-c.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ping checks that ClickHouse answers.
+func (c *ClickhouseClient) Ping(ctx context.Context) error {
+	return c.Conn.Ping(ctx)
+}
+
+// Close flushes the rows already queued and stops the batcher. Calls after
+// the first return the first call's result.
+func (c *ClickhouseClient) Close() error {
+	c.closeOne.Do(func() {
+		close(c.stop)
+		<-c.stopped
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// run collects rows until a limit or the delay is reached, then inserts
+// them as one batch.
+func (c *ClickhouseClient) run() {
+	defer close(c.stopped)
+
+	var batch []pendingRow
+	var bytes int
+	var timer <-chan time.Time
+	flush := func() {
+		c.flush(batch, bytes)
+		batch, bytes, timer = nil, 0, nil
+	}
+
+	for {
+		select {
+		case row := <-c.rows:
+			if len(batch) == 0 {
+				timer = time.After(c.batchDelay)
+			}
+			batch = append(batch, row)
+			bytes += row.index.size()
+			if len(batch) >= c.batchRows || bytes >= c.batchBytes {
+				flush()
+			}
+		case <-timer:
+			flush()
+		case done := <-c.flushes:
+			flush()
+			close(done)
+		case <-c.stop:
+			flush()
+			return
+		}
+	}
+}
+
+func (c *ClickhouseClient) flush(batch []pendingRow, bytes int) {
+	if len(batch) == 0 {
+		return
+	}
+	start := time.Now()
+	rejected, err := c.send(batch)
+	elapsed := time.Since(start)
+
+	batchMetrics.Add("batches", 1)
+	batchMetrics.Add("rows", int64(len(batch)))
+	batchMetrics.Add("bytes", int64(bytes))
+	batchMetrics.Add("flush_ms_total", elapsed.Milliseconds())
+	setInt(batchMetrics, "last_rows", int64(len(batch)))
+	setInt(batchMetrics, "last_bytes", int64(bytes))
+	setInt(batchMetrics, "last_flush_ms", elapsed.Milliseconds())
+	// How long the oldest row waited for its batch to be sent.
+	setInt(batchMetrics, "last_latency_ms", time.Since(batch[0].queued).Milliseconds())
 	if err != nil {
-		log.Printf("ERROR: Failed to write to ClickHouse: %v", err)
-		return err
+		batchMetrics.Add("errors", 1)
+		log.Printf("ERROR: Failed to write batch of %d rows to ClickHouse: %v", len(batch), err)
+	}
+
+	for i, row := range batch {
+		if rejected[i] != nil {
+			batchMetrics.Add("rejected_rows", 1)
+			log.Printf("ERROR: Rejected log %s for ClickHouse: %v", row.index.LogID, rejected[i])
+			row.done <- rejected[i]
+			continue
+		}
+		row.done <- err
 	}
-	return nil
 }
 
+// send inserts a batch. A row that cannot be appended invalidates the
+// batch, so it is left out and the batch is built again from the other
+// rows; rejected holds each row's own error. err is the error of the
+// insert itself.
+func (c *ClickhouseClient) send(batch []pendingRow) (rejected []error, err error) {
+	ctx := context.Background()
+	rejected = make([]error, len(batch))
+retry:
+	for {
+		b, err := c.Conn.PrepareBatch(ctx, `INSERT INTO logs_index (project_id, log_id, event_name, timestamp, ingested_at, searchable, payload_string, payload_number, payload_bool, payload_text)`)
+		if err != nil {
+			return rejected, err
+		}
+		appended := 0
+		for i, row := range batch {
+			if rejected[i] != nil {
+				continue
+			}
+			if err := b.Append(row.index.values()...); err != nil {
+				b.Abort()
+				// Marked as invalid so the row is not retried.
+				rejected[i] = fmt.Errorf("%w: %w", clickhouse.ErrBatchInvalid, err)
+				continue retry
+			}
+			appended++
+		}
+		if appended == 0 {
+			b.Abort()
+			return rejected, nil
+		}
+		return rejected, b.Send()
+	}
+}
+
+// values are the row's columns in insert order. indexed_at is left to
+// ClickHouse, which sets it to the time of the insert; it is the row's
+// version, and logs_index keeps the newest row of each log.
+func (l LogIndex) values() []interface{} {
+	return []interface{}{
+		l.ProjectID,
+		l.LogID,
+		l.EventName,
+		time.UnixMilli(l.Timestamp),
+		time.UnixMilli(l.IngestedAt),
+		nonNil(l.Searchable),
+		nonNil(l.Strings),
+		nonNil(l.Numbers),
+		nonNil(l.Bools),
+		l.Text,
+	}
+}
 
+// Now returns ClickHouse's clock in unix milliseconds, the clock indexed_at
+// is set from.
+func (c *ClickhouseClient) Now(ctx context.Context) (int64, error) {
+	var now int64
+	err := c.Conn.QueryRow(ctx, `SELECT toUnixTimestamp64Milli(now64(3))`).Scan(&now)
+	return now, err
+}
 
+// DeleteSuperseded deletes a project's rows of logs ingested before
+// ingestedBefore that were indexed before indexedBefore, by ClickHouse's
+// clock: older versions of rows written again since, and rows of logs that
+// were not. Times are unix milliseconds. The delete is a mutation that
+// ClickHouse applies in the background; rows inserted after it is issued
+// are not affected.
+func (c *ClickhouseClient) DeleteSuperseded(ctx context.Context, projectID string, ingestedBefore, indexedBefore int64) error {
+	return c.Conn.Exec(ctx,
+		`ALTER TABLE logs_index DELETE WHERE project_id = ? AND ingested_at < ? AND indexed_at < ?`,
+		projectID, time.UnixMilli(ingestedBefore), time.UnixMilli(indexedBefore),
+	)
+}
+
+// size estimates the bytes a row adds to a batch.
+func (l LogIndex) size() int {
+	n := len(l.ProjectID) + len(l.LogID) + len(l.EventName) + len(l.Text) + 16
+	for k, v := range l.Searchable {
+		n += len(k) + len(v)
+	}
+	for k, v := range l.Strings {
+		n += len(k) + len(v)
+	}
+	for k := range l.Numbers {
+		n += len(k) + 8
+	}
+	for k := range l.Bools {
+		n += len(k) + 1
+	}
+	return n
+}
+
+// nonNil gives rows without values for a Map column an empty map.
+func nonNil[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return map[string]V{}
+	}
+	return m
+}
+
+func setInt(m *expvar.Map, key string, v int64) {
+	i := new(expvar.Int)
+	i.Set(v)
+	m.Set(key, i)
+}
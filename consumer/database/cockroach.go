@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/lib/pq"
+	"log-analysis-system/consumer/config"
+)
+
+// Ack statuses written to log_acks.
+const (
+	AckStored = "stored"
+	AckFailed = "failed"
+)
+
+type CockroachClient struct {
+	DB *sql.DB
+}
+
+func NewCockroachClient(cfg config.CockroachConfig) (*CockroachClient, error) {
+	db, err := sql.Open("postgres", cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	return &CockroachClient{DB: db}, nil
+}
+
+// WriteAck records the outcome of storing a log for a client waiting with
+// ack=stored. A later outcome for the same log replaces an earlier one, so a
+// redelivered log that is stored after a failure reports stored.
+func (c *CockroachClient) WriteAck(ctx context.Context, projectID, logID, status, errMsg string) error {
+	_, err := c.DB.ExecContext(ctx,
+		`UPSERT INTO log_acks (project_id, log_id, status, error, acked_at) VALUES ($1, $2, $3, NULLIF($4, ''), now())`,
+		projectID, logID, status, errMsg,
+	)
+	return err
+}
+
+func (c *CockroachClient) Close() error {
+	return c.DB.Close()
+}
+
+// SearchableKeys returns the payload keys a project chose to index.
+func (c *CockroachClient) SearchableKeys(ctx context.Context, projectID string) ([]string, error) {
+	rows, err := c.DB.QueryContext(ctx,
+		`SELECT key_name FROM project_searchable_keys WHERE project_id = $1 ORDER BY key_name`,
+		projectID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
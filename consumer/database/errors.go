@@ -0,0 +1,66 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/column"
+	"github.com/gocql/gocql"
+)
+
+// transientClickhouseCodes are ClickHouse server errors that a later retry
+// can succeed on: overload, timeouts, network trouble and read-only replicas.
+var transientClickhouseCodes = map[int32]bool{
+	3:   true, // UNEXPECTED_END_OF_FILE
+	159: true, // TIMEOUT_EXCEEDED
+	164: true, // READONLY
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	241: true, // MEMORY_LIMIT_EXCEEDED
+	242: true, // TABLE_IS_READ_ONLY
+	252: true, // TOO_MANY_PARTS
+	319: true, // UNKNOWN_STATUS_OF_INSERT
+	425: true, // SYSTEM_ERROR
+	999: true, // KEEPER_EXCEPTION
+}
+
+// IsTransient reports whether a write that failed with err may succeed if
+// it is tried again. Errors that describe the data or the query, such as a
+// type mismatch or a syntax error, are permanent. Unknown errors are treated
+// as transient, so a log is never given up on for an error we do not know.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var chErr *clickhouse.Exception
+	if errors.As(err, &chErr) {
+		return transientClickhouseCodes[chErr.Code]
+	}
+
+	var cqlErr gocql.RequestError
+	if errors.As(err, &cqlErr) {
+		switch cqlErr.Code() {
+		case gocql.ErrCodeSyntax, gocql.ErrCodeInvalid, gocql.ErrCodeUnauthorized,
+			gocql.ErrCodeConfig, gocql.ErrCodeAlreadyExists, gocql.ErrCodeCredentials,
+			gocql.ErrCodeFunctionFailure:
+			return false
+		}
+		return true
+	}
+
+	// Values the driver cannot convert to the column type fail the same way
+	// every time.
+	var convErr *column.ColumnConverterError
+	if errors.As(err, &convErr) || errors.Is(err, clickhouse.ErrBatchInvalid) {
+		return false
+	}
+	var colErr *column.Error
+	if errors.As(err, &colErr) {
+		return false
+	}
+
+	// Timeouts, dropped connections and everything else we cannot place.
+	return true
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// SearchableKeyCache keeps each project's searchable keys in memory and
+// reloads them once they are older than the refresh interval, so keys added
+// to a project are picked up without a restart.
+type SearchableKeyCache struct {
+	client  *CockroachClient
+	refresh time.Duration
+
+	mu      sync.Mutex
+	entries map[string]searchableKeysEntry
+}
+
+type searchableKeysEntry struct {
+	keys   []string
+	loaded time.Time
+}
+
+func NewSearchableKeyCache(client *CockroachClient, refresh time.Duration) *SearchableKeyCache {
+	return &SearchableKeyCache{
+		client:  client,
+		refresh: refresh,
+		entries: make(map[string]searchableKeysEntry),
+	}
+}
+
+// Keys returns the searchable keys of a project. If they cannot be reloaded
+// the previous keys are kept (none for a project not seen before) and the
+// lookup is tried again after the next refresh interval, so a database
+// outage does not stop logs from being stored.
+func (c *SearchableKeyCache) Keys(ctx context.Context, projectID string) []string {
+	c.mu.Lock()
+	entry, ok := c.entries[projectID]
+	c.mu.Unlock()
+	if ok && time.Since(entry.loaded) < c.refresh {
+		return entry.keys
+	}
+
+	keys, err := c.client.SearchableKeys(ctx, projectID)
+	if err != nil {
+		log.Printf("ERROR: could not load searchable keys for project %s: %v", projectID, err)
+		keys = entry.keys
+	}
+
+	c.mu.Lock()
+	c.entries[projectID] = searchableKeysEntry{keys: keys, loaded: time.Now()}
+	c.mu.Unlock()
+	return keys
+}
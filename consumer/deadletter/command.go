@@ -0,0 +1,262 @@
+package deadletter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"log-analysis-system/consumer/config"
+)
+
+// readTimeout bounds a single read from the dead-letter topic.
+const readTimeout = 10 * time.Second
+
+const usage = `usage: consumer dlq <command> [flags]
+
+commands:
+  list [-project ID] [-limit N]       list dead-lettered messages
+  inspect <partition:offset>           show one message and why it failed
+  redrive [-project ID] [-all] [ID...] publish messages back to the logs topic
+`
+
+// Run runs a dlq subcommand against the dead-letter topic.
+func Run(cfg *config.KafkaConfig, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("missing dlq command")
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		return runList(ctx, cfg, args[1:])
+	case "inspect":
+		return runInspect(ctx, cfg, args[1:])
+	case "redrive":
+		return runRedrive(ctx, cfg, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown dlq command %q", args[0])
+	}
+}
+
+func runList(ctx context.Context, cfg *config.KafkaConfig, args []string) error {
+	fs := flag.NewFlagSet("dlq list", flag.ContinueOnError)
+	project := fs.String("project", "", "only list messages of this project")
+	limit := fs.Int("limit", 100, "maximum number of messages to list, 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tFAILED AT\tPROJECT\tSOURCE\tATTEMPTS\tERROR")
+	n := 0
+	err := scan(ctx, cfg, func(r *Record) bool {
+		if *project != "" && r.ProjectID() != *project {
+			return true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s/%d@%d\t%d\t%s\n",
+			r.ID(), r.FailedAt.Format(time.RFC3339), r.ProjectID(),
+			r.SourceTopic, r.SourcePartition, r.SourceOffset, r.Attempts, r.Error)
+		n++
+		return *limit == 0 || n < *limit
+	})
+	tw.Flush()
+	return err
+}
+
+func runInspect(ctx context.Context, cfg *config.KafkaConfig, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: consumer dlq inspect <partition:offset>")
+	}
+	r, err := fetch(ctx, cfg, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ID:          %s\n", r.ID())
+	fmt.Printf("Failed at:   %s\n", r.FailedAt.Format(time.RFC3339Nano))
+	fmt.Printf("Attempts:    %d\n", r.Attempts)
+	fmt.Printf("Error:       %s\n", r.Error)
+	fmt.Printf("Source:      %s partition %d offset %d\n", r.SourceTopic, r.SourcePartition, r.SourceOffset)
+	fmt.Printf("Key:         %s\n", r.Key)
+	fmt.Println("Value:")
+	writeValue(os.Stdout, r.Value)
+	return nil
+}
+
+// writeValue pretty-prints a JSON value, or prints it as is when it is not
+// valid JSON (which may be why it was dead-lettered).
+func writeValue(w io.Writer, value []byte) {
+	var out bytes.Buffer
+	if err := json.Indent(&out, value, "", "  "); err != nil {
+		fmt.Fprintf(w, "%q\n", value)
+		return
+	}
+	out.WriteByte('\n')
+	out.WriteTo(w)
+}
+
+func runRedrive(ctx context.Context, cfg *config.KafkaConfig, args []string) error {
+	fs := flag.NewFlagSet("dlq redrive", flag.ContinueOnError)
+	all := fs.Bool("all", false, "re-drive every dead-lettered message")
+	project := fs.String("project", "", "with -all, only re-drive messages of this project")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *all == (fs.NArg() > 0) {
+		return errors.New("usage: consumer dlq redrive [-project ID] -all | <partition:offset>...")
+	}
+
+	var records []*Record
+	if *all {
+		err := scan(ctx, cfg, func(r *Record) bool {
+			if *project == "" || r.ProjectID() == *project {
+				records = append(records, r)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, id := range fs.Args() {
+			r, err := fetch(ctx, cfg, id)
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+	}
+	if len(records) == 0 {
+		fmt.Println("Nothing to re-drive.")
+		return nil
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Topic:        cfg.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+	defer writer.Close()
+
+	messages := make([]kafka.Message, len(records))
+	for i, r := range records {
+		messages[i] = kafka.Message{
+			Key:     r.Key,
+			Value:   r.Value,
+			Headers: []kafka.Header{{Key: headerRedriveKey, Value: []byte(r.ID())}},
+		}
+	}
+	if err := writer.WriteMessages(ctx, messages...); err != nil {
+		return fmt.Errorf("could not re-drive messages: %w", err)
+	}
+	// Log IDs are kept, so a message re-driven twice is still stored once.
+	fmt.Printf("Re-drove %d message(s) to %s.\n", len(records), cfg.Topic)
+	return nil
+}
+
+// scan reads every partition of the dead-letter topic from its first offset
+// to its current end, calling fn for each record until fn returns false.
+func scan(ctx context.Context, cfg *config.KafkaConfig, fn func(*Record) bool) error {
+	conn, err := kafka.DialContext(ctx, "tcp", cfg.Brokers[0])
+	if err != nil {
+		return err
+	}
+	partitions, err := conn.ReadPartitions(cfg.DeadLetterTopic)
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("could not read partitions of %s: %w", cfg.DeadLetterTopic, err)
+	}
+
+	for _, p := range partitions {
+		leader, err := kafka.DialLeader(ctx, "tcp", cfg.Brokers[0], cfg.DeadLetterTopic, p.ID)
+		if err != nil {
+			return err
+		}
+		first, last, err := leader.ReadOffsets()
+		leader.Close()
+		if err != nil {
+			return err
+		}
+		if first >= last {
+			continue
+		}
+
+		more, err := scanPartition(ctx, cfg, p.ID, first, last, fn)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+func scanPartition(ctx context.Context, cfg *config.KafkaConfig, partition int, first, last int64, fn func(*Record) bool) (bool, error) {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   cfg.Brokers,
+		Topic:     cfg.DeadLetterTopic,
+		Partition: partition,
+	})
+	defer reader.Close()
+	if err := reader.SetOffset(first); err != nil {
+		return false, err
+	}
+
+	for {
+		readCtx, cancel := context.WithTimeout(ctx, readTimeout)
+		msg, err := reader.ReadMessage(readCtx)
+		cancel()
+		if err != nil {
+			return false, fmt.Errorf("could not read partition %d: %w", partition, err)
+		}
+		if !fn(recordFromMessage(msg)) {
+			return false, nil
+		}
+		if msg.Offset+1 >= last {
+			return true, nil
+		}
+	}
+}
+
+// fetch reads one record by its "partition:offset" ID.
+func fetch(ctx context.Context, cfg *config.KafkaConfig, id string) (*Record, error) {
+	partStr, offStr, ok := strings.Cut(id, ":")
+	partition, err1 := strconv.Atoi(partStr)
+	offset, err2 := strconv.ParseInt(offStr, 10, 64)
+	if !ok || err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid message ID %q, want partition:offset", id)
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   cfg.Brokers,
+		Topic:     cfg.DeadLetterTopic,
+		Partition: partition,
+	})
+	defer reader.Close()
+	if err := reader.SetOffset(offset); err != nil {
+		return nil, err
+	}
+	readCtx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+	msg, err := reader.ReadMessage(readCtx)
+	if err != nil {
+		return nil, fmt.Errorf("could not read message %s: %w", id, err)
+	}
+	if msg.Offset != offset {
+		return nil, fmt.Errorf("message %s not found", id)
+	}
+	return recordFromMessage(msg), nil
+}
@@ -0,0 +1,113 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"log-analysis-system/consumer/config"
+)
+
+// Headers a dead-lettered message carries. The key and value are the
+// original message's, untouched, so it can be re-driven as it was.
+const (
+	headerError      = "dlq.error"
+	headerTopic      = "dlq.source.topic"
+	headerPartition  = "dlq.source.partition"
+	headerOffset     = "dlq.source.offset"
+	headerAttempts   = "dlq.attempts"
+	headerFailedAt   = "dlq.failed_at"
+	headerRedriveKey = "dlq.redriven_from"
+)
+
+// Record is a message read back from the dead-letter topic.
+type Record struct {
+	// Partition and Offset locate the record in the dead-letter topic.
+	Partition int
+	Offset    int64
+
+	Error           string
+	SourceTopic     string
+	SourcePartition int
+	SourceOffset    int64
+	Attempts        int
+	FailedAt        time.Time
+
+	Key   []byte
+	Value []byte
+}
+
+// ID names a record for the inspect and redrive commands.
+func (r *Record) ID() string {
+	return fmt.Sprintf("%d:%d", r.Partition, r.Offset)
+}
+
+// ProjectID is the project in the original envelope, if it can be decoded.
+func (r *Record) ProjectID() string {
+	var env struct {
+		ProjectID string `json:"project_id"`
+	}
+	json.Unmarshal(r.Value, &env)
+	return env.ProjectID
+}
+
+func recordFromMessage(msg kafka.Message) *Record {
+	r := &Record{Partition: msg.Partition, Offset: msg.Offset, Key: msg.Key, Value: msg.Value}
+	for _, h := range msg.Headers {
+		v := string(h.Value)
+		switch h.Key {
+		case headerError:
+			r.Error = v
+		case headerTopic:
+			r.SourceTopic = v
+		case headerPartition:
+			r.SourcePartition, _ = strconv.Atoi(v)
+		case headerOffset:
+			r.SourceOffset, _ = strconv.ParseInt(v, 10, 64)
+		case headerAttempts:
+			r.Attempts, _ = strconv.Atoi(v)
+		case headerFailedAt:
+			r.FailedAt, _ = time.Parse(time.RFC3339Nano, v)
+		}
+	}
+	return r
+}
+
+// Publisher writes failed messages to the dead-letter topic.
+type Publisher struct {
+	writer *kafka.Writer
+}
+
+func NewPublisher(cfg config.KafkaConfig) *Publisher {
+	return &Publisher{writer: &kafka.Writer{
+		Addr:  kafka.TCP(cfg.Brokers...),
+		Topic: cfg.DeadLetterTopic,
+		// Keep the original key, so a project's failures stay together.
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}}
+}
+
+// Publish dead-letters msg with the reason it failed and how many times it
+// was tried.
+func (p *Publisher) Publish(ctx context.Context, msg kafka.Message, reason error, attempts int) error {
+	return p.writer.WriteMessages(ctx, kafka.Message{
+		Key:   msg.Key,
+		Value: msg.Value,
+		Headers: []kafka.Header{
+			{Key: headerError, Value: []byte(reason.Error())},
+			{Key: headerTopic, Value: []byte(msg.Topic)},
+			{Key: headerPartition, Value: []byte(strconv.Itoa(msg.Partition))},
+			{Key: headerOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+			{Key: headerAttempts, Value: []byte(strconv.Itoa(attempts))},
+			{Key: headerFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+		},
+	})
+}
+
+func (p *Publisher) Close() error {
+	return p.writer.Close()
+}
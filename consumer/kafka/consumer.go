@@ -3,107 +3,505 @@ package kafka
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/segmentio/kafka-go"
 	"log-analysis-system/consumer/config"
 	"log-analysis-system/consumer/database"
+	"log-analysis-system/consumer/deadletter"
+	"log-analysis-system/consumer/sink"
 )
 
+// KafkaMessage is the envelope the API publishes. EventTime and IngestedAt
+// are unix milliseconds; messages published before they existed carry zero.
 type KafkaMessage struct {
-	ProjectID string      `json:"project_id"`
-	Payload   IngestedLog `json:"payload"`
+	ProjectID  string      `json:"project_id"`
+	LogID      string      `json:"log_id"`
+	EventTime  int64       `json:"event_time"`
+	IngestedAt int64       `json:"ingested_at"`
+	Payload    IngestedLog `json:"payload"`
+	// Ack is "stored" when the client waits for the outcome in log_acks.
+	Ack string `json:"ack,omitempty"`
 }
 
+// IngestedLog is the log as the client sent it. Payload is kept as raw JSON
+// so sinks can store it exactly as submitted.
 type IngestedLog struct {
-	EventName string                 `json:"event_name"`
-	Payload   map[string]interface{} `json:"payload"`
+	EventName string          `json:"event_name"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// legacyLogIDNamespace seeds log IDs for messages published without one, so a
+// redelivered message still maps to the same ID.
+var legacyLogIDNamespace = uuid.MustParse("3b9d6f2e-1c4a-4e8b-a7f5-6d0e2c9b1a47")
+
+// ackWriter records the outcome of a log whose client waits with
+// ack=stored. *database.CockroachClient is one.
+type ackWriter interface {
+	WriteAck(ctx context.Context, projectID, logID, status, errMsg string) error
+}
+
+// keySource returns a project's searchable keys.
+// *database.SearchableKeyCache is one.
+type keySource interface {
+	Keys(ctx context.Context, projectID string) []string
 }
 
 type Consumer struct {
 	reader          *kafka.Reader
-	clickhouseClient *database.ClickhouseClient
-	cassandraClient *database.CassandraClient
+	sinks           []sink.LogSink
+	// breakers[i] guards sinks[i].
+	breakers        []*breaker
+	acks            ackWriter
+	searchableKeys  keySource
+	deadLetters     *deadletter.Publisher
+	dedup           *Deduplicator
+	offsets         *offsetTracker
+	workers         int
+	queueSize       int
+	// slots holds a token for each message handed to the sinks and not
+	// yet stored, and inFlight waits for them at shutdown.
+	slots           chan struct{}
+	inFlight        sync.WaitGroup
+	// flights are the logs being stored, by dedup key, so a duplicate
+	// waiting for an ack can wait for the first copy.
+	flightsMu       sync.Mutex
+	flights         map[string]*flight
+	maxAttempts     int
+	backoff         backoff
 }
 
-func NewConsumer(cfg config.KafkaConfig, ch *database.ClickhouseClient, cass *database.CassandraClient) *Consumer {
+// NewConsumer builds a consumer that writes every log to each of sinks.
+func NewConsumer(cfg config.KafkaConfig, dedupCfg config.DedupConfig, retryCfg config.RetryConfig, sinks []sink.LogSink, crdb *database.CockroachClient, keys *database.SearchableKeyCache, dlq *deadletter.Publisher) *Consumer {
 	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: cfg.Brokers,
-		Topic:   cfg.Topic,
-		GroupID: cfg.GroupID,
+		Brokers:        cfg.Brokers,
+		Topic:          cfg.Topic,
+		GroupID:        cfg.GroupID,
+		CommitInterval: cfg.CommitInterval,
 	})
+	breakers := make([]*breaker, len(sinks))
+	for i, s := range sinks {
+		breakers[i] = newBreaker(s.Name(), retryCfg)
+	}
 	return &Consumer{
 		reader:          reader,
-		clickhouseClient: ch,
-		cassandraClient: cass,
+		sinks:           sinks,
+		breakers:        breakers,
+		acks:            crdb,
+		searchableKeys:  keys,
+		deadLetters:     dlq,
+		dedup:           NewDeduplicator(dedupCfg.Window),
+		offsets:         newOffsetTracker(),
+		workers:         cfg.Workers,
+		queueSize:       cfg.QueueSize,
+		slots:           make(chan struct{}, cfg.MaxInFlight),
+		flights:         make(map[string]*flight),
+		maxAttempts:     cfg.MaxAttempts,
+		backoff:         backoff{base: retryCfg.BaseDelay, max: retryCfg.MaxDelay},
 	}
 }
 
-func (c *Consumer) Start() {
-	defer c.reader.Close()
+// storeError is a write that was given up on, either because the error is
+// permanent or because it was still failing after maxAttempts.
+type storeError struct {
+	sink     string
+	attempts int
+	err      error
+}
+
+func (e *storeError) Error() string {
+	return fmt.Sprintf("%s: %v (after %d attempt(s))", e.sink, e.err, e.attempts)
+}
+
+func (e *storeError) Unwrap() error { return e.err }
+
+// errUndecodable marks a message that can never be stored, so it is
+// dead-lettered without being retried.
+var errUndecodable = errors.New("undecodable message")
 
+// Start fetches the topic and hands each message to one of a fixed number of
+// workers until ctx is cancelled. Messages with the same partition and key
+// (e.g. one project) go to the same worker. Offsets are committed only after
+// a message and everything before it in its partition is stored, so a crash
+// redelivers rather than loses logs.
+//
+// When ctx is cancelled Start stops fetching, waits for the logs already
+// handed to the sinks and commits them before it returns. Messages still
+// queued are left uncommitted and redelivered on the next start.
+func (c *Consumer) Start(ctx context.Context) {
+	queues := make([]chan *pendingOffset, c.workers)
+	var workers sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan *pendingOffset, c.queueSize)
+		workers.Add(1)
+		go func(queue <-chan *pendingOffset) {
+			defer workers.Done()
+			c.work(ctx, queue)
+		}(queues[i])
+	}
+
+fetch:
 	for {
-		msg, err := c.reader.ReadMessage(context.Background())
+		// Stop fetching while a store is down, so the backlog stays in Kafka
+		// instead of failing write after write.
+		if err := c.waitForStores(ctx); err != nil {
+			break
+		}
+		msg, err := c.reader.FetchMessage(ctx)
 		if err != nil {
-			log.Printf("ERROR: could not read message from kafka: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("ERROR: could not fetch message from kafka: %v", err)
 			continue
 		}
+		select {
+		case queues[workerFor(msg, len(queues))] <- c.offsets.track(msg):
+		case <-ctx.Done():
+			break fetch
+		}
+	}
+
+	log.Println("Shutting down, waiting for workers to finish their batches...")
+	workers.Wait()
+	c.inFlight.Wait()
+	// Closing the reader flushes the pending commits.
+	if err := c.reader.Close(); err != nil {
+		log.Printf("ERROR: could not close kafka reader: %v", err)
+	}
+}
+
+// workerFor picks the worker for a message from its partition and key.
+func workerFor(msg kafka.Message, workers int) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d/", msg.Partition)
+	h.Write(msg.Key)
+	return int(h.Sum32() % uint32(workers))
+}
+
+// work hands the messages of its queue to the sinks in the order they were
+// fetched, until ctx is cancelled. A worker's messages share partitions and
+// keys, so each partition's logs reach the sinks in order; only retries can
+// store a log after later ones.
+func (c *Consumer) work(ctx context.Context, queue <-chan *pendingOffset) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-queue:
+			c.process(ctx, p)
+		}
+	}
+}
 
-		var kafkaMsg KafkaMessage
-		if err := json.Unmarshal(msg.Value, &kafkaMsg); err != nil {
-			log.Printf("ERROR: could not unmarshal kafka message: %v", err)
+// process hands one message to the sinks and, without waiting for them,
+// tracks it until it is stored, dead-lettering it if a store gives up on
+// it. It waits only while CONSUMER_MAX_IN_FLIGHT messages are in flight.
+// The offset is committed only once the message is stored or
+// dead-lettered; a message still being retried at shutdown is left for
+// redelivery.
+func (c *Consumer) process(ctx context.Context, p *pendingOffset) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	wait := c.handleMessage(ctx, p.msg)
+	c.inFlight.Add(1)
+	go func() {
+		defer c.inFlight.Done()
+		defer func() { <-c.slots }()
+
+		err := wait()
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			attempts := 1
+			var se *storeError
+			if errors.As(err, &se) {
+				attempts = se.attempts
+			}
+			if !c.deadLetter(ctx, p.msg, err, attempts) {
+				return
+			}
+		}
+		c.commit(p)
+	}()
+}
+
+// waitForStores blocks while any sink's circuit breaker is open.
+func (c *Consumer) waitForStores(ctx context.Context) error {
+	for _, b := range c.breakers {
+		if err := b.waitClosed(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withRetry waits for the result of a write, first of first if it is not
+// nil, and runs write again until it succeeds, fails permanently or has
+// failed maxAttempts times, backing off between attempts. While the store's
+// breaker is open the write waits for it, and failures then are blamed on
+// the store rather than counted against the log.
+func (c *Consumer) withRetry(ctx context.Context, b *breaker, first <-chan error, write func() <-chan error) error {
+	attempts := 0
+	result := first
+	for {
+		if result == nil {
+			if err := b.acquire(ctx); err != nil {
+				return err
+			}
+			result = write()
+		}
+		err := <-result
+		result = nil
+		if err == nil {
+			b.success()
+			return nil
+		}
+		log.Printf("ERROR: could not write to %s: %v", b.name, err)
+		attempts++
+		if !database.IsTransient(err) {
+			// The store answered; the write itself is at fault.
+			b.success()
+			return &storeError{sink: b.name, attempts: attempts, err: err}
+		}
+		if b.failure() {
+			attempts--
 			continue
 		}
+		if attempts >= c.maxAttempts {
+			return &storeError{sink: b.name, attempts: attempts, err: err}
+		}
+		log.Printf("ERROR: %s write failed (attempt %d), retrying: %v", b.name, attempts, err)
+		if !sleep(ctx, c.backoff.delay(attempts)) {
+			return ctx.Err()
+		}
+	}
+}
+
+// sleep waits for d, or returns false if ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// deadLetter publishes a message that could not be stored to the dead-letter
+// topic, retrying until it is published, and fails its ack if the client is
+// waiting for one. It returns false if ctx was cancelled before the message
+// could be published.
+func (c *Consumer) deadLetter(ctx context.Context, msg kafka.Message, reason error, attempts int) bool {
+	log.Printf("ERROR: dead-lettering message at partition %d offset %d after %d attempt(s): %v", msg.Partition, msg.Offset, attempts, reason)
+	for attempt := 0; ; {
+		err := c.deadLetters.Publish(context.Background(), msg, reason, attempts)
+		if err == nil {
+			break
+		}
+		log.Printf("ERROR: could not publish dead letter for partition %d offset %d, retrying: %v", msg.Partition, msg.Offset, err)
+		attempt++
+		if !sleep(ctx, c.backoff.delay(attempt)) {
+			return false
+		}
+	}
+
+	var kafkaMsg KafkaMessage
+	if json.Unmarshal(msg.Value, &kafkaMsg) != nil || kafkaMsg.Ack != database.AckStored {
+		return true
+	}
+	errMsg := "could not store log: " + reason.Error()
+	if err := c.acks.WriteAck(context.Background(), kafkaMsg.ProjectID, kafkaMsg.LogID, database.AckFailed, errMsg); err != nil {
+		log.Printf("ERROR: could not record ack for log %s: %v", kafkaMsg.LogID, err)
+	}
+	return true
+}
+
+// commit marks a message stored and commits the newest offset of its
+// partition that has nothing unstored before it.
+func (c *Consumer) commit(p *pendingOffset) {
+	msg, ok := c.offsets.complete(p)
+	if !ok {
+		return
+	}
+	if err := c.reader.CommitMessages(context.Background(), msg); err != nil {
+		log.Printf("ERROR: could not commit offset %d of partition %d: %v", msg.Offset, msg.Partition, err)
+	}
+}
+
+// flight is a log being stored. done is closed once err is set.
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// handleMessage decodes one message and hands it to every sink. It returns
+// a function that waits until every write has finished, each with its own
+// retries, and then records the ack. A message that cannot be decoded
+// returns errUndecodable, and a sink that gave up returns a *storeError.
+//
+// A duplicate of a log seen within the dedup window is not written again.
+// If its client waits with ack=stored, it is acked with the outcome of the
+// first copy once that is known.
+func (c *Consumer) handleMessage(ctx context.Context, msg kafka.Message) func() error {
+	kafkaMsg, l, err := decode(msg)
+	if err != nil {
+		return func() error { return err }
+	}
+	projectID, logID := l.ProjectID, l.LogID
+	key := projectID + "/" + logID
 
-		projectID := kafkaMsg.ProjectID
-		ingestedLog := kafkaMsg.Payload
+	c.flightsMu.Lock()
+	first := c.flights[key]
+	duplicate := c.dedup.Seen(key)
+	if !duplicate {
+		first = &flight{done: make(chan struct{})}
+		c.flights[key] = first
+	}
+	c.flightsMu.Unlock()
 
-		logID := uuid.NewString()
-		timestamp := time.Now().Unix()
+	if duplicate {
+		log.Printf("INFO: skipping duplicate log %s for project %s", logID, projectID)
+		return func() error {
+			if first != nil {
+				<-first.done
+				if first.err != nil {
+					return first.err
+				}
+			}
+			c.ack(kafkaMsg)
+			return nil
+		}
+	}
 
-		go c.writeToCassandra(projectID, ingestedLog, logID, timestamp)
-		go c.writeToClickHouse(projectID, ingestedLog, logID, timestamp)
+	l.Searchable = sink.SearchableValues(l.Payload, c.searchableKeys.Keys(ctx, projectID))
+	wait := c.write(ctx, l)
+	return func() error {
+		storeErr := wait()
+		if storeErr != nil {
+			// Let a redelivery of this log be written again.
+			c.dedup.Forget(key)
+		}
+		c.flightsMu.Lock()
+		// A forgotten key may already belong to a redelivered copy.
+		if c.flights[key] == first {
+			delete(c.flights, key)
+		}
+		c.flightsMu.Unlock()
+		first.err = storeErr
+		close(first.done)
+
+		if storeErr != nil {
+			return storeErr
+		}
+		c.ack(kafkaMsg)
+		return nil
 	}
 }
 
-func (c *Consumer) writeToCassandra(projectID string, logData IngestedLog, logID string, ts int64) {
-	payload := database.LogPayload{
-		ProjectID: projectID,
-		LogID:     logID,
-		EventName: logData.EventName,
-		Timestamp: ts,
-		Payload:   convertPayload(logData.Payload),
+// ack records that a log was stored if its client waits with ack=stored.
+func (c *Consumer) ack(kafkaMsg *KafkaMessage) {
+	if kafkaMsg.Ack != database.AckStored {
+		return
 	}
-	if err := c.cassandraClient.WriteLog(payload); err != nil {
-		log.Printf("ERROR: could not write to Cassandra: %v", err)
+	if err := c.acks.WriteAck(context.Background(), kafkaMsg.ProjectID, kafkaMsg.LogID, database.AckStored, ""); err != nil {
+		log.Printf("ERROR: could not record ack for log %s: %v", kafkaMsg.LogID, err)
 	}
 }
 
-func (c *Consumer) writeToClickHouse(projectID string, logData IngestedLog, logID string, ts int64) {
-	var searchableKey string
-	if key, ok := logData.Payload["searchable_key_1"].(string); ok {
-		searchableKey = key
+// decode turns a message into the log the sinks store, without its
+// searchable values, which need the project's keys.
+func decode(msg kafka.Message) (*KafkaMessage, sink.Log, error) {
+	var kafkaMsg KafkaMessage
+	if err := json.Unmarshal(msg.Value, &kafkaMsg); err != nil {
+		return nil, sink.Log{}, fmt.Errorf("%w: %v", errUndecodable, err)
+	}
+	ingestedLog := kafkaMsg.Payload
+	payload, err := sink.DecodePayload(ingestedLog.Payload)
+	if err != nil {
+		return nil, sink.Log{}, fmt.Errorf("%w: payload: %v", errUndecodable, err)
+	}
+
+	logID := kafkaMsg.LogID
+	if logID == "" {
+		source := fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+		logID = uuid.NewSHA1(legacyLogIDNamespace, []byte(source)).String()
 	}
 
-	index := database.LogIndex{
-		ProjectID:    projectID,
-		LogID:        logID,
-		EventName:    logData.EventName,
-		Timestamp:    ts,
-		SearchableKey: searchableKey,
+	ingestedAt := kafkaMsg.IngestedAt
+	if ingestedAt == 0 {
+		ingestedAt = msg.Time.UnixMilli()
 	}
-	if err := c.clickhouseClient.WriteLog(index); err != nil {
-		log.Printf("ERROR: could not write to ClickHouse: %v", err)
+	timestamp := kafkaMsg.EventTime
+	if timestamp == 0 {
+		timestamp = ingestedAt
+	}
+
+	return &kafkaMsg, sink.Log{
+		ProjectID:  kafkaMsg.ProjectID,
+		LogID:      logID,
+		EventName:  ingestedLog.EventName,
+		Timestamp:  timestamp,
+		IngestedAt: ingestedAt,
+		Payload:    payload,
+		RawPayload: sink.RawPayload(ingestedLog.Payload),
+		Fields:     sink.Flatten(payload),
+	}, nil
+}
+
+// write hands a log to every sink and returns a function that waits for
+// the writes, retrying each sink's failures on its own, and returns the
+// joined errors of the sinks that gave up. A write in progress when ctx is
+// cancelled is finished, so shutdown does not drop rows waiting for a
+// batch; only further retries are abandoned.
+func (c *Consumer) write(ctx context.Context, l sink.Log) func() error {
+	writeCtx := context.WithoutCancel(ctx)
+	firsts := make([]<-chan error, len(c.sinks))
+	for i, s := range c.sinks {
+		// A write that cannot start now is started by withRetry.
+		if c.breakers[i].acquire(ctx) == nil {
+			firsts[i] = s.Write(writeCtx, l)
+		}
+	}
+	return func() error {
+		errs := make([]error, len(c.sinks))
+		var wg sync.WaitGroup
+		for i, s := range c.sinks {
+			wg.Add(1)
+			go func(i int, s sink.LogSink) {
+				defer wg.Done()
+				errs[i] = c.withRetry(ctx, c.breakers[i], firsts[i], func() <-chan error {
+					return s.Write(writeCtx, l)
+				})
+			}(i, s)
+		}
+		wg.Wait()
+		return errors.Join(errs...)
 	}
 }
 
-func convertPayload(payload map[string]interface{}) map[string]string {
-	stringPayload := make(map[string]string)
-	for key, value := range payload {
-		stringPayload[key] = fmt.Sprintf("%v", value)
+// store writes a log to every sink and waits until it is stored.
+func (c *Consumer) store(ctx context.Context, l sink.Log) error {
+	return c.write(ctx, l)()
+}
+
+// Health checks every sink, returning their errors by name.
+func (c *Consumer) Health(ctx context.Context) map[string]error {
+	health := make(map[string]error, len(c.sinks))
+	for _, s := range c.sinks {
+		health[s.Name()] = s.Health(ctx)
 	}
-	return stringPayload
-}
\ No newline at end of file
+	return health
+}
@@ -0,0 +1,246 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/segmentio/kafka-go"
+	"log-analysis-system/consumer/config"
+	"log-analysis-system/consumer/database"
+	"log-analysis-system/consumer/sink"
+)
+
+type fakeAcks struct {
+	mu   sync.Mutex
+	acks []string
+}
+
+func (f *fakeAcks) WriteAck(ctx context.Context, projectID, logID, status, errMsg string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acks = append(f.acks, logID+" "+status)
+	return nil
+}
+
+func (f *fakeAcks) recorded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.acks...)
+}
+
+type fakeKeys []string
+
+func (k fakeKeys) Keys(ctx context.Context, projectID string) []string { return k }
+
+func newTestConsumer(acks *fakeAcks, sinks ...sink.LogSink) *Consumer {
+	retryCfg := config.RetryConfig{
+		BaseDelay:          time.Millisecond,
+		MaxDelay:           time.Millisecond,
+		BreakerThreshold:   100,
+		BreakerCooldown:    time.Millisecond,
+		BreakerMaxCooldown: time.Millisecond,
+	}
+	breakers := make([]*breaker, len(sinks))
+	for i, s := range sinks {
+		breakers[i] = newBreaker(s.Name(), retryCfg)
+	}
+	return &Consumer{
+		sinks:          sinks,
+		breakers:       breakers,
+		acks:           acks,
+		searchableKeys: fakeKeys{"user.id"},
+		dedup:          NewDeduplicator(time.Minute),
+		flights:        make(map[string]*flight),
+		maxAttempts:    3,
+		backoff:        backoff{base: retryCfg.BaseDelay, max: retryCfg.MaxDelay},
+	}
+}
+
+func message(t *testing.T, offset int64, m KafkaMessage) kafka.Message {
+	t.Helper()
+	value, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kafka.Message{
+		Topic:     "logs",
+		Partition: 1,
+		Offset:    offset,
+		Time:      time.UnixMilli(1700000000000),
+		Value:     value,
+	}
+}
+
+func checkout(logID, ack string) KafkaMessage {
+	return KafkaMessage{
+		ProjectID:  "p1",
+		LogID:      logID,
+		EventTime:  1699999999000,
+		IngestedAt: 1700000000000,
+		Payload: IngestedLog{
+			EventName: "checkout",
+			Payload:   json.RawMessage(`{"user": {"id": 42}, "total": 9.5}`),
+		},
+		Ack: ack,
+	}
+}
+
+func TestHandleMessageStoresEverySink(t *testing.T) {
+	a, b := sink.NewMemory(), sink.NewMemory()
+	acks := &fakeAcks{}
+	c := newTestConsumer(acks, a, b)
+
+	if err := c.handleMessage(context.Background(), message(t, 1, checkout("l1", database.AckStored)))(); err != nil {
+		t.Fatalf("handleMessage() = %v", err)
+	}
+	for _, m := range []*sink.Memory{a, b} {
+		logs := m.Logs()
+		if len(logs) != 1 {
+			t.Fatalf("sink stored %d logs, want 1", len(logs))
+		}
+		l := logs[0]
+		if l.ProjectID != "p1" || l.LogID != "l1" || l.EventName != "checkout" || l.Timestamp != 1699999999000 || l.IngestedAt != 1700000000000 {
+			t.Errorf("stored %+v", l)
+		}
+		if want := map[string]string{"user.id": "42"}; !reflect.DeepEqual(l.Searchable, want) {
+			t.Errorf("Searchable = %v, want %v", l.Searchable, want)
+		}
+		if want := map[string]interface{}{"user.id": json.Number("42"), "total": json.Number("9.5")}; !reflect.DeepEqual(l.Fields, want) {
+			t.Errorf("Fields = %v, want %v", l.Fields, want)
+		}
+		if string(l.RawPayload) != `{"user":{"id":42},"total":9.5}` {
+			t.Errorf("RawPayload = %s", l.RawPayload)
+		}
+	}
+	if got, want := acks.recorded(), []string{"l1 stored"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("acks = %v, want %v", got, want)
+	}
+}
+
+func TestHandleMessageLegacy(t *testing.T) {
+	m := sink.NewMemory()
+	c := newTestConsumer(&fakeAcks{}, m)
+	// Messages published before log IDs and event times existed.
+	legacy := KafkaMessage{ProjectID: "p1", Payload: IngestedLog{EventName: "old", Payload: json.RawMessage(`{}`)}}
+	for i := 0; i < 2; i++ {
+		c.dedup = NewDeduplicator(time.Minute)
+		if err := c.handleMessage(context.Background(), message(t, 7, legacy))(); err != nil {
+			t.Fatalf("handleMessage() = %v", err)
+		}
+	}
+	logs := m.Logs()
+	if len(logs) != 2 || logs[0].LogID == "" || logs[0].LogID != logs[1].LogID {
+		t.Fatalf("a redelivered legacy message got log IDs %q and %q", logs[0].LogID, logs[1].LogID)
+	}
+	if logs[0].Timestamp != 1700000000000 || logs[0].IngestedAt != 1700000000000 {
+		t.Errorf("timestamp %d, ingested at %d; want the message time", logs[0].Timestamp, logs[0].IngestedAt)
+	}
+}
+
+func TestHandleMessageUndecodable(t *testing.T) {
+	m := sink.NewMemory()
+	c := newTestConsumer(&fakeAcks{}, m)
+	for _, value := range []string{`not json`, `{"project_id": "p1", "payload": {"event_name": "x", "payload": [1]}}`} {
+		err := c.handleMessage(context.Background(), kafka.Message{Value: []byte(value)})()
+		if !errors.Is(err, errUndecodable) {
+			t.Errorf("handleMessage(%s) = %v, want errUndecodable", value, err)
+		}
+	}
+	if n := len(m.Logs()); n != 0 {
+		t.Errorf("stored %d undecodable logs", n)
+	}
+}
+
+func TestHandleMessageDuplicate(t *testing.T) {
+	m := sink.NewMemory()
+	acks := &fakeAcks{}
+	c := newTestConsumer(acks, m)
+	ctx := context.Background()
+
+	first := c.handleMessage(ctx, message(t, 1, checkout("l1", database.AckStored)))
+	// The copy arrives while the first is still being stored and is acked
+	// once the first is.
+	dup := c.handleMessage(ctx, message(t, 2, checkout("l1", database.AckStored)))
+	if err := first(); err != nil {
+		t.Fatalf("first copy: %v", err)
+	}
+	if err := dup(); err != nil {
+		t.Fatalf("duplicate: %v", err)
+	}
+	// A copy after the first was stored is acked at once.
+	if err := c.handleMessage(ctx, message(t, 3, checkout("l1", database.AckStored)))(); err != nil {
+		t.Fatalf("late duplicate: %v", err)
+	}
+
+	if n := len(m.Logs()); n != 1 {
+		t.Errorf("stored %d copies, want 1", n)
+	}
+	if got, want := acks.recorded(), []string{"l1 stored", "l1 stored", "l1 stored"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("acks = %v, want %v", got, want)
+	}
+}
+
+func TestHandleMessageRetries(t *testing.T) {
+	transient := errors.New("connection reset")
+	permanent := fmt.Errorf("bad row: %w", clickhouse.ErrBatchInvalid)
+	tests := []struct {
+		name     string
+		failures []error
+		stored   int
+		attempts int // of the *storeError, 0 if the log is stored
+	}{
+		{"transient then stored", []error{transient, transient}, 1, 0},
+		{"transient past max attempts", []error{transient, transient, transient}, 0, 3},
+		{"permanent is not retried", []error{permanent}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, failing := sink.NewMemory(), sink.NewMemory()
+			failing.FailNext(tt.failures...)
+			acks := &fakeAcks{}
+			c := newTestConsumer(acks, ok, failing)
+			ctx := context.Background()
+
+			err := c.handleMessage(ctx, message(t, 1, checkout("l1", database.AckStored)))()
+			var se *storeError
+			if tt.attempts == 0 {
+				if err != nil {
+					t.Fatalf("handleMessage() = %v", err)
+				}
+			} else if !errors.As(err, &se) || se.attempts != tt.attempts {
+				t.Fatalf("handleMessage() = %v, want a storeError after %d attempts", err, tt.attempts)
+			}
+			if n := len(failing.Logs()); n != tt.stored {
+				t.Errorf("failing sink stored %d logs, want %d", n, tt.stored)
+			}
+			if n := len(ok.Logs()); n != 1 {
+				t.Errorf("healthy sink stored %d logs, want 1", n)
+			}
+			if tt.attempts == 0 {
+				if got := acks.recorded(); !reflect.DeepEqual(got, []string{"l1 stored"}) {
+					t.Errorf("acks = %v", got)
+				}
+				return
+			}
+
+			// The failure is acked by the dead-letter path, not here, and
+			// a redelivery is written again.
+			if got := acks.recorded(); len(got) != 0 {
+				t.Errorf("acks = %v, want none", got)
+			}
+			if err := c.handleMessage(ctx, message(t, 1, checkout("l1", database.AckStored)))(); err != nil {
+				t.Fatalf("redelivery: %v", err)
+			}
+			if n := len(failing.Logs()); n != 1 {
+				t.Errorf("redelivery stored %d logs, want 1", n)
+			}
+		})
+	}
+}
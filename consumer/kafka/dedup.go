@@ -0,0 +1,73 @@
+package kafka
+
+import (
+	"sync"
+	"time"
+)
+
+// Deduplicator remembers recently seen log keys for a fixed window. Keys are
+// expired in insertion order, so a queue is enough to keep the map bounded.
+// It only saves the stores repeated writes: both key logs by ID, so a copy
+// it misses (after a restart, say) still replaces the log rather than
+// adding one.
+type Deduplicator struct {
+	window time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []dedupEntry
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+func NewDeduplicator(window time.Duration) *Deduplicator {
+	return &Deduplicator{
+		window: window,
+		now:    time.Now,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Seen reports whether key was recorded within the window, and records it if
+// not. A zero window disables deduplication.
+func (d *Deduplicator) Seen(key string) bool {
+	if d.window <= 0 {
+		return false
+	}
+	now := d.now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+	if expires, ok := d.seen[key]; ok && now.Before(expires) {
+		return true
+	}
+	expires := now.Add(d.window)
+	d.seen[key] = expires
+	d.order = append(d.order, dedupEntry{key: key, expires: expires})
+	return false
+}
+
+// Forget drops key, so a log that failed to store is written again when it
+// is redelivered. Its entry in the expiry queue is skipped when it expires.
+func (d *Deduplicator) Forget(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, key)
+}
+
+func (d *Deduplicator) expire(now time.Time) {
+	i := 0
+	for ; i < len(d.order) && !now.Before(d.order[i].expires); i++ {
+		// A forgotten key may have been seen again with a later expiry.
+		if d.seen[d.order[i].key].Equal(d.order[i].expires) {
+			delete(d.seen, d.order[i].key)
+		}
+	}
+	d.order = d.order[i:]
+}
@@ -0,0 +1,92 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicator(t *testing.T) {
+	type step struct {
+		at     time.Duration // since the start
+		op     string        // "seen" or "forget"
+		key    string
+		want   bool // for "seen"
+		queued int  // entries left in the expiry queue after the step
+	}
+	tests := []struct {
+		name   string
+		window time.Duration
+		steps  []step
+	}{
+		{
+			name:   "repeat within the window",
+			window: time.Minute,
+			steps: []step{
+				{at: 0, op: "seen", key: "a", want: false, queued: 1},
+				{at: 30 * time.Second, op: "seen", key: "a", want: true, queued: 1},
+				{at: 30 * time.Second, op: "seen", key: "b", want: false, queued: 2},
+			},
+		},
+		{
+			name:   "expires at the end of the window",
+			window: time.Minute,
+			steps: []step{
+				{at: 0, op: "seen", key: "a", want: false, queued: 1},
+				{at: time.Minute - time.Nanosecond, op: "seen", key: "a", want: true, queued: 1},
+				{at: time.Minute, op: "seen", key: "a", want: false, queued: 1},
+			},
+		},
+		{
+			name:   "forget lets a key through again",
+			window: time.Minute,
+			steps: []step{
+				{at: 0, op: "seen", key: "a", want: false, queued: 1},
+				{at: time.Second, op: "forget", key: "a", queued: 1},
+				{at: 2 * time.Second, op: "seen", key: "a", want: false, queued: 2},
+				{at: 3 * time.Second, op: "seen", key: "a", want: true, queued: 2},
+			},
+		},
+		{
+			name:   "stale queue entry of a forgotten key keeps the new one",
+			window: time.Minute,
+			steps: []step{
+				{at: 0, op: "seen", key: "a", want: false, queued: 1},
+				{at: time.Second, op: "forget", key: "a", queued: 1},
+				{at: 10 * time.Second, op: "seen", key: "a", want: false, queued: 2},
+				// The first entry expires here, but "a" was seen again since.
+				{at: time.Minute + time.Second, op: "seen", key: "a", want: true, queued: 1},
+				{at: time.Minute + 10*time.Second, op: "seen", key: "a", want: false, queued: 1},
+			},
+		},
+		{
+			name:   "zero window never deduplicates",
+			window: 0,
+			steps: []step{
+				{at: 0, op: "seen", key: "a", want: false},
+				{at: 0, op: "seen", key: "a", want: false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			var now time.Time
+			d := NewDeduplicator(tt.window)
+			d.now = func() time.Time { return now }
+			for i, s := range tt.steps {
+				now = start.Add(s.at)
+				switch s.op {
+				case "seen":
+					if got := d.Seen(s.key); got != s.want {
+						t.Errorf("step %d: Seen(%q) = %v, want %v", i, s.key, got, s.want)
+					}
+				case "forget":
+					d.Forget(s.key)
+				}
+				if len(d.order) != s.queued {
+					t.Errorf("step %d: %d queued entries, want %d", i, len(d.order), s.queued)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// pendingOffset is a fetched message that has not been stored yet.
+type pendingOffset struct {
+	msg  kafka.Message
+	done bool
+}
+
+// offsetTracker keeps the fetched messages of each partition in fetch order,
+// so an offset is committed only once it and every earlier offset in its
+// partition have been stored.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[int][]*pendingOffset
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[int][]*pendingOffset)}
+}
+
+// track records a fetched message. It must be called in fetch order.
+func (t *offsetTracker) track(msg kafka.Message) *pendingOffset {
+	p := &pendingOffset{msg: msg}
+	t.mu.Lock()
+	t.partitions[msg.Partition] = append(t.partitions[msg.Partition], p)
+	t.mu.Unlock()
+	return p
+}
+
+// complete marks p as stored and returns the newest message of its partition
+// that can now be committed, if any.
+func (t *offsetTracker) complete(p *pendingOffset) (kafka.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p.done = true
+	pending := t.partitions[p.msg.Partition]
+	i := 0
+	for ; i < len(pending) && pending[i].done; i++ {
+	}
+	if i == 0 {
+		return kafka.Message{}, false
+	}
+	last := pending[i-1].msg
+	t.partitions[p.msg.Partition] = pending[i:]
+	return last, true
+}
@@ -0,0 +1,77 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	type msg struct{ partition, offset int }
+	tests := []struct {
+		name     string
+		fetched  []msg
+		complete []int // indexes into fetched, in completion order
+		// commits[i] is the offset committed after complete[i], or -1 for none.
+		commits []int64
+		left    map[int]int // pending messages per partition at the end
+	}{
+		{
+			name:     "in order",
+			fetched:  []msg{{0, 1}, {0, 2}, {0, 3}},
+			complete: []int{0, 1, 2},
+			commits:  []int64{1, 2, 3},
+			left:     map[int]int{0: 0},
+		},
+		{
+			name:     "out of order waits for the gap",
+			fetched:  []msg{{0, 1}, {0, 2}, {0, 3}},
+			complete: []int{2, 1, 0},
+			commits:  []int64{-1, -1, 3},
+			left:     map[int]int{0: 0},
+		},
+		{
+			name:     "gap in the middle",
+			fetched:  []msg{{0, 1}, {0, 2}, {0, 3}, {0, 4}},
+			complete: []int{0, 2, 3, 1},
+			commits:  []int64{1, -1, -1, 4},
+			left:     map[int]int{0: 0},
+		},
+		{
+			name:     "partitions are independent",
+			fetched:  []msg{{0, 10}, {1, 20}, {0, 11}, {1, 21}},
+			complete: []int{1, 3, 2},
+			commits:  []int64{20, 21, -1},
+			left:     map[int]int{0: 2, 1: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newOffsetTracker()
+			pending := make([]*pendingOffset, len(tt.fetched))
+			for i, m := range tt.fetched {
+				pending[i] = tr.track(kafka.Message{Partition: m.partition, Offset: int64(m.offset)})
+			}
+			for i, idx := range tt.complete {
+				got, ok := tr.complete(pending[idx])
+				want := tt.commits[i]
+				switch {
+				case want < 0 && ok:
+					t.Errorf("complete #%d: committed offset %d, want none", i, got.Offset)
+				case want >= 0 && !ok:
+					t.Errorf("complete #%d: nothing to commit, want offset %d", i, want)
+				case want >= 0 && got.Offset != want:
+					t.Errorf("complete #%d: committed offset %d, want %d", i, got.Offset, want)
+				}
+				if ok && got.Partition != pending[idx].msg.Partition {
+					t.Errorf("complete #%d: committed partition %d, want %d", i, got.Partition, pending[idx].msg.Partition)
+				}
+			}
+			for partition, n := range tt.left {
+				if got := len(tr.partitions[partition]); got != n {
+					t.Errorf("partition %d has %d pending, want %d", partition, got, n)
+				}
+			}
+		})
+	}
+}
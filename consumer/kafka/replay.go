@@ -0,0 +1,411 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"log-analysis-system/consumer/config"
+	"log-analysis-system/consumer/database"
+	"log-analysis-system/consumer/sink"
+)
+
+// ReplayOptions selects what Replay reads and where its progress is kept.
+type ReplayOptions struct {
+	// GroupID is the consumer group replay progress is committed to. It
+	// must differ from the live consumer's group.
+	GroupID string
+	// From is where each partition starts: "committed" for the group's
+	// committed offsets (the start of the topic for partitions it has none
+	// for), "earliest", an offset, an RFC3339 time, or a duration ago such
+	// as "6h".
+	From string
+	// Projects and Events, when not empty, limit which logs are written.
+	Projects map[string]bool
+	Events   map[string]bool
+	// DryRun reads and counts the matching logs without writing them or
+	// committing offsets.
+	DryRun bool
+	// Progress is how often progress is logged and offsets committed.
+	Progress time.Duration
+}
+
+// ReplayStats counts what a replay did. Events counts matching logs by
+// event name.
+type ReplayStats struct {
+	Total    int64
+	Read     int64
+	Matched  int64
+	Skipped  int64
+	Replayed int64
+	Failed   int64
+	Events   map[string]int64
+}
+
+// replayRange is the part of one partition a replay reads: from start up to,
+// but not including, end.
+type replayRange struct {
+	partition  int
+	start, end int64
+}
+
+// replayer holds the state of one Replay call.
+type replayer struct {
+	cfg      config.KafkaConfig
+	opts     ReplayOptions
+	consumer *Consumer
+	client   *kafka.Client
+
+	total, read, matched, skipped, replayed, failed atomic.Int64
+
+	mu     sync.Mutex
+	events map[string]int64
+	// committable is the next offset to commit for each partition.
+	committable map[int]int64
+}
+
+// Replay reads the topic from opts.From up to the end offsets it finds when
+// it starts, and writes the matching logs to sinks. Writes are retried like
+// the live consumer's, but a log that still fails is counted and left out
+// rather than dead-lettered, and no stored acks are written. Progress is
+// committed to opts.GroupID, so an interrupted replay can be continued with
+// From "committed". Sinks and keys may be nil for a dry run.
+func Replay(ctx context.Context, cfg config.KafkaConfig, retryCfg config.RetryConfig, sinks []sink.LogSink, keys *database.SearchableKeyCache, opts ReplayOptions) (*ReplayStats, error) {
+	if opts.GroupID == "" || opts.GroupID == cfg.GroupID {
+		return nil, fmt.Errorf("replay group must differ from the live group %q", cfg.GroupID)
+	}
+	breakers := make([]*breaker, len(sinks))
+	for i, s := range sinks {
+		breakers[i] = newBreaker(s.Name(), retryCfg)
+	}
+	r := &replayer{
+		cfg:  cfg,
+		opts: opts,
+		consumer: &Consumer{
+			sinks:          sinks,
+			breakers:       breakers,
+			searchableKeys: keys,
+			maxAttempts:    cfg.MaxAttempts,
+			backoff:        backoff{base: retryCfg.BaseDelay, max: retryCfg.MaxDelay},
+		},
+		client:      &kafka.Client{Addr: kafka.TCP(cfg.Brokers...)},
+		events:      make(map[string]int64),
+		committable: make(map[int]int64),
+	}
+
+	ranges, err := r.ranges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, rg := range ranges {
+		r.total.Add(rg.end - rg.start)
+	}
+	log.Printf("INFO: replaying %d message(s) from %d partition(s) of %s as group %s", r.total.Load(), len(ranges), cfg.Topic, opts.GroupID)
+
+	progressDone := make(chan struct{})
+	var progress sync.WaitGroup
+	progress.Add(1)
+	go func() {
+		defer progress.Done()
+		r.reportProgress(progressDone)
+	}()
+
+	// Writes share one pool of workers across partitions, so rows from
+	// several partitions can fill the same ClickHouse batch.
+	slots := make(chan struct{}, cfg.Workers)
+	errs := make([]error, len(ranges))
+	var readers sync.WaitGroup
+	for i, rg := range ranges {
+		readers.Add(1)
+		go func(i int, rg replayRange) {
+			defer readers.Done()
+			errs[i] = r.replayPartition(ctx, rg, slots)
+		}(i, rg)
+	}
+	readers.Wait()
+	close(progressDone)
+	progress.Wait()
+
+	if err := r.commit(context.Background()); err != nil {
+		log.Printf("ERROR: could not commit replay offsets: %v", err)
+	}
+	r.logProgress()
+	return r.stats(), errors.Join(errs...)
+}
+
+// ranges finds where each partition starts and ends.
+func (r *replayer) ranges(ctx context.Context) ([]replayRange, error) {
+	conn, err := kafka.DialContext(ctx, "tcp", r.cfg.Brokers[0])
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := conn.ReadPartitions(r.cfg.Topic)
+	conn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("could not read partitions of %s: %w", r.cfg.Topic, err)
+	}
+
+	var committed map[int]int64
+	if r.opts.From == "committed" {
+		ids := make([]int, len(partitions))
+		for i, p := range partitions {
+			ids[i] = p.ID
+		}
+		if committed, err = r.committedOffsets(ctx, ids); err != nil {
+			return nil, err
+		}
+	}
+
+	var ranges []replayRange
+	for _, p := range partitions {
+		leader, err := kafka.DialLeader(ctx, "tcp", r.cfg.Brokers[0], r.cfg.Topic, p.ID)
+		if err != nil {
+			return nil, err
+		}
+		first, last, err := leader.ReadOffsets()
+		if err != nil {
+			leader.Close()
+			return nil, err
+		}
+		start, err := r.startOffset(leader, first, committed, p.ID)
+		leader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %w", p.ID, err)
+		}
+		if start < first {
+			start = first
+		}
+		if start < last {
+			ranges = append(ranges, replayRange{partition: p.ID, start: start, end: last})
+		}
+	}
+	return ranges, nil
+}
+
+// startOffset resolves opts.From for one partition.
+func (r *replayer) startOffset(leader *kafka.Conn, first int64, committed map[int]int64, partition int) (int64, error) {
+	from := r.opts.From
+	switch from {
+	case "committed":
+		if off, ok := committed[partition]; ok && off >= 0 {
+			return off, nil
+		}
+		return first, nil
+	case "earliest":
+		return first, nil
+	}
+	if off, err := strconv.ParseInt(from, 10, 64); err == nil {
+		return off, nil
+	}
+	if t, err := time.Parse(time.RFC3339, from); err == nil {
+		return leader.ReadOffset(t)
+	}
+	if d, err := time.ParseDuration(from); err == nil {
+		return leader.ReadOffset(time.Now().Add(-d))
+	}
+	return 0, fmt.Errorf("invalid start %q, want committed, earliest, an offset, an RFC3339 time or a duration", from)
+}
+
+func (r *replayer) committedOffsets(ctx context.Context, partitions []int) (map[int]int64, error) {
+	resp, err := r.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: r.opts.GroupID,
+		Topics:  map[string][]int{r.cfg.Topic: partitions},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch offsets of group %s: %w", r.opts.GroupID, err)
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("could not fetch offsets of group %s: %w", r.opts.GroupID, resp.Error)
+	}
+	offsets := make(map[int]int64)
+	for _, p := range resp.Topics[r.cfg.Topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("could not fetch offset of partition %d: %w", p.Partition, p.Error)
+		}
+		offsets[p.Partition] = p.CommittedOffset
+	}
+	return offsets, nil
+}
+
+// replayPartition reads one partition range, handing each matching log to
+// a worker slot. It returns once every write it started has finished.
+func (r *replayer) replayPartition(ctx context.Context, rg replayRange, slots chan struct{}) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   r.cfg.Brokers,
+		Topic:     r.cfg.Topic,
+		Partition: rg.partition,
+	})
+	defer reader.Close()
+	if err := reader.SetOffset(rg.start); err != nil {
+		return err
+	}
+
+	tracker := newOffsetTracker()
+	var writes sync.WaitGroup
+	defer writes.Wait()
+	for offset := rg.start; offset < rg.end; {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("could not read partition %d: %w", rg.partition, err)
+		}
+		offset = msg.Offset + 1
+		r.read.Add(1)
+		p := tracker.track(msg)
+
+		_, l, err := decode(msg)
+		if err != nil {
+			log.Printf("ERROR: skipping message at partition %d offset %d: %v", msg.Partition, msg.Offset, err)
+			r.failed.Add(1)
+			r.done(tracker, p)
+			continue
+		}
+		if !r.matches(l) {
+			r.skipped.Add(1)
+			r.done(tracker, p)
+			continue
+		}
+		r.matched.Add(1)
+		r.mu.Lock()
+		r.events[l.EventName]++
+		r.mu.Unlock()
+		if r.opts.DryRun {
+			r.done(tracker, p)
+			continue
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		writes.Add(1)
+		go func() {
+			defer writes.Done()
+			defer func() { <-slots }()
+			l.Searchable = sink.SearchableValues(l.Payload, r.consumer.searchableKeys.Keys(ctx, l.ProjectID))
+			if err := r.consumer.store(ctx, l); err != nil {
+				if ctx.Err() != nil {
+					// Left uncommitted, so a resumed replay writes it again.
+					return
+				}
+				log.Printf("ERROR: could not replay log %s at partition %d offset %d: %v", l.LogID, p.msg.Partition, p.msg.Offset, err)
+				r.failed.Add(1)
+			} else {
+				r.replayed.Add(1)
+			}
+			r.done(tracker, p)
+		}()
+	}
+	return nil
+}
+
+func (r *replayer) matches(l sink.Log) bool {
+	if len(r.opts.Projects) > 0 && !r.opts.Projects[l.ProjectID] {
+		return false
+	}
+	if len(r.opts.Events) > 0 && !r.opts.Events[l.EventName] {
+		return false
+	}
+	return true
+}
+
+// done marks a message as handled and moves its partition's committable
+// offset past every handled message before it.
+func (r *replayer) done(tracker *offsetTracker, p *pendingOffset) {
+	msg, ok := tracker.complete(p)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	r.committable[msg.Partition] = msg.Offset + 1
+	r.mu.Unlock()
+}
+
+// commit publishes the committable offsets to the replay group. A dry run
+// commits nothing.
+func (r *replayer) commit(ctx context.Context) error {
+	if r.opts.DryRun {
+		return nil
+	}
+	r.mu.Lock()
+	offsets := make([]kafka.OffsetCommit, 0, len(r.committable))
+	for partition, offset := range r.committable {
+		offsets = append(offsets, kafka.OffsetCommit{Partition: partition, Offset: offset})
+	}
+	r.mu.Unlock()
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	// Generation -1 commits as a standalone consumer, outside any group
+	// membership.
+	resp, err := r.client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      r.opts.GroupID,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{r.cfg.Topic: offsets},
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range resp.Topics[r.cfg.Topic] {
+		if p.Error != nil {
+			return fmt.Errorf("partition %d: %w", p.Partition, p.Error)
+		}
+	}
+	return nil
+}
+
+// reportProgress logs progress and commits offsets every opts.Progress
+// until done is closed.
+func (r *replayer) reportProgress(done <-chan struct{}) {
+	t := time.NewTicker(r.opts.Progress)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			r.logProgress()
+			if err := r.commit(context.Background()); err != nil {
+				log.Printf("ERROR: could not commit replay offsets: %v", err)
+			}
+		}
+	}
+}
+
+func (r *replayer) logProgress() {
+	total, read := r.total.Load(), r.read.Load()
+	pct := 100.0
+	if total > 0 {
+		pct = float64(read) * 100 / float64(total)
+	}
+	log.Printf("INFO: replay: read %d/%d (%.1f%%), matched %d, skipped %d, replayed %d, failed %d",
+		read, total, pct, r.matched.Load(), r.skipped.Load(), r.replayed.Load(), r.failed.Load())
+}
+
+func (r *replayer) stats() *ReplayStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make(map[string]int64, len(r.events))
+	for k, v := range r.events {
+		events[k] = v
+	}
+	return &ReplayStats{
+		Total:    r.total.Load(),
+		Read:     r.read.Load(),
+		Matched:  r.matched.Load(),
+		Skipped:  r.skipped.Load(),
+		Replayed: r.replayed.Load(),
+		Failed:   r.failed.Load(),
+		Events:   events,
+	}
+}
@@ -0,0 +1,178 @@
+package kafka
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"log-analysis-system/consumer/config"
+)
+
+// backoff spaces out retries exponentially, with full jitter so workers that
+// failed together do not retry together.
+type backoff struct {
+	base time.Duration
+	max  time.Duration
+}
+
+// delay is the wait before retry number attempt (1 for the first retry).
+func (b backoff) delay(attempt int) time.Duration {
+	d := b.base
+	for i := 1; i < attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is a circuit breaker for one sink. It opens after threshold
+// consecutive transient failures. While it is open, writes to the sink wait
+// and the consumer stops fetching. After the cooldown one write is let
+// through as a probe: success closes the breaker, failure opens it again
+// with a longer cooldown.
+type breaker struct {
+	name        string
+	threshold   int
+	minCooldown time.Duration
+	maxCooldown time.Duration
+	now         func() time.Time
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+	probing   bool
+	// changed is closed and replaced whenever the state changes.
+	changed chan struct{}
+}
+
+func newBreaker(name string, cfg config.RetryConfig) *breaker {
+	return &breaker{
+		name:        name,
+		threshold:   cfg.BreakerThreshold,
+		minCooldown: cfg.BreakerCooldown,
+		maxCooldown: cfg.BreakerMaxCooldown,
+		cooldown:    cfg.BreakerCooldown,
+		now:         time.Now,
+		changed:     make(chan struct{}),
+	}
+}
+
+// acquire waits until a write to the sink is allowed: immediately while the
+// breaker is closed, or as the probe once an open breaker's cooldown ends.
+func (b *breaker) acquire(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		if b.state == breakerOpen && !b.now().Before(b.openUntil) {
+			b.setState(breakerHalfOpen)
+		}
+		switch {
+		case b.state == breakerClosed:
+			b.mu.Unlock()
+			return nil
+		case b.state == breakerHalfOpen && !b.probing:
+			b.probing = true
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		wait := b.openUntil.Sub(b.now())
+		b.mu.Unlock()
+
+		if err := waitFor(ctx, changed, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// waitClosed waits until the breaker is closed.
+func (b *breaker) waitClosed(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		if b.state == breakerClosed {
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		if err := waitFor(ctx, changed, 0); err != nil {
+			return err
+		}
+	}
+}
+
+// success records that the sink answered, which closes the breaker.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+	b.cooldown = b.minCooldown
+	if b.state != breakerClosed {
+		log.Printf("INFO: %s is back, resuming writes", b.name)
+		b.setState(breakerClosed)
+	}
+}
+
+// failure records a transient failure and reports whether the breaker is
+// now open, i.e. the sink looks down rather than the write being at fault.
+func (b *breaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+		b.probing = false
+		if b.cooldown *= 2; b.cooldown > b.maxCooldown {
+			b.cooldown = b.maxCooldown
+		}
+		b.open()
+	case b.state == breakerClosed && b.failures >= b.threshold:
+		log.Printf("ERROR: %s failed %d times in a row, pausing consumption for %s", b.name, b.failures, b.cooldown)
+		b.open()
+	}
+	return b.state != breakerClosed
+}
+
+func (b *breaker) open() {
+	b.openUntil = b.now().Add(b.cooldown)
+	b.setState(breakerOpen)
+}
+
+// setState must be called with mu held.
+func (b *breaker) setState(s breakerState) {
+	b.state = s
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// waitFor waits for changed to close, for d if it is positive, or for ctx.
+func waitFor(ctx context.Context, changed <-chan struct{}, d time.Duration) error {
+	var timeout <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-changed:
+	case <-timeout:
+	}
+	return nil
+}
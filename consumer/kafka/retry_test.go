@@ -0,0 +1,165 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"log-analysis-system/consumer/config"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := backoff{base: 100 * time.Millisecond, max: time.Second}
+	ceilings := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, ceiling := range ceilings {
+		attempt := i + 1
+		var low, high bool
+		for n := 0; n < 500; n++ {
+			d := b.delay(attempt)
+			if d <= 0 || d > ceiling {
+				t.Fatalf("delay(%d) = %v, want within (0, %v]", attempt, d, ceiling)
+			}
+			low = low || d < ceiling/2
+			high = high || d >= ceiling/2
+		}
+		// Full jitter spreads the delays over the whole range.
+		if !low || !high {
+			t.Errorf("delay(%d) is not jittered over (0, %v]", attempt, ceiling)
+		}
+	}
+	if d := b.delay(1000); d <= 0 || d > time.Second {
+		t.Errorf("delay(1000) = %v, want within (0, 1s]", d)
+	}
+}
+
+// testBreaker returns a breaker on a clock that only moves when told to.
+func testBreaker() (*breaker, *time.Time) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	b := newBreaker("test", config.RetryConfig{
+		BreakerThreshold:   3,
+		BreakerCooldown:    time.Second,
+		BreakerMaxCooldown: 4 * time.Second,
+	})
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+// acquired reports whether acquire lets a write through at once.
+func acquired(b *breaker) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	return b.acquire(ctx) == nil
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b, now := testBreaker()
+	for i := 1; i < 3; i++ {
+		if b.failure() {
+			t.Fatalf("open after %d failures, threshold is 3", i)
+		}
+		if !acquired(b) {
+			t.Fatalf("closed breaker blocked a write after %d failures", i)
+		}
+	}
+	// A success in between starts the count again.
+	b.success()
+	b.failure()
+	b.failure()
+	if b.state != breakerClosed {
+		t.Fatal("open after a success and 2 failures")
+	}
+	if !b.failure() || b.state != breakerOpen {
+		t.Fatal("still closed after 3 failures in a row")
+	}
+	if want := now.Add(time.Second); !b.openUntil.Equal(want) {
+		t.Errorf("open until %v, want %v", b.openUntil, want)
+	}
+	if acquired(b) {
+		t.Error("open breaker let a write through")
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b, now := testBreaker()
+	for i := 0; i < 3; i++ {
+		b.failure()
+	}
+
+	// Each failed probe doubles the cooldown, up to the maximum.
+	for _, cooldown := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		*now = now.Add(cooldown - time.Millisecond)
+		if acquired(b) {
+			t.Fatalf("a write got through before the %v cooldown ended", cooldown)
+		}
+		*now = now.Add(time.Millisecond)
+		if !acquired(b) {
+			t.Fatalf("no probe after the %v cooldown", cooldown)
+		}
+		if b.state != breakerHalfOpen {
+			t.Fatalf("state = %v after the cooldown, want half-open", b.state)
+		}
+		if acquired(b) {
+			t.Fatal("a second write got through while probing")
+		}
+		if !b.failure() || b.state != breakerOpen {
+			t.Fatal("a failed probe did not open the breaker")
+		}
+	}
+
+	*now = now.Add(4 * time.Second)
+	if !acquired(b) {
+		t.Fatal("no probe after the cooldown")
+	}
+	b.success()
+	if b.state != breakerClosed || b.failures != 0 || b.cooldown != time.Second {
+		t.Errorf("after a successful probe: state %v, %d failures, cooldown %v", b.state, b.failures, b.cooldown)
+	}
+	if !acquired(b) || !acquired(b) {
+		t.Error("closed breaker blocked a write")
+	}
+}
+
+func TestBreakerWaitClosed(t *testing.T) {
+	b, now := testBreaker()
+	for i := 0; i < 3; i++ {
+		b.failure()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- b.waitClosed(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("waitClosed returned %v while open", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	*now = now.Add(time.Second)
+	if !acquired(b) {
+		t.Fatal("no probe after the cooldown")
+	}
+	b.success()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("waitClosed() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitClosed did not return once the breaker closed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		b.failure()
+	}
+	if err := b.waitClosed(ctx); err != context.Canceled {
+		t.Errorf("waitClosed(cancelled) = %v, want context.Canceled", err)
+	}
+}
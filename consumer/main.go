@@ -2,34 +2,150 @@ package main
 
 
 import(
+	"context"
+	"encoding/json"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"log-analysis-system/consumer/backfill"
 	"log-analysis-system/consumer/config"
 	"log-analysis-system/consumer/database"
+	"log-analysis-system/consumer/deadletter"
 	"log-analysis-system/consumer/kafka"
+	"log-analysis-system/consumer/sink"
 )
 
 func main(){
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		kafkaCfg, err := config.LoadKafka()
+		if err != nil {
+			log.Fatalf("Could not load config in consumer: %v", err)
+		}
+		if err := deadletter.Run(kafkaCfg, os.Args[2:]); err != nil {
+			log.Fatalf("dlq: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatalf("replay: %v", err)
+		}
+		return
+	}
+
 	cfg, err := config.Load()
 
 	if err != nil{
 		log.Fatalf("Could not load config in consumer: %v",err)
 	}
 
-	clickhouseClient, err := database.NewClickHouseClient(cfg.Clickhouse)
+	sinks, err := sink.Open(cfg)
 	if err != nil {
-		log.Fatalf("Could not connect to ClickHouse: %v", err)
+		log.Fatalf("Could not open sinks: %v", err)
 	}
+	defer func() {
+		if err := sink.CloseAll(sinks); err != nil {
+			log.Printf("ERROR: could not close sinks: %v", err)
+		}
+	}()
 
-
-	cassandraClient, err := database.NewCassandraClient(cfg.Cassandra)
+	cockroachClient, err := database.NewCockroachClient(cfg.Cockroach)
 	if err != nil {
-		log.Fatalf("Could not connect to CassandraHouse: %v", err)
+		log.Fatalf("Could not connect to CockroachDB: %v", err)
 	}
+	defer cockroachClient.Close()
+	searchableKeys := database.NewSearchableKeyCache(cockroachClient, cfg.Cockroach.SearchableKeysRefresh)
+
+	deadLetters := deadletter.NewPublisher(cfg.Kafka)
+	defer deadLetters.Close()
+
+	consumerService := kafka.NewConsumer(cfg.Kafka, cfg.Dedup, cfg.Retry, sinks, cockroachClient, searchableKeys, deadLetters) 
+
+	if cfg.MetricsAddr != "" {
+		// expvar registers /debug/vars on the default mux.
+		http.HandleFunc("/healthz", healthHandler(consumerService))
+		go func() {
+			log.Printf("Serving metrics on %s/debug/vars", cfg.MetricsAddr)
+			if err := http.ListenAndServe(cfg.MetricsAddr, nil); err != nil {
+				log.Printf("ERROR: metrics server stopped: %v", err)
+			}
+		}()
+	}
+
+	// Deferred closes run after Start returns, so the sinks and the
+	// dead-letter writer flush what the workers left them.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	consumerService := kafka.NewConsumer(cfg.Kafka, clickhouseClient, cassandraClient) 
+	var backfills sync.WaitGroup
+	if slices.Contains(cfg.Sinks, "clickhouse") && slices.Contains(cfg.Sinks, "cassandra") {
+		runner, closeRunner, err := newBackfillRunner(cfg, cockroachClient)
+		if err != nil {
+			log.Fatalf("Could not start backfill worker: %v", err)
+		}
+		defer closeRunner()
+		backfills.Add(1)
+		go func() {
+			defer backfills.Done()
+			runner.Run(ctx)
+		}()
+	}
 
 	log.Println("Starting Kafka consumer service...")
-	consumerService.Start()
+	consumerService.Start(ctx)
+	backfills.Wait()
+	log.Println("Kafka consumer service stopped.")
+
+
+}
+
+// newBackfillRunner connects the backfill worker to Cassandra and to a
+// ClickHouse client of its own, so its batches do not hold up live writes.
+func newBackfillRunner(cfg *config.Config, crdb *database.CockroachClient) (*backfill.Runner, func(), error) {
+	cassandra, err := database.NewCassandraClient(cfg.Cassandra)
+	if err != nil {
+		return nil, nil, err
+	}
+	// A page is written at once, so it fills a batch.
+	indexCfg := cfg.Clickhouse
+	indexCfg.BatchRows = cfg.Backfill.PageSize
+	index, err := database.NewClickHouseClient(indexCfg)
+	if err != nil {
+		cassandra.Close()
+		return nil, nil, err
+	}
+	closeAll := func() {
+		if err := index.Close(); err != nil {
+			log.Printf("ERROR: could not close backfill ClickHouse client: %v", err)
+		}
+		cassandra.Close()
+	}
+	return backfill.NewRunner(cfg.Backfill, crdb, cassandra, index), closeAll, nil
+}
 
+// healthHandler reports each sink's health, with 503 if any is unhealthy.
+func healthHandler(c *kafka.Consumer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
 
-}
\ No newline at end of file
+		status := http.StatusOK
+		body := make(map[string]string)
+		for name, err := range c.Health(ctx) {
+			body[name] = "ok"
+			if err != nil {
+				body[name] = err.Error()
+				status = http.StatusServiceUnavailable
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"log-analysis-system/consumer/config"
+	"log-analysis-system/consumer/database"
+	"log-analysis-system/consumer/kafka"
+	"log-analysis-system/consumer/sink"
+)
+
+// runReplay implements "consumer replay", which rewrites logs from the
+// topic into a chosen set of sinks.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	from := fs.String("from", "committed", "where to start: committed, earliest, an offset, an RFC3339 time or a duration ago such as 6h")
+	group := fs.String("group", "", "consumer group to commit replay progress to (default <live group>-replay)")
+	sinks := fs.String("sinks", "", "comma-separated sinks to write to (default SINKS)")
+	projects := fs.String("project", "", "comma-separated project IDs to replay (default all)")
+	events := fs.String("event", "", "comma-separated event names to replay (default all)")
+	dryRun := fs.Bool("dry-run", false, "count the logs that would be replayed without writing them")
+	progress := fs.Duration("progress", 10*time.Second, "how often to report progress and commit offsets")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if *progress <= 0 {
+		return fmt.Errorf("-progress must be positive")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if *sinks != "" {
+		cfg.Sinks = splitList(*sinks)
+	}
+	opts := kafka.ReplayOptions{
+		GroupID:  *group,
+		From:     *from,
+		Projects: toSet(*projects),
+		Events:   toSet(*events),
+		DryRun:   *dryRun,
+		Progress: *progress,
+	}
+	if opts.GroupID == "" {
+		opts.GroupID = cfg.Kafka.GroupID + "-replay"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var opened []sink.LogSink
+	var keys *database.SearchableKeyCache
+	if !*dryRun {
+		opened, err = sink.Open(cfg)
+		if err != nil {
+			return fmt.Errorf("could not open sinks: %w", err)
+		}
+		defer sink.CloseAll(opened)
+
+		cockroachClient, err := database.NewCockroachClient(cfg.Cockroach)
+		if err != nil {
+			return fmt.Errorf("could not connect to CockroachDB: %w", err)
+		}
+		defer cockroachClient.Close()
+		keys = database.NewSearchableKeyCache(cockroachClient, cfg.Cockroach.SearchableKeysRefresh)
+	}
+
+	stats, err := kafka.Replay(ctx, cfg.Kafka, cfg.Retry, opened, keys, opts)
+	if stats != nil {
+		printReplayStats(stats, *dryRun)
+	}
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("replay interrupted; run again with -from committed -group %s to continue", opts.GroupID)
+	}
+	return err
+}
+
+func printReplayStats(stats *kafka.ReplayStats, dryRun bool) {
+	fmt.Printf("Read %d of %d message(s): %d matched, %d skipped by filters, %d failed.\n",
+		stats.Read, stats.Total, stats.Matched, stats.Skipped, stats.Failed)
+	if dryRun {
+		fmt.Printf("Would replay %d log(s).\n", stats.Matched)
+	} else {
+		fmt.Printf("Replayed %d log(s).\n", stats.Replayed)
+	}
+	if len(stats.Events) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(stats.Events))
+	for name := range stats.Events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "EVENT\tMATCHED")
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%d\n", name, stats.Events[name])
+	}
+	tw.Flush()
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func toSet(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range splitList(s) {
+		set[v] = true
+	}
+	return set
+}
@@ -0,0 +1,53 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	"log-analysis-system/consumer/config"
+	"log-analysis-system/consumer/database"
+)
+
+func init() {
+	Register("cassandra", func(cfg *config.Config) (LogSink, error) {
+		if len(cfg.Cassandra.Hosts) == 0 {
+			return nil, fmt.Errorf("required environment variable CASSANDRA_HOSTS is not set")
+		}
+		client, err := database.NewCassandraClient(cfg.Cassandra)
+		if err != nil {
+			return nil, err
+		}
+		return &cassandraSink{client: client}, nil
+	})
+}
+
+// cassandraSink writes the full log to the logs table: the payload JSON as
+// submitted, and its flattened fields as text.
+type cassandraSink struct {
+	client *database.CassandraClient
+}
+
+func (s *cassandraSink) Name() string { return "Cassandra" }
+
+func (s *cassandraSink) Write(ctx context.Context, l Log) <-chan error {
+	row := database.LogPayload{
+		ProjectID:   l.ProjectID,
+		LogID:       l.LogID,
+		EventName:   l.EventName,
+		Timestamp:   l.Timestamp,
+		IngestedAt:  l.IngestedAt,
+		Payload:     textFields(l.Fields),
+		PayloadJSON: string(l.RawPayload),
+	}
+	return goWrite(func() error { return s.client.WriteLog(row) })
+}
+
+// Flush has nothing to do: every write is sent on its own.
+func (s *cassandraSink) Flush(ctx context.Context) error { return nil }
+
+func (s *cassandraSink) Close() error {
+	s.client.Close()
+	return nil
+}
+
+func (s *cassandraSink) Health(ctx context.Context) error { return s.client.Ping(ctx) }
@@ -0,0 +1,55 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	"log-analysis-system/consumer/config"
+	"log-analysis-system/consumer/database"
+)
+
+func init() {
+	Register("clickhouse", func(cfg *config.Config) (LogSink, error) {
+		if cfg.Clickhouse.Host == "" {
+			return nil, fmt.Errorf("required environment variable CLICKHOUSE_HOST is not set")
+		}
+		client, err := database.NewClickHouseClient(cfg.Clickhouse)
+		if err != nil {
+			return nil, err
+		}
+		return &clickhouseSink{client: client}, nil
+	})
+}
+
+// clickhouseSink writes the searchable index of each log to logs_index, with
+// the flattened payload fields in maps by type.
+type clickhouseSink struct {
+	client *database.ClickhouseClient
+}
+
+func (s *clickhouseSink) Name() string { return "ClickHouse" }
+
+func (s *clickhouseSink) Write(ctx context.Context, l Log) <-chan error {
+	return s.client.WriteLog(ctx, IndexRow(l))
+}
+
+// IndexRow is the logs_index row for a log.
+func IndexRow(l Log) database.LogIndex {
+	strs, nums, bools := typedFields(l.Fields)
+	return database.LogIndex{
+		ProjectID:  l.ProjectID,
+		LogID:      l.LogID,
+		EventName:  l.EventName,
+		Timestamp:  l.Timestamp,
+		IngestedAt: l.IngestedAt,
+		Searchable: l.Searchable,
+		Strings:    strs,
+		Numbers:    nums,
+		Bools:      bools,
+		Text:       fullText(l.Fields),
+	}
+}
+
+func (s *clickhouseSink) Flush(ctx context.Context) error  { return s.client.Flush(ctx) }
+func (s *clickhouseSink) Close() error                     { return s.client.Close() }
+func (s *clickhouseSink) Health(ctx context.Context) error { return s.client.Ping(ctx) }
@@ -0,0 +1,127 @@
+package sink
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fieldString renders a flattened field as text: strings as they are,
+// numbers as written, and arrays and null as JSON.
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+// textFields renders every flattened field as text.
+func textFields(fields map[string]interface{}) map[string]string {
+	out := make(map[string]string, len(fields))
+	for k, v := range fields {
+		out[k] = fieldString(v)
+	}
+	return out
+}
+
+// typedFields splits flattened fields by type. Numbers a float64 cannot
+// hold exactly as written, arrays and strings go to strs; nulls are left
+// out.
+func typedFields(fields map[string]interface{}) (strs map[string]string, nums map[string]float64, bools map[string]bool) {
+	strs = make(map[string]string)
+	nums = make(map[string]float64)
+	bools = make(map[string]bool)
+	for k, v := range fields {
+		switch v := v.(type) {
+		case nil:
+		case bool:
+			bools[k] = v
+		case json.Number:
+			if f, ok := exactFloat(v); ok {
+				nums[k] = f
+			} else {
+				strs[k] = v.String()
+			}
+		default:
+			strs[k] = fieldString(v)
+		}
+	}
+	return strs, nums, bools
+}
+
+// exactFloat converts n to a float64 if the float reads back as the number
+// n was written as, so 0.1 and 1e300 are numbers but 9007199254740993
+// (2^53+1), which would round, is not.
+func exactFloat(n json.Number) (float64, bool) {
+	f, err := n.Float64()
+	if err != nil {
+		return 0, false
+	}
+	want, ok := parseDecimal(n.String())
+	if !ok {
+		return 0, false
+	}
+	got, _ := parseDecimal(strconv.FormatFloat(f, 'e', -1, 64))
+	return f, got == want
+}
+
+// decimal is a number as sign, significant digits and a power of ten, with
+// no leading or trailing zeros in digits. Zero has no digits.
+type decimal struct {
+	neg    bool
+	digits string
+	exp    int
+}
+
+// parseDecimal reads a JSON number into its decimal form without
+// evaluating it, so huge exponents cost nothing.
+func parseDecimal(s string) (decimal, bool) {
+	var d decimal
+	d.neg = strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exp, err := strconv.Atoi(s[i+1:])
+		if err != nil {
+			return decimal{}, false
+		}
+		s, d.exp = s[:i], exp
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	digits := strings.TrimLeft(whole+frac, "0")
+	d.exp -= len(frac)
+	trimmed := strings.TrimRight(digits, "0")
+	d.exp += len(digits) - len(trimmed)
+	d.digits = trimmed
+	if d.digits == "" {
+		return decimal{}, true
+	}
+	return d, true
+}
+
+// fullText joins the payload's string values, one per line in key order,
+// for the full-text index.
+func fullText(fields map[string]interface{}) string {
+	keys := make([]string, 0, len(fields))
+	for k, v := range fields {
+		if _, ok := v.(string); ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = fields[k].(string)
+	}
+	return strings.Join(values, "\n")
+}
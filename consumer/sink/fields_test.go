@@ -0,0 +1,108 @@
+package sink
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestExactFloat(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"-0", 0, true},
+		{"42", 42, true},
+		{"-17", -17, true},
+		{"0.1", 0.1, true},
+		{"1.50", 1.5, true},
+		{"2.5e3", 2500, true},
+		{"1E-7", 1e-7, true},
+		{"1e300", 1e300, true},
+		{"9007199254740992", 9007199254740992, true}, // 2^53
+		{"100000000000000000000", 1e20, true},
+		{"9007199254740993", 0, false}, // 2^53+1 rounds
+		{"12345678901234567890", 0, false},
+		{"0.10000000000000001", 0, false},
+		{"1e400", 0, false},
+		{"1e-400", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := exactFloat(json.Number(tt.in))
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("exactFloat(%s) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTypedFields(t *testing.T) {
+	fields := map[string]interface{}{
+		"name":  "checkout",
+		"count": json.Number("3"),
+		"id":    json.Number("9007199254740993"),
+		"paid":  true,
+		"tags":  []interface{}{"a", "b"},
+		"none":  nil,
+	}
+	strs, nums, bools := typedFields(fields)
+	if want := map[string]string{"name": "checkout", "id": "9007199254740993", "tags": `["a","b"]`}; !reflect.DeepEqual(strs, want) {
+		t.Errorf("strings = %v, want %v", strs, want)
+	}
+	if want := map[string]float64{"count": 3}; !reflect.DeepEqual(nums, want) {
+		t.Errorf("numbers = %v, want %v", nums, want)
+	}
+	if want := map[string]bool{"paid": true}; !reflect.DeepEqual(bools, want) {
+		t.Errorf("bools = %v, want %v", bools, want)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    map[string]interface{}
+	}{
+		{
+			name:    "nested objects",
+			payload: `{"user": {"id": 42, "address": {"city": "Oslo"}}, "ok": true}`,
+			want:    map[string]interface{}{"user.id": json.Number("42"), "user.address.city": "Oslo", "ok": true},
+		},
+		{
+			name:    "arrays are kept whole and empty objects dropped",
+			payload: `{"tags": ["a", {"b": 1}], "empty": {}}`,
+			want:    map[string]interface{}{"tags": []interface{}{"a", map[string]interface{}{"b": json.Number("1")}}},
+		},
+		{
+			name:    "a dotted key beats a nested path",
+			payload: `{"a": {"b": "nested"}, "a.b": "dotted"}`,
+			want:    map[string]interface{}{"a.b": "dotted"},
+		},
+		{
+			name:    "the least nested wins at any depth",
+			payload: `{"x": {"a": {"b": 2}}, "x.a": {"b": 1}}`,
+			want:    map[string]interface{}{"x.a.b": json.Number("1")},
+		},
+		{
+			name:    "equally nested keys go by key order",
+			payload: `{"x": {"a.b": 1}, "x.a": {"b": 2}}`,
+			want:    map[string]interface{}{"x.a.b": json.Number("1")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := DecodePayload(json.RawMessage(tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Map order changes from run to run, so repeat to catch a
+			// result that depends on it.
+			for i := 0; i < 20; i++ {
+				if got := Flatten(payload); !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("Flatten(%s) = %v, want %v", tt.payload, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"log-analysis-system/consumer/config"
+)
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.ndjson")
+	open := func() LogSink {
+		sinks, err := Open(&config.Config{Sinks: []string{"file"}, File: config.FileSinkConfig{Path: path}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sinks[0]
+	}
+	ctx := context.Background()
+
+	s := open()
+	logs := []Log{
+		{
+			ProjectID: "p1", LogID: "l1", EventName: "checkout", Timestamp: 1000, IngestedAt: 2000,
+			RawPayload: json.RawMessage(`{"total": 9.5}`),
+			Searchable: map[string]string{"total": "9.5"},
+		},
+		{ProjectID: "p1", LogID: "l2", EventName: "login", Timestamp: 3000, IngestedAt: 4000, RawPayload: json.RawMessage(`{}`)},
+	}
+	if err := <-s.Write(ctx, logs[0]); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if err := s.Health(ctx); err == nil {
+		t.Error("Health() after Close succeeded")
+	}
+	// Reopening appends.
+	s = open()
+	if err := <-s.Write(ctx, logs[1]); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := s.Health(ctx); err != nil {
+		t.Errorf("Health() = %v", err)
+	}
+	s.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []map[string]interface{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		got = append(got, line)
+	}
+	want := []map[string]interface{}{
+		{
+			"project_id": "p1", "log_id": "l1", "event_name": "checkout", "timestamp": 1000.0, "ingested_at": 2000.0,
+			"payload": map[string]interface{}{"total": 9.5}, "searchable": map[string]interface{}{"total": "9.5"},
+		},
+		{"project_id": "p1", "log_id": "l2", "event_name": "login", "timestamp": 3000.0, "ingested_at": 4000.0, "payload": map[string]interface{}{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("file holds\n  %v\nwant\n  %v", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"log-analysis-system/consumer/config"
+)
+
+func init() {
+	Register("memory", func(cfg *config.Config) (LogSink, error) {
+		return NewMemory(), nil
+	})
+}
+
+var errMemoryClosed = errors.New("memory sink is closed")
+
+// Memory keeps every log it is given in memory. It is meant for tests and
+// for running the consumer without any store; its logs are lost on exit.
+type Memory struct {
+	mu       sync.Mutex
+	logs     []Log
+	failures []error
+	closed   bool
+}
+
+func NewMemory() *Memory { return &Memory{} }
+
+func (m *Memory) Name() string { return "memory" }
+
+// Write stores the log before it returns, unless FailNext queued an error
+// for it.
+func (m *Memory) Write(ctx context.Context, l Log) <-chan error {
+	done := make(chan error, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case len(m.failures) > 0:
+		done <- m.failures[0]
+		m.failures = m.failures[1:]
+	case m.closed:
+		done <- errMemoryClosed
+	default:
+		m.logs = append(m.logs, l)
+		done <- nil
+	}
+	return done
+}
+
+// FailNext makes the next writes fail with errs, one write per error.
+func (m *Memory) FailNext(errs ...error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = append(m.failures, errs...)
+}
+
+// Logs returns the logs stored so far, in the order they were written.
+func (m *Memory) Logs() []Log {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Log(nil), m.logs...)
+}
+
+// Flush has nothing to do: every write is stored at once.
+func (m *Memory) Flush(ctx context.Context) error { return nil }
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
+
+func (m *Memory) Health(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errMemoryClosed
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+)
+
+// DecodePayload decodes a log payload, keeping numbers as json.Number so
+// integers beyond float64 precision survive. A missing or null payload is
+// empty.
+func DecodePayload(raw json.RawMessage) (map[string]interface{}, error) {
+	payload := map[string]interface{}{}
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return payload, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return nil, err
+	}
+	if payload == nil {
+		return nil, errors.New("payload is not a JSON object")
+	}
+	return payload, nil
+}
+
+// RawPayload is the payload as submitted, with a missing one stored as {}.
+func RawPayload(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return json.RawMessage("{}")
+	}
+	return raw
+}
+
+// Flatten turns nested objects into dotted keys, so {"user": {"id": 42}}
+// becomes {"user.id": 42}. Leaves are strings, json.Numbers, bools, nil
+// and arrays, which are kept whole. Empty objects are dropped. When keys
+// flatten to the same one, as {"a.b": 1} and {"a": {"b": 2}} do, the least
+// nested wins, as it does for searchable keys, and among equally nested
+// ones the first in key order.
+func Flatten(payload map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(payload))
+	flattenInto(fields, make(map[string]int), "", 0, payload)
+	return fields
+}
+
+// flattenInto adds the leaves of obj, depth levels down, to fields. depths
+// holds the depth each field was found at.
+func flattenInto(fields map[string]interface{}, depths map[string]int, prefix string, depth int, obj map[string]interface{}) {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if nested, ok := obj[k].(map[string]interface{}); ok {
+			flattenInto(fields, depths, key, depth+1, nested)
+			continue
+		}
+		if d, taken := depths[key]; taken && d <= depth {
+			continue
+		}
+		fields[key] = obj[k]
+		depths[key] = depth
+	}
+}
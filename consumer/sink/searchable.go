@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// SearchableValues picks the values of keys out of a payload. A key is
+// looked up as written first, then as a dotted path into nested objects, so
+// "user.id" finds {"user": {"id": 42}}. Values are stored as strings:
+// numbers without trailing zeros, and objects and arrays as JSON.
+func SearchableValues(payload map[string]interface{}, keys []string) map[string]string {
+	if len(keys) == 0 || len(payload) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		v, ok := lookupPath(payload, key)
+		if !ok || v == nil {
+			continue
+		}
+		values[key] = searchableString(v)
+	}
+	return values
+}
+
+func lookupPath(payload map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := payload[key]; ok {
+		return v, true
+	}
+	var cur interface{} = payload
+	for _, part := range strings.Split(key, ".") {
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func searchableString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
@@ -0,0 +1,123 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"log-analysis-system/consumer/config"
+)
+
+// Log is one decoded log, as every sink receives it. Timestamp (event time)
+// and IngestedAt are unix milliseconds.
+type Log struct {
+	ProjectID  string
+	LogID      string
+	EventName  string
+	Timestamp  int64
+	IngestedAt int64
+	// Payload is the decoded payload, with numbers as json.Number.
+	Payload map[string]interface{}
+	// RawPayload is the payload JSON exactly as the client submitted it.
+	RawPayload json.RawMessage
+	// Fields is Payload flattened to dotted keys ("user.id"). Values are
+	// strings, json.Numbers, bools, nil or arrays.
+	Fields map[string]interface{}
+	// Searchable holds the values of the project's searchable keys that
+	// the payload carries, as strings.
+	Searchable map[string]string
+}
+
+// LogSink is a store the consumer writes logs to. Write may be called from
+// many goroutines at once. It hands the log to the sink without waiting for
+// it to be stored, and returns a channel that receives nil once the log is
+// durable in the sink, or the error it failed with. Errors are classified
+// with database.IsTransient.
+type LogSink interface {
+	// Name identifies the sink in logs and metrics.
+	Name() string
+	Write(ctx context.Context, l Log) <-chan error
+	// Flush writes out anything the sink buffers.
+	Flush(ctx context.Context) error
+	// Close flushes and releases the sink's connections.
+	Close() error
+	// Health reports whether the sink can currently accept writes.
+	Health(ctx context.Context) error
+}
+
+// Factory builds a sink from the consumer's configuration.
+type Factory func(cfg *config.Config) (LogSink, error)
+
+var registry = struct {
+	sync.Mutex
+	factories map[string]Factory
+}{factories: make(map[string]Factory)}
+
+// Register makes a sink available under name for config.Config.Sinks.
+func Register(name string, f Factory) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.factories[name]; dup {
+		panic("sink: Register called twice for " + name)
+	}
+	registry.factories[name] = f
+}
+
+// Open builds the sinks named in cfg.Sinks. If one fails, those already
+// opened are closed.
+func Open(cfg *config.Config) ([]LogSink, error) {
+	if len(cfg.Sinks) == 0 {
+		return nil, fmt.Errorf("no sinks configured")
+	}
+
+	var sinks []LogSink
+	for _, name := range cfg.Sinks {
+		registry.Lock()
+		f, ok := registry.factories[name]
+		registry.Unlock()
+		if !ok {
+			CloseAll(sinks)
+			return nil, fmt.Errorf("unknown sink %q (available: %s)", name, strings.Join(names(), ", "))
+		}
+		s, err := f(cfg)
+		if err != nil {
+			CloseAll(sinks)
+			return nil, fmt.Errorf("could not open sink %s: %w", name, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// CloseAll flushes and closes every sink and returns the first error.
+func CloseAll(sinks []LogSink) error {
+	var first error
+	for _, s := range sinks {
+		if err := s.Close(); err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", s.Name(), err)
+		}
+	}
+	return first
+}
+
+func names() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	var out []string
+	for name := range registry.factories {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// goWrite runs a blocking write in its own goroutine and returns the
+// channel its result is sent on, for sinks that store each log on its own.
+func goWrite(write func() error) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- write() }()
+	return done
+}
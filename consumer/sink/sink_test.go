@@ -0,0 +1,104 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"log-analysis-system/consumer/config"
+)
+
+// trackedSink records whether it was closed.
+type trackedSink struct {
+	*Memory
+	closed *bool
+}
+
+func (s trackedSink) Close() error {
+	*s.closed = true
+	return s.Memory.Close()
+}
+
+func TestOpen(t *testing.T) {
+	var closed bool
+	Register("test-tracked", func(cfg *config.Config) (LogSink, error) {
+		return trackedSink{Memory: NewMemory(), closed: &closed}, nil
+	})
+	Register("test-broken", func(cfg *config.Config) (LogSink, error) {
+		return nil, errors.New("no connection")
+	})
+
+	sinks, err := Open(&config.Config{Sinks: []string{"memory", "test-tracked"}})
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	if len(sinks) != 2 || sinks[0].Name() != "memory" {
+		t.Fatalf("Open() = %v", sinks)
+	}
+	if err := CloseAll(sinks); err != nil || !closed {
+		t.Errorf("CloseAll() = %v, closed = %v", err, closed)
+	}
+
+	tests := []struct {
+		sinks []string
+		err   string
+	}{
+		{nil, "no sinks configured"},
+		{[]string{"test-tracked", "nope"}, `unknown sink "nope" (available: `},
+		{[]string{"test-tracked", "test-broken"}, "could not open sink test-broken: no connection"},
+	}
+	for _, tt := range tests {
+		closed = false
+		sinks, err := Open(&config.Config{Sinks: tt.sinks})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Open(%v) = %v, want an error containing %q", tt.sinks, err, tt.err)
+		}
+		if sinks != nil {
+			t.Errorf("Open(%v) returned sinks with an error", tt.sinks)
+		}
+		if len(tt.sinks) > 0 && !closed {
+			t.Errorf("Open(%v) left the sinks it opened open", tt.sinks)
+		}
+	}
+	if _, err := Open(&config.Config{Sinks: []string{"nope"}}); err == nil || !strings.Contains(err.Error(), "file, memory") {
+		t.Errorf("unknown sink error %v does not list the sinks", err)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering memory twice did not panic")
+		}
+	}()
+	Register("memory", func(cfg *config.Config) (LogSink, error) { return NewMemory(), nil })
+}
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+	ctx := context.Background()
+	boom := errors.New("boom")
+	m.FailNext(boom)
+
+	if err := <-m.Write(ctx, Log{LogID: "a"}); err != boom {
+		t.Errorf("first Write() = %v, want %v", err, boom)
+	}
+	if err := <-m.Write(ctx, Log{LogID: "b"}); err != nil {
+		t.Errorf("second Write() = %v", err)
+	}
+	if logs := m.Logs(); len(logs) != 1 || logs[0].LogID != "b" {
+		t.Errorf("Logs() = %v, want only b", logs)
+	}
+	if err := m.Health(ctx); err != nil {
+		t.Errorf("Health() = %v", err)
+	}
+
+	m.Close()
+	if err := <-m.Write(ctx, Log{LogID: "c"}); err == nil {
+		t.Error("Write() after Close succeeded")
+	}
+	if err := m.Health(ctx); err == nil {
+		t.Error("Health() after Close succeeded")
+	}
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ListenerConfig is one syslog socket. Messages without an API key in their
+// structured data are routed to ProjectID, if set.
+type ListenerConfig struct {
+	Network   string // "udp" or "tcp"
+	Addr      string
+	ProjectID string
+}
+
+// Config is the syslog service configuration. Messages are sent to the
+// batch endpoint of the API at APIURL.
+type Config struct {
+	Listeners   []ListenerConfig
+	APIURL      string
+	DatabaseURL string
+}
+
+// Load reads the syslog service configuration from the environment.
+// SYSLOG_LISTENERS is a comma separated list such as
+// "udp://:5514,tcp://:5514#<projectID>", where the optional fragment names
+// the project for messages that do not carry an API key.
+func Load() (*Config, error) {
+	apiURL := os.Getenv("API_URL")
+	if apiURL == "" {
+		apiURL = "http://localhost:8080"
+	}
+
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		// Default connection string for local CockroachDB
+		databaseURL = "postgresql://root@localhost:26257/log?sslmode=disable"
+	}
+
+	spec := os.Getenv("SYSLOG_LISTENERS")
+	if spec == "" {
+		spec = "udp://:5514,tcp://:5514"
+	}
+	var listeners []ListenerConfig
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		u, err := url.Parse(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SYSLOG_LISTENERS entry %q: %w", entry, err)
+		}
+		if u.Scheme != "udp" && u.Scheme != "tcp" {
+			return nil, fmt.Errorf("invalid SYSLOG_LISTENERS entry %q: scheme must be udp or tcp", entry)
+		}
+		listeners = append(listeners, ListenerConfig{
+			Network:   u.Scheme,
+			Addr:      u.Host,
+			ProjectID: u.Fragment,
+		})
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("SYSLOG_LISTENERS has no listeners")
+	}
+
+	return &Config{
+		Listeners:   listeners,
+		APIURL:      apiURL,
+		DatabaseURL: databaseURL,
+	}, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	_ "github.com/lib/pq"
+	"log-analysis-system/syslog/config"
+	"log-analysis-system/syslog/server"
+)
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Could not load config in syslog service: %v", err)
+	}
+
+	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Could not open database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		log.Fatalf("Could not connect to database: %v", err)
+	}
+	defer db.Close()
+
+	// Messages go through the API's batch endpoint, so they are checked
+	// and limited like logs sent to it directly.
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Println("Starting syslog ingest service...")
+	if err := server.New(cfg, db, client).Run(ctx); err != nil {
+		log.Fatalf("Syslog service failed: %v", err)
+	}
+}
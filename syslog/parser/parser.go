@@ -0,0 +1,227 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Message is a syslog message parsed from either RFC 5424 or RFC 3164
+// format. Fields absent from the message (or sent as "-") are empty.
+type Message struct {
+	Facility  int
+	Severity  int
+	Version   int // 1 for RFC 5424, 0 for RFC 3164
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	// StructuredData maps SD-ID to its parameters.
+	StructuredData map[string]map[string]string
+	Message        string
+}
+
+var facilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severityNames = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+func (m *Message) FacilityName() string {
+	if m.Facility >= 0 && m.Facility < len(facilityNames) {
+		return facilityNames[m.Facility]
+	}
+	return strconv.Itoa(m.Facility)
+}
+
+func (m *Message) SeverityName() string {
+	if m.Severity >= 0 && m.Severity < len(severityNames) {
+		return severityNames[m.Severity]
+	}
+	return strconv.Itoa(m.Severity)
+}
+
+// Parse parses one syslog message. RFC 5424 is recognised by the version
+// number after the priority; anything else is parsed as RFC 3164. now is
+// used to fill in the year RFC 3164 timestamps leave out.
+func Parse(data []byte, now time.Time) (*Message, error) {
+	s := strings.TrimRight(string(data), "\r\n\x00")
+	pri, rest, err := parsePriority(s)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Facility: pri / 8, Severity: pri % 8}
+
+	if len(rest) >= 2 && rest[0] >= '1' && rest[0] <= '9' {
+		if sp := strings.IndexByte(rest, ' '); sp > 0 && sp <= 3 {
+			if v, err := strconv.Atoi(rest[:sp]); err == nil {
+				m.Version = v
+				return m, parse5424(m, rest[sp+1:])
+			}
+		}
+	}
+	parse3164(m, rest, now)
+	return m, nil
+}
+
+func parsePriority(s string) (int, string, error) {
+	if len(s) < 3 || s[0] != '<' {
+		return 0, "", errors.New("missing priority")
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return 0, "", errors.New("invalid priority")
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return 0, "", errors.New("invalid priority")
+	}
+	return pri, s[end+1:], nil
+}
+
+// parse5424 parses everything after "<PRI>VERSION ".
+func parse5424(m *Message, s string) error {
+	fields := make([]string, 5)
+	for i := range fields {
+		sp := strings.IndexByte(s, ' ')
+		if sp < 0 {
+			return fmt.Errorf("truncated RFC 5424 header")
+		}
+		fields[i], s = s[:sp], s[sp+1:]
+	}
+
+	if fields[0] != "-" {
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid RFC 5424 timestamp: %w", err)
+		}
+		m.Timestamp = ts
+	}
+	m.Hostname = nilValue(fields[1])
+	m.AppName = nilValue(fields[2])
+	m.ProcID = nilValue(fields[3])
+	m.MsgID = nilValue(fields[4])
+
+	sd, rest, err := parseStructuredData(s)
+	if err != nil {
+		return err
+	}
+	m.StructuredData = sd
+	rest = strings.TrimPrefix(rest, " ")
+	m.Message = strings.TrimPrefix(rest, "\ufeff")
+	return nil
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// parseStructuredData parses "-" or a run of "[SD-ID param="value" ...]"
+// elements, returning the rest of the message.
+func parseStructuredData(s string) (map[string]map[string]string, string, error) {
+	if strings.HasPrefix(s, "-") {
+		return nil, s[1:], nil
+	}
+	if !strings.HasPrefix(s, "[") {
+		return nil, "", errors.New("invalid structured data")
+	}
+
+	sd := map[string]map[string]string{}
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		end := strings.IndexAny(s, " ]")
+		if end <= 0 {
+			return nil, "", errors.New("invalid SD-ID")
+		}
+		id := s[:end]
+		s = s[end:]
+		params := map[string]string{}
+		for {
+			s = strings.TrimLeft(s, " ")
+			if strings.HasPrefix(s, "]") {
+				s = s[1:]
+				break
+			}
+			eq := strings.IndexByte(s, '=')
+			if eq <= 0 || len(s) < eq+2 || s[eq+1] != '"' {
+				return nil, "", fmt.Errorf("invalid SD-PARAM in %q", id)
+			}
+			name := s[:eq]
+			value, rest, err := parseParamValue(s[eq+2:])
+			if err != nil {
+				return nil, "", fmt.Errorf("%s.%s: %w", id, name, err)
+			}
+			params[name] = value
+			s = rest
+		}
+		sd[id] = params
+	}
+	return sd, s, nil
+}
+
+// parseParamValue reads a quoted PARAM-VALUE up to its closing quote,
+// undoing the \" \\ and \] escapes.
+func parseParamValue(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']') {
+				i++
+			}
+			b.WriteByte(s[i])
+		case '"':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", errors.New("unterminated value")
+}
+
+// parse3164 parses everything after "<PRI>". BSD syslog is loosely
+// specified, so missing parts are tolerated rather than rejected.
+func parse3164(m *Message, s string, now time.Time) {
+	if len(s) >= 16 && s[15] == ' ' {
+		if ts, err := time.ParseInLocation(time.Stamp, s[:15], now.Location()); err == nil {
+			ts = ts.AddDate(now.Year(), 0, 0)
+			// A December message read in January belongs to last year.
+			if ts.After(now.AddDate(0, 1, 0)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			m.Timestamp = ts
+			s = s[16:]
+
+			if sp := strings.IndexByte(s, ' '); sp > 0 && !strings.HasSuffix(s[:sp], ":") {
+				m.Hostname = s[:sp]
+				s = s[sp+1:]
+			}
+		}
+	}
+
+	// TAG is up to 32 alphanumerics, optionally followed by "[pid]", then ":".
+	if colon := strings.IndexByte(s, ':'); colon > 0 && colon <= 48 && !strings.ContainsAny(s[:colon], " ") {
+		tag := s[:colon]
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			m.ProcID = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		m.AppName = tag
+		s = strings.TrimPrefix(s[colon+1:], " ")
+	}
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "\ufffd")
+	}
+	m.Message = s
+}
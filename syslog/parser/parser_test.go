@@ -0,0 +1,194 @@
+package parser
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParse5424(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		in   string
+		want Message
+	}{
+		{
+			name: "full header with structured data",
+			in:   `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut="3" eventSource="Application"] An application event`,
+			want: Message{
+				Facility: 20, Severity: 5, Version: 1,
+				Timestamp: time.Date(2003, 10, 11, 22, 14, 15, 3e6, time.UTC),
+				Hostname:  "mymachine.example.com", AppName: "evntslog", ProcID: "1234", MsgID: "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "eventSource": "Application"},
+				},
+				Message: "An application event",
+			},
+		},
+		{
+			name: "nil values and no structured data",
+			in:   "<34>1 - - - - - -",
+			want: Message{Facility: 4, Severity: 2, Version: 1},
+		},
+		{
+			name: "BOM is stripped from the message",
+			in:   "<14>1 - host app - - - \ufeffhello",
+			want: Message{Facility: 1, Severity: 6, Version: 1, Hostname: "host", AppName: "app", Message: "hello"},
+		},
+		{
+			name: "escaped param values and several elements",
+			in:   `<14>1 - - - - - [a x="q\"uo\]te\\"][b y=""] msg`,
+			want: Message{
+				Facility: 1, Severity: 6, Version: 1,
+				StructuredData: map[string]map[string]string{
+					"a": {"x": `q"uo]te\`},
+					"b": {"y": ""},
+				},
+				Message: "msg",
+			},
+		},
+		{
+			name: "trailing newline is trimmed",
+			in:   "<14>1 - - - - - - hi\r\n",
+			want: Message{Facility: 1, Severity: 6, Version: 1, Message: "hi"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.in), now)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Parse(%q)\n got %+v\nwant %+v", tt.in, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse3164(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		in   string
+		now  time.Time
+		want Message
+	}{
+		{
+			name: "timestamp, host and tag with pid",
+			in:   "<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed",
+			want: Message{
+				Facility: 4, Severity: 2,
+				Timestamp: time.Date(2023, 10, 11, 22, 14, 15, 0, time.UTC),
+				Hostname:  "mymachine", AppName: "su", ProcID: "230",
+				Message: "'su root' failed",
+			},
+		},
+		{
+			name: "this year when not in the future",
+			in:   "<13>Mar  1 08:00:00 host cron: job",
+			want: Message{
+				Facility: 1, Severity: 5,
+				Timestamp: time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC),
+				Hostname:  "host", AppName: "cron", Message: "job",
+			},
+		},
+		{
+			name: "December message read in January is last year",
+			in:   "<13>Dec 31 23:59:59 host app: late",
+			now:  time.Date(2024, 1, 1, 0, 0, 5, 0, time.UTC),
+			want: Message{
+				Facility: 1, Severity: 5,
+				Timestamp: time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC),
+				Hostname:  "host", AppName: "app", Message: "late",
+			},
+		},
+		{
+			name: "no timestamp, tag only",
+			in:   "<13>app: just a message",
+			want: Message{Facility: 1, Severity: 5, AppName: "app", Message: "just a message"},
+		},
+		{
+			name: "no header at all",
+			in:   "<13>free text, no tag",
+			want: Message{Facility: 1, Severity: 5, Message: "free text, no tag"},
+		},
+		{
+			name: "tag right after the timestamp is not a hostname",
+			in:   "<13>Mar  1 08:00:00 app: msg",
+			want: Message{
+				Facility: 1, Severity: 5,
+				Timestamp: time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC),
+				AppName:   "app", Message: "msg",
+			},
+		},
+		{
+			name: "invalid UTF-8 is replaced",
+			in:   "<13>app: bad \xff byte",
+			want: Message{Facility: 1, Severity: 5, AppName: "app", Message: "bad \ufffd byte"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := tt.now
+			if n.IsZero() {
+				n = now
+			}
+			got, err := Parse([]byte(tt.in), n)
+			if err != nil {
+				t.Fatalf("Parse(%q) error: %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Parse(%q)\n got %+v\nwant %+v", tt.in, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"no priority", "hello"},
+		{"unterminated priority", "<13 hello"},
+		{"priority too large", "<192>hello"},
+		{"non-numeric priority", "<1a>hello"},
+		{"truncated 5424 header", "<14>1 2003-10-11T22:14:15Z host"},
+		{"bad 5424 timestamp", "<14>1 yesterday host app - - - msg"},
+		{"bad structured data", "<14>1 - - - - - nope"},
+		{"unterminated param value", `<14>1 - - - - - [a x="open] msg`},
+		{"param without quotes", `<14>1 - - - - - [a x=1] msg`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if m, err := Parse([]byte(tt.in), time.Now()); err == nil {
+				t.Errorf("Parse(%q) = %+v, want an error", tt.in, m)
+			}
+		})
+	}
+}
+
+func TestFacilityAndSeverityNames(t *testing.T) {
+	tests := []struct {
+		pri                int
+		facility, severity string
+	}{
+		{0, "kern", "emerg"},
+		{13, "user", "notice"},
+		{86, "authpriv", "info"},
+		{191, "local7", "debug"},
+	}
+	for _, tt := range tests {
+		m, err := Parse([]byte("<"+strconv.Itoa(tt.pri)+">x: y"), time.Now())
+		if err != nil {
+			t.Fatalf("Parse pri %d: %v", tt.pri, err)
+		}
+		if m.FacilityName() != tt.facility || m.SeverityName() != tt.severity {
+			t.Errorf("pri %d: got %s.%s, want %s.%s", tt.pri, m.FacilityName(), m.SeverityName(), tt.facility, tt.severity)
+		}
+	}
+}
@@ -0,0 +1,682 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log-analysis-system/syslog/config"
+	"log-analysis-system/syslog/parser"
+)
+
+const (
+	// maxMessageSize bounds a single syslog message on either transport.
+	maxMessageSize = 64 * 1024
+	// maxOctetCountDigits bounds the length field of an octet-counted frame.
+	maxOctetCountDigits = 10
+	// tcpIdleTimeout closes TCP connections that stop sending.
+	tcpIdleTimeout = 5 * time.Minute
+	// apiKeyCacheTTL bounds how long an API key lookup is reused.
+	apiKeyCacheTTL = time.Minute
+	// maxCachedProjects bounds the lookup cache, which also holds misses for
+	// keys that senders make up. The least recently used entry goes first.
+	maxCachedProjects = 10000
+
+	publishBatchSize  = 500
+	publishBatchDelay = 100 * time.Millisecond
+	// maxRequestBytes keeps each batch request under the API's 10 MiB body
+	// limit.
+	maxRequestBytes = 8 << 20
+
+	// senders is the number of requests to the API in flight at once, and
+	// sendQueueSize the number of requests waiting for a sender. When both
+	// are full the queue of messages fills up and new messages are dropped.
+	senders       = 4
+	sendQueueSize = 16
+	// A request that fails with a transport error, a 5xx or a 429 is tried
+	// up to maxPostAttempts times, waiting twice as long each time from
+	// minRetryDelay. A Retry-After over maxRetryDelay (a daily quota) is not
+	// waited for.
+	maxPostAttempts = 5
+	minRetryDelay   = 500 * time.Millisecond
+	maxRetryDelay   = 30 * time.Second
+)
+
+// batchEntry is one entry of a request to the API's batch endpoint, which
+// checks it like any other log: its timestamp, its event schema and the
+// project's rate limits and quotas.
+type batchEntry struct {
+	EventName string                 `json:"event_name"`
+	Timestamp string                 `json:"timestamp,omitempty"`
+	Payload   map[string]interface{} `json:"payload"`
+}
+
+// batchResponse is the part of the batch endpoint's response that reports
+// rejected entries.
+type batchResponse struct {
+	Results []struct {
+		Index  int    `json:"index"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	} `json:"results"`
+}
+
+// project is where a message is sent: the project and the API key that
+// authenticates it.
+type project struct {
+	id     string
+	apiKey string
+}
+
+// queuedLog is a serialized batchEntry waiting to be sent.
+type queuedLog struct {
+	project project
+	entry   []byte
+}
+
+// request is one NDJSON body for a project's batch endpoint. Its key is sent
+// as the Idempotency-Key, so a retry of a request the API already took in
+// part does not store the same logs twice.
+type request struct {
+	project project
+	key     string
+	body    []byte
+}
+
+func newRequest(p project, body []byte) request {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return request{project: p, key: hex.EncodeToString(b), body: body}
+}
+
+type projectEntry struct {
+	key     string
+	project project
+	loaded  time.Time
+}
+
+type Server struct {
+	cfg      *config.Config
+	db       *sql.DB
+	client   *http.Client
+	messages chan queuedLog
+	requests chan request
+	// dropped counts the messages dropped because the queue was full since
+	// publish last reported them.
+	dropped atomic.Int64
+
+	mu       sync.Mutex
+	projects map[string]*list.Element
+	lru      *list.List
+}
+
+func New(cfg *config.Config, db *sql.DB, client *http.Client) *Server {
+	return &Server{
+		cfg:      cfg,
+		db:       db,
+		client:   client,
+		messages: make(chan queuedLog, 10*publishBatchSize),
+		requests: make(chan request, sendQueueSize),
+		projects: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Run starts every configured listener and sends what they receive to the
+// API until ctx is cancelled. If a listener cannot be opened, the ones already
+// open are closed and Run returns the error.
+func (s *Server) Run(ctx context.Context) error {
+	type listener struct {
+		lc   config.ListenerConfig
+		conn net.PacketConn
+		ln   net.Listener
+	}
+	var opened []listener
+	for _, lc := range s.cfg.Listeners {
+		l := listener{lc: lc}
+		var err error
+		switch lc.Network {
+		case "udp":
+			l.conn, err = net.ListenPacket("udp", lc.Addr)
+		case "tcp":
+			l.ln, err = net.Listen("tcp", lc.Addr)
+		}
+		if err != nil {
+			for _, o := range opened {
+				if o.conn != nil {
+					o.conn.Close()
+				} else {
+					o.ln.Close()
+				}
+			}
+			return fmt.Errorf("listen %s %s: %w", lc.Network, lc.Addr, err)
+		}
+		opened = append(opened, l)
+	}
+
+	var listeners sync.WaitGroup
+	for _, l := range opened {
+		l := l
+		log.Printf("Listening for syslog on %s %s", l.lc.Network, l.lc.Addr)
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			if l.conn != nil {
+				s.serveUDP(ctx, l.conn, l.lc)
+			} else {
+				s.serveTCP(ctx, l.ln, l.lc)
+			}
+		}()
+	}
+
+	var sent sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		sent.Add(1)
+		go func() {
+			defer sent.Done()
+			for r := range s.requests {
+				s.deliver(ctx, r)
+			}
+		}()
+	}
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		s.publish()
+		close(s.requests)
+	}()
+
+	<-ctx.Done()
+	listeners.Wait()
+	close(s.messages)
+	<-published
+	sent.Wait()
+	return nil
+}
+
+func (s *Server) serveUDP(ctx context.Context, conn net.PacketConn, lc config.ListenerConfig) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("ERROR: udp read on %s: %v", lc.Addr, err)
+			continue
+		}
+		s.handle(buf[:n], addr, lc)
+	}
+}
+
+func (s *Server) serveTCP(ctx context.Context, ln net.Listener, lc config.ListenerConfig) {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("ERROR: tcp accept on %s: %v", lc.Addr, err)
+			continue
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			s.serveConn(ctx, conn, lc)
+		}()
+	}
+}
+
+// serveConn reads framed messages from one TCP connection. Each frame is
+// either octet-counted ("LEN SP MSG") or terminated by a newline (RFC 6587).
+func (s *Server) serveConn(ctx context.Context, conn net.Conn, lc config.ListenerConfig) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	r := bufio.NewReaderSize(conn, maxMessageSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		frame, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Printf("ERROR: tcp read from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(frame) > 0 {
+			s.handle(frame, conn.RemoteAddr(), lc)
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		n, err := readOctetCount(r)
+		if err != nil {
+			return nil, err
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("message longer than %d bytes", maxMessageSize)
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	return append([]byte(nil), line...), nil
+}
+
+// readOctetCount reads the length field of an octet-counted frame and the
+// space after it. The count is read a digit at a time and checked against
+// maxMessageSize before anything is allocated for the frame.
+func readOctetCount(r *bufio.Reader) (int, error) {
+	n := 0
+	for digits := 0; ; digits++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == ' ' && digits > 0 {
+			return n, nil
+		}
+		if c < '0' || c > '9' || digits == maxOctetCountDigits {
+			return 0, fmt.Errorf("invalid octet count: unexpected %q after %d digits", c, digits)
+		}
+		n = n*10 + int(c-'0')
+		if n > maxMessageSize {
+			return 0, fmt.Errorf("octet count over %d bytes", maxMessageSize)
+		}
+	}
+}
+
+// handle parses one message, routes it to a project and queues it for the
+// API. It never waits for the queue: a message that does not fit is dropped
+// and counted, so a slow API cannot stall the readers.
+func (s *Server) handle(data []byte, addr net.Addr, lc config.ListenerConfig) {
+	msg, err := parser.Parse(data, time.Now())
+	if err != nil {
+		log.Printf("WARN: dropping unparsable syslog message from %s: %v", addr, err)
+		return
+	}
+
+	var p project
+	switch apiKey := extractAPIKey(msg); {
+	case apiKey != "":
+		p, err = s.projectForAPIKey(apiKey)
+	case lc.ProjectID != "":
+		p, err = s.projectByID(lc.ProjectID)
+	default:
+		err = fmt.Errorf("no API key and no project for listener %s", lc.Addr)
+	}
+	if err != nil {
+		log.Printf("WARN: dropping syslog message from %s: %v", addr, err)
+		return
+	}
+
+	// Without a timestamp the API uses the time it receives the log.
+	entry := batchEntry{EventName: eventName(msg), Payload: buildPayload(msg, addr)}
+	if !msg.Timestamp.IsZero() {
+		entry.Timestamp = msg.Timestamp.Format(time.RFC3339Nano)
+	}
+	value, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("ERROR: could not serialize syslog message: %v", err)
+		return
+	}
+	select {
+	case s.messages <- queuedLog{project: p, entry: value}:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// extractAPIKey finds an apiKey (or api_key) parameter in any SD element and
+// removes it, so the key is never stored with the log.
+func extractAPIKey(msg *parser.Message) string {
+	for _, params := range msg.StructuredData {
+		for name, value := range params {
+			switch strings.ToLower(name) {
+			case "apikey", "api_key", "api-key":
+				delete(params, name)
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// projectForAPIKey finds the project an API key belongs to. A key that is
+// not 32 hex digits, the form the API creates, is rejected without a lookup.
+func (s *Server) projectForAPIKey(apiKey string) (project, error) {
+	if !validAPIKey(apiKey) {
+		return project{}, errors.New("malformed API key")
+	}
+	return s.lookupProject("key/"+apiKey, func() (project, error) {
+		p := project{apiKey: apiKey}
+		err := s.db.QueryRow(`SELECT id FROM projects WHERE api_key = $1`, apiKey).Scan(&p.id)
+		return p, err
+	})
+}
+
+// projectByID loads the API key of a listener's project.
+func (s *Server) projectByID(projectID string) (project, error) {
+	return s.lookupProject("id/"+projectID, func() (project, error) {
+		p := project{id: projectID}
+		err := s.db.QueryRow(`SELECT api_key FROM projects WHERE id = $1`, projectID).Scan(&p.apiKey)
+		return p, err
+	})
+}
+
+func validAPIKey(apiKey string) bool {
+	if len(apiKey) != 32 {
+		return false
+	}
+	for i := 0; i < len(apiKey); i++ {
+		c := apiKey[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupProject caches project lookups, including misses, for
+// apiKeyCacheTTL.
+func (s *Server) lookupProject(cacheKey string, load func() (project, error)) (project, error) {
+	entry, ok := s.cached(cacheKey)
+	if !ok || time.Since(entry.loaded) >= apiKeyCacheTTL {
+		p, err := load()
+		if err != nil && err != sql.ErrNoRows {
+			return project{}, fmt.Errorf("could not look up project: %w", err)
+		}
+		if err == sql.ErrNoRows {
+			p = project{}
+		}
+		entry = projectEntry{key: cacheKey, project: p, loaded: time.Now()}
+		s.cache(entry)
+	}
+	if entry.project.id == "" {
+		return project{}, errors.New("invalid API key or project")
+	}
+	return entry.project, nil
+}
+
+func (s *Server) cached(cacheKey string) (projectEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.projects[cacheKey]
+	if !ok {
+		return projectEntry{}, false
+	}
+	s.lru.MoveToFront(el)
+	return *el.Value.(*projectEntry), true
+}
+
+// cache stores a lookup and evicts the least recently used entries past
+// maxCachedProjects.
+func (s *Server) cache(entry projectEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.projects[entry.key]; ok {
+		*el.Value.(*projectEntry) = entry
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.projects[entry.key] = s.lru.PushFront(&entry)
+	for s.lru.Len() > maxCachedProjects {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.projects, oldest.Value.(*projectEntry).key)
+	}
+}
+
+// eventName prefers the RFC 5424 MSGID, which identifies the type of
+// message, then the application name.
+func eventName(msg *parser.Message) string {
+	switch {
+	case msg.MsgID != "":
+		return msg.MsgID
+	case msg.AppName != "":
+		return msg.AppName
+	default:
+		return "syslog"
+	}
+}
+
+// buildPayload flattens the syslog header and structured data into payload
+// keys. Structured data parameters become "sd.<SD-ID>.<name>".
+func buildPayload(msg *parser.Message, addr net.Addr) map[string]interface{} {
+	payload := map[string]interface{}{
+		"facility": msg.FacilityName(),
+		"severity": msg.SeverityName(),
+		"message":  msg.Message,
+	}
+	optional := map[string]string{
+		"hostname": msg.Hostname,
+		"app_name": msg.AppName,
+		"proc_id":  msg.ProcID,
+		"msg_id":   msg.MsgID,
+	}
+	for k, v := range optional {
+		if v != "" {
+			payload[k] = v
+		}
+	}
+	if addr != nil {
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			payload["remote_addr"] = host
+		}
+	}
+	for id, params := range msg.StructuredData {
+		for name, value := range params {
+			payload["sd."+id+"."+name] = value
+		}
+	}
+	return payload
+}
+
+// publish sends queued messages to the API in batches until the queue is
+// closed.
+func (s *Server) publish() {
+	batch := make([]queuedLog, 0, publishBatchSize)
+	timer := time.NewTimer(publishBatchDelay)
+	defer timer.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		s.send(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case msg, ok := <-s.messages:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= publishBatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			if n := s.dropped.Swap(0); n > 0 {
+				log.Printf("WARN: dropped %d syslog messages because the queue to the API is full", n)
+			}
+			timer.Reset(publishBatchDelay)
+		}
+	}
+}
+
+// send queues a batch for each of its projects' batch endpoint as NDJSON, in
+// requests of at most maxRequestBytes. It waits while the senders are busy.
+func (s *Server) send(batch []queuedLog) {
+	var order []project
+	bodies := make(map[project][]byte)
+	for _, q := range batch {
+		body, ok := bodies[q.project]
+		if !ok {
+			order = append(order, q.project)
+		}
+		if len(body) > 0 && len(body)+len(q.entry)+1 > maxRequestBytes {
+			s.requests <- newRequest(q.project, body)
+			body = nil
+		}
+		bodies[q.project] = append(append(body, q.entry...), '\n')
+	}
+	for _, p := range order {
+		s.requests <- newRequest(p, bodies[p])
+	}
+}
+
+// transientError is a failed request worth trying again. retryAfter is the
+// API's Retry-After, if it sent one.
+type transientError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+
+// deliver posts a request, retrying transient failures with exponential
+// backoff. Once ctx is done each request gets one more attempt, so that
+// shutdown is not held up by an API that is down.
+func (s *Server) deliver(ctx context.Context, r request) {
+	n := bytes.Count(r.body, []byte{'\n'})
+	for attempt := 1; ; attempt++ {
+		err := s.post(r)
+		if err == nil {
+			return
+		}
+		var transient *transientError
+		if !errors.As(err, &transient) || attempt == maxPostAttempts || ctx.Err() != nil {
+			log.Printf("ERROR: dropping %d syslog messages for project %s after %d attempts: %v", n, r.project.id, attempt, err)
+			return
+		}
+		delay := retryDelay(attempt, transient.retryAfter)
+		if delay > maxRetryDelay {
+			log.Printf("WARN: dropping %d syslog messages for project %s: %v (retry after %v)", n, r.project.id, err, transient.retryAfter)
+			return
+		}
+		log.Printf("WARN: could not send %d syslog messages for project %s, retrying in %v: %v", n, r.project.id, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+}
+
+// retryDelay is the wait before the attempt after the given one: the API's
+// Retry-After if it sent one, otherwise minRetryDelay doubled for each failed
+// attempt, capped at maxRetryDelay and jittered down by up to half so that
+// replicas do not retry in step.
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	delay := maxRetryDelay
+	if attempt <= 16 {
+		delay = min(minRetryDelay<<(attempt-1), maxRetryDelay)
+	}
+	return delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)+1))
+}
+
+// transient reports whether a response status is worth retrying.
+func transient(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds.
+func parseRetryAfter(h string) time.Duration {
+	secs, err := strconv.Atoi(strings.TrimSpace(h))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// post sends one project's entries and logs the ones the API rejects. A
+// transport error, a 5xx or a 429 (over the project's rate limit or quota)
+// is returned as a *transientError.
+func (s *Server) post(r request) error {
+	p := r.project
+	url := strings.TrimSuffix(s.cfg.APIURL, "/") + "/api/projects/" + p.id + "/logs/batch"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(r.body))
+	if err != nil {
+		return fmt.Errorf("could not build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("X-API-KEY", p.apiKey)
+	req.Header.Set("Idempotency-Key", r.key)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &transientError{err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxRequestBytes))
+	if transient(resp.StatusCode) {
+		return &transientError{
+			err:        fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(respBody)),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	var result batchResponse
+	if json.Unmarshal(respBody, &result) != nil || result.Results == nil {
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(respBody))
+		}
+		return nil
+	}
+	for _, res := range result.Results {
+		if res.Status != "accepted" {
+			log.Printf("WARN: syslog message for project %s rejected: %s", p.id, res.Error)
+		}
+	}
+	return nil
+}
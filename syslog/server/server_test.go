@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"log-analysis-system/syslog/config"
+)
+
+func TestReadFrame(t *testing.T) {
+	big := strings.Repeat("x", maxMessageSize)
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{name: "octet counted", in: "5 hello3 abc", want: []string{"hello", "abc"}},
+		{name: "octet count covers spaces and newlines", in: "7 a b\nc d", want: []string{"a b\nc d"}},
+		{name: "newline delimited", in: "<13>one\n<13>two\n", want: []string{"<13>one\n", "<13>two\n"}},
+		{name: "last line without newline", in: "<13>one", want: []string{"<13>one"}},
+		{name: "largest allowed frame", in: strconv.Itoa(maxMessageSize) + " " + big, want: []string{big}},
+		{name: "count over the maximum", in: strconv.Itoa(maxMessageSize+1) + " x", wantErr: true},
+		{name: "count with a letter", in: "12a hello", wantErr: true},
+		{name: "count without a space", in: "12\nhello", wantErr: true},
+		{name: "endless digits", in: strings.Repeat("9", 1000), wantErr: true},
+		{name: "short frame", in: "10 abc", wantErr: true},
+		{name: "line longer than the maximum", in: "<" + big + "\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(tt.in), maxMessageSize)
+			var got []string
+			for {
+				frame, err := readFrame(r)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					if !tt.wantErr {
+						t.Fatalf("readFrame error: %v", err)
+					}
+					return
+				}
+				got = append(got, string(frame))
+			}
+			if tt.wantErr {
+				t.Fatalf("readFrame read %d frames, want an error", len(got))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("frames = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadOctetCountStopsEarly(t *testing.T) {
+	// A count that is already too large is rejected without reading the
+	// rest of the digits.
+	r := bufio.NewReader(strings.NewReader("1000000" + strings.Repeat("0", 100)))
+	if _, err := readOctetCount(r); err == nil {
+		t.Fatal("readOctetCount accepted an oversized count")
+	}
+	if r.Buffered() == 0 {
+		t.Error("readOctetCount consumed every digit")
+	}
+}
+
+func TestValidAPIKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"0123456789abcdef0123456789abcdef", true},
+		{"0123456789ABCDEF0123456789abcdef", false},
+		{"0123456789abcdef0123456789abcde", false},
+		{"0123456789abcdef0123456789abcdefa", false},
+		{"0123456789abcdef0123456789abcdeg", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validAPIKey(tt.in); got != tt.want {
+			t.Errorf("validAPIKey(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLookupProjectCache(t *testing.T) {
+	s := New(&config.Config{}, nil, nil)
+	loads := 0
+	lookup := func(key string) (project, error) {
+		return s.lookupProject(key, func() (project, error) {
+			loads++
+			if strings.HasPrefix(key, "miss") {
+				return project{}, sql.ErrNoRows
+			}
+			return project{id: key, apiKey: key}, nil
+		})
+	}
+
+	if p, err := lookup("p1"); err != nil || p.id != "p1" {
+		t.Fatalf("lookup(p1) = %+v, %v", p, err)
+	}
+	if _, err := lookup("miss1"); err == nil {
+		t.Fatal("lookup(miss1) succeeded")
+	}
+	lookup("p1")
+	lookup("miss1")
+	if loads != 2 {
+		t.Errorf("loads = %d after cached lookups, want 2", loads)
+	}
+
+	// Filling the cache evicts the least recently used entries, not p1,
+	// which is looked up again along the way.
+	for i := 0; i < maxCachedProjects; i++ {
+		lookup("miss" + strconv.Itoa(i+2))
+		if i%1000 == 0 {
+			lookup("p1")
+		}
+	}
+	if n := s.lru.Len(); n != maxCachedProjects || len(s.projects) != n {
+		t.Errorf("cache holds %d entries (%d in the map), want %d", n, len(s.projects), maxCachedProjects)
+	}
+	if _, ok := s.projects["miss1"]; ok {
+		t.Error("miss1 was not evicted")
+	}
+	loads = 0
+	lookup("p1")
+	if loads != 0 {
+		t.Error("p1 was evicted")
+	}
+}
+
+func TestPost(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		body       string
+		transient  bool
+		failed     bool
+		after      time.Duration
+	}{
+		{"accepted", http.StatusOK, "", `{"results":[{"index":0,"status":"accepted"}]}`, false, false, 0},
+		{"partly rejected", http.StatusMultiStatus, "", `{"results":[{"index":0,"status":"rejected","error":"bad"}]}`, false, false, 0},
+		{"bad request", http.StatusBadRequest, "", `invalid`, false, true, 0},
+		{"too large", http.StatusRequestEntityTooLarge, "", `{"error":"too large"}`, false, true, 0},
+		{"rate limited", http.StatusTooManyRequests, "3", `{"error":"rate limit"}`, true, true, 3 * time.Second},
+		{"unavailable", http.StatusServiceUnavailable, "", `down`, true, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/projects/p1/logs/batch" || r.Header.Get("X-API-KEY") != "k1" {
+					t.Errorf("request to %s with key %q", r.URL.Path, r.Header.Get("X-API-KEY"))
+				}
+				if r.Header.Get("Idempotency-Key") != "i1" {
+					t.Errorf("Idempotency-Key = %q, want i1", r.Header.Get("Idempotency-Key"))
+				}
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer api.Close()
+
+			s := New(&config.Config{APIURL: api.URL + "/"}, nil, api.Client())
+			err := s.post(request{project: project{id: "p1", apiKey: "k1"}, key: "i1", body: []byte("{}\n")})
+			if (err != nil) != tt.failed {
+				t.Fatalf("post() = %v, want failed=%v", err, tt.failed)
+			}
+			var transient *transientError
+			if errors.As(err, &transient) != tt.transient {
+				t.Fatalf("post() = %v, want transient=%v", err, tt.transient)
+			}
+			if transient != nil && transient.retryAfter != tt.after {
+				t.Errorf("retryAfter = %v, want %v", transient.retryAfter, tt.after)
+			}
+		})
+	}
+
+	s := New(&config.Config{APIURL: "http://127.0.0.1:0"}, nil, http.DefaultClient)
+	var transient *transientError
+	if err := s.post(newRequest(project{id: "p1"}, []byte("{}\n"))); !errors.As(err, &transient) {
+		t.Errorf("post() to a closed port = %v, want a transient error", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if got := retryDelay(1, 7*time.Second); got != 7*time.Second {
+		t.Errorf("retryDelay with Retry-After = %v, want 7s", got)
+	}
+	for attempt := 1; attempt <= 20; attempt++ {
+		ceiling := maxRetryDelay
+		if attempt < 8 {
+			ceiling = min(minRetryDelay<<(attempt-1), maxRetryDelay)
+		}
+		for i := 0; i < 50; i++ {
+			if got := retryDelay(attempt, 0); got < ceiling/2 || got > ceiling {
+				t.Fatalf("retryDelay(%d) = %v, want within [%v, %v]", attempt, got, ceiling/2, ceiling)
+			}
+		}
+	}
+}